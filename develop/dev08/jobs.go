@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+type jobState int
+
+const (
+	jobRunning jobState = iota
+	jobStopped
+	jobDone
+)
+
+// job is a command or a pipeline started by the shell. With job control its
+// processes share a process group, so that they are stopped, resumed and
+// given the terminal together; without it pgid is 0 and they stay in the
+// group of the shell.
+type job struct {
+	id         int
+	pgid       int
+	command    string
+	background bool
+	// procs holds the state of every process of the job by PID; last is
+	// the PID of the last process of the pipeline, whose wait status is
+	// the status of the job.
+	procs  map[int]jobState
+	last   int
+	status syscall.WaitStatus
+	// notified reports whether the current state has been reported.
+	notified bool
+}
+
+// state is stopped once no process is running and one of them is stopped,
+// and done once every process has exited.
+func (j *job) state() jobState {
+	state := jobDone
+	for _, procState := range j.procs {
+		if procState == jobRunning {
+			return jobRunning
+		}
+		if procState == jobStopped {
+			state = jobStopped
+		}
+	}
+	return state
+}
+
+// signal sends a signal to the process group of the job or, without job
+// control, to each of its processes that has not exited.
+func (j *job) signal(sig syscall.Signal) error {
+	if j.pgid != 0 {
+		return syscall.Kill(-j.pgid, sig)
+	}
+	for pid, state := range j.procs {
+		if state == jobDone {
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitStatus is the status of a command as && and || see it: its exit
+// code, or 128 plus the number of the signal that ended it.
+func exitStatus(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// describe returns the state as the jobs builtin shows it.
+func (j *job) describe() string {
+	switch j.state() {
+	case jobRunning:
+		return "Running"
+	case jobStopped:
+		return "Stopped"
+	}
+	switch {
+	case j.status.Signaled():
+		name := j.status.Signal().String()
+		return strings.ToUpper(name[:1]) + name[1:]
+	case j.status.ExitStatus() != 0:
+		return fmt.Sprintf("Exit %d", j.status.ExitStatus())
+	default:
+		return "Done"
+	}
+}
+
+// jobTable holds the jobs of the shell until they have finished and, for
+// background jobs, their end has been reported at a prompt.
+type jobTable struct {
+	jobs []*job
+	// recent orders the jobs by when they were last started, stopped or
+	// resumed; the last one is the current job.
+	recent []*job
+	// terminal is the file descriptor of the controlling terminal, or -1
+	// when the shell does not run on one, in which case there is no job
+	// control; pgid is the process group of the shell.
+	terminal int
+	pgid     int
+	signals  chan os.Signal
+}
+
+var jobs *jobTable
+
+// newJobTable takes the terminal when the shell is interactive and
+// standard input is one. An interactive shell catches the stop signals, so
+// that Ctrl-Z and reads from the background do not stop it, while its
+// children get the default behaviour back. A shell running a subshell
+// keeps the defaults and is stopped along with the job it belongs to.
+func newJobTable(interactive bool) *jobTable {
+	t := &jobTable{terminal: -1, pgid: syscall.Getpgrp()}
+	if !interactive {
+		return t
+	}
+	t.signals = make(chan os.Signal, 1)
+	signal.Notify(t.signals, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU)
+
+	fd := int(os.Stdin.Fd())
+	if _, err := tcgetpgrp(fd); err != nil {
+		return t
+	}
+	t.terminal = fd
+	if t.pgid != syscall.Getpid() && syscall.Setpgid(0, 0) == nil {
+		t.pgid = syscall.Getpid()
+	}
+	t.setForeground(t.pgid)
+	return t
+}
+
+// setForeground gives the terminal to a process group. SIGTTOU is ignored
+// meanwhile, as the shell is not in the foreground when it takes the
+// terminal back.
+func (t *jobTable) setForeground(pgid int) {
+	if t.terminal < 0 {
+		return
+	}
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Notify(t.signals, syscall.SIGTTOU)
+	if err := tcsetpgrp(t.terminal, pgid); err != nil {
+		fmt.Println("job control error:", err)
+	}
+}
+
+func tcgetpgrp(fd int) (int, error) {
+	var pgid int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgid)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
+
+func tcsetpgrp(fd, pgid int) error {
+	id := int32(pgid)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&id)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// start runs the commands of a pipeline as a new job and returns its
+// status. A foreground job is given the terminal and waited for; a
+// background job is announced with its number and the PID of its last
+// process, and its status is 0. A job none of whose commands could be
+// started has status 127.
+func (t *jobTable) start(pipeline [][]string, command string, background bool) int {
+	j := &job{command: command, background: background, procs: make(map[int]jobState)}
+	stdin := os.Stdin
+	if background && t.terminal < 0 {
+		// Without job control nothing keeps a background job from reading
+		// the input of the shell, so it reads /dev/null instead.
+		if devNull, err := os.Open(os.DevNull); err == nil {
+			stdin = devNull
+		}
+	}
+	for i, args := range pipeline {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = stdin
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+		var next, pipe *os.File
+		if i < len(pipeline)-1 {
+			var err error
+			if next, pipe, err = os.Pipe(); err != nil {
+				fmt.Println("Error starting command:", err)
+				break
+			}
+			// The output of the current command goes to the input of the next one
+			cmd.Stdout = pipe
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: t.terminal >= 0, Pgid: j.pgid}
+		if j.pgid == 0 && !background && t.terminal >= 0 {
+			// The first process puts the group in the foreground before
+			// it runs; fd 0 of the child is the terminal.
+			cmd.SysProcAttr.Foreground = true
+			cmd.SysProcAttr.Ctty = 0
+		}
+
+		err := cmd.Start()
+		if pipe != nil {
+			pipe.Close()
+		}
+		if stdin != os.Stdin {
+			stdin.Close()
+		}
+		stdin = next
+		if err != nil {
+			fmt.Printf("Command execution error: %s\n", err)
+			continue
+		}
+		pid := cmd.Process.Pid
+		cmd.Process.Release()
+		if j.pgid == 0 && t.terminal >= 0 {
+			j.pgid = pid
+		}
+		j.procs[pid] = jobRunning
+		j.last = pid
+	}
+	if stdin != os.Stdin && stdin != nil {
+		stdin.Close()
+	}
+	if len(j.procs) == 0 {
+		return 127
+	}
+
+	t.add(j)
+	if background {
+		fmt.Printf("[%d] %d\n", j.id, j.last)
+		return 0
+	}
+	return t.foreground(j)
+}
+
+func (t *jobTable) add(j *job) {
+	j.id = 1
+	for _, other := range t.jobs {
+		if other.id >= j.id {
+			j.id = other.id + 1
+		}
+	}
+	t.jobs = append(t.jobs, j)
+	t.touch(j)
+}
+
+// touch makes the job the current one.
+func (t *jobTable) touch(j *job) {
+	for i, other := range t.recent {
+		if other == j {
+			t.recent = append(t.recent[:i], t.recent[i+1:]...)
+			break
+		}
+	}
+	t.recent = append(t.recent, j)
+}
+
+func (t *jobTable) remove(j *job) {
+	for i, other := range t.jobs {
+		if other == j {
+			t.jobs = append(t.jobs[:i], t.jobs[i+1:]...)
+			break
+		}
+	}
+	for i, other := range t.recent {
+		if other == j {
+			t.recent = append(t.recent[:i], t.recent[i+1:]...)
+			break
+		}
+	}
+}
+
+// foreground gives the terminal to the job and waits until it has
+// finished or has been stopped, then takes the terminal back and returns
+// the status of the job, 148 when it has been stopped. A stopped job stays
+// in the table. Background jobs that change state meanwhile are recorded
+// for the next prompt.
+func (t *jobTable) foreground(j *job) int {
+	j.background = false
+	options := 0
+	if t.terminal >= 0 {
+		options = syscall.WUNTRACED
+	}
+	for j.state() == jobRunning {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, options, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		t.update(pid, status)
+	}
+	t.setForeground(t.pgid)
+
+	switch j.state() {
+	case jobStopped:
+		t.touch(j)
+		j.background = true
+		j.notified = true
+		fmt.Println()
+		t.print(j)
+		return 128 + int(syscall.SIGTSTP)
+	case jobDone:
+		// A failure shows in the status, which && and || act on; only
+		// a job killed by a signal is reported.
+		t.remove(j)
+		if j.status.Signaled() {
+			fmt.Printf("Command execution error: signal: %s\n", j.status.Signal())
+		}
+	}
+	return exitStatus(j.status)
+}
+
+// update records a state change of a process of a job.
+func (t *jobTable) update(pid int, status syscall.WaitStatus) {
+	for _, j := range t.jobs {
+		if _, ok := j.procs[pid]; !ok {
+			continue
+		}
+		switch {
+		case status.Stopped():
+			j.procs[pid] = jobStopped
+		case status.Continued():
+			j.procs[pid] = jobRunning
+		default:
+			j.procs[pid] = jobDone
+			if pid == j.last {
+				j.status = status
+			}
+		}
+		j.notified = false
+		return
+	}
+}
+
+// notify collects the state changes of the background jobs without
+// waiting and reports the jobs that have finished or have been stopped
+// since the last prompt.
+func (t *jobTable) notify() {
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG|syscall.WUNTRACED|syscall.WCONTINUED, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			break
+		}
+		t.update(pid, status)
+	}
+
+	for _, j := range append([]*job(nil), t.jobs...) {
+		switch state := j.state(); {
+		case state == jobDone:
+			t.print(j)
+			t.remove(j)
+		case state == jobStopped && !j.notified:
+			j.notified = true
+			t.print(j)
+		}
+	}
+}
+
+// print shows a job the way the jobs builtin lists it:
+//
+//	[1]+  Running                 sleep 100 &
+func (t *jobTable) print(j *job) {
+	mark := ' '
+	if n := len(t.recent); n > 0 && t.recent[n-1] == j {
+		mark = '+'
+	} else if n > 1 && t.recent[n-2] == j {
+		mark = '-'
+	}
+	command := j.command
+	if j.state() == jobRunning && j.background {
+		command += " &"
+	}
+	fmt.Printf("[%d]%c  %-24s%s\n", j.id, mark, j.describe(), command)
+}
+
+// lookup finds a job by a specification such as %2, 2, %+ or %-; an empty
+// one is the current job.
+func (t *jobTable) lookup(spec string) (*job, error) {
+	n := len(t.recent)
+	switch spec {
+	case "", "%", "%%", "%+":
+		if n == 0 {
+			return nil, fmt.Errorf("no current job")
+		}
+		return t.recent[n-1], nil
+	case "%-":
+		if n < 2 {
+			return nil, fmt.Errorf("no previous job")
+		}
+		return t.recent[n-2], nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(spec, "%"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	for _, j := range t.jobs {
+		if j.id == id {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no such job", spec)
+}
+
+// resume sends SIGCONT to the stopped processes of the job.
+func (t *jobTable) resume(j *job) error {
+	if err := j.signal(syscall.SIGCONT); err != nil {
+		return err
+	}
+	for pid, state := range j.procs {
+		if state == jobStopped {
+			j.procs[pid] = jobRunning
+		}
+	}
+	t.touch(j)
+	return nil
+}
+
+func handleJobs() int {
+	jobs.notify()
+	sorted := append([]*job(nil), jobs.jobs...)
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i].id < sorted[k].id })
+	for _, j := range sorted {
+		jobs.print(j)
+	}
+	return 0
+}
+
+func handleFg(args []string) int {
+	j, err := jobs.lookup(jobArg(args))
+	if err != nil {
+		fmt.Println("fg:", err)
+		return 1
+	}
+	fmt.Println(j.command)
+	jobs.setForeground(j.pgid)
+	if j.state() == jobStopped {
+		if err := jobs.resume(j); err != nil {
+			jobs.setForeground(jobs.pgid)
+			fmt.Println("fg error:", err)
+			return 1
+		}
+	}
+	return jobs.foreground(j)
+}
+
+func handleBg(args []string) int {
+	j, err := jobs.lookup(jobArg(args))
+	if err != nil {
+		fmt.Println("bg:", err)
+		return 1
+	}
+	if j.state() != jobStopped {
+		fmt.Printf("bg: job %d already in background\n", j.id)
+		return 0
+	}
+	if err := jobs.resume(j); err != nil {
+		fmt.Println("bg error:", err)
+		return 1
+	}
+	j.background = true
+	j.notified = true
+	fmt.Printf("[%d]+ %s &\n", j.id, j.command)
+	return 0
+}
+
+func jobArg(args []string) string {
+	if len(args) < 2 {
+		return ""
+	}
+	return args[1]
+}
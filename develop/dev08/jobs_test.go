@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestJobState(t *testing.T) {
+	exited := func(code int) syscall.WaitStatus { return syscall.WaitStatus(code << 8) }
+	tests := []struct {
+		procs    []jobState
+		status   syscall.WaitStatus
+		expected string
+	}{
+		{[]jobState{jobRunning, jobStopped}, 0, "Running"},
+		{[]jobState{jobDone, jobStopped}, 0, "Stopped"},
+		{[]jobState{jobDone, jobDone}, exited(0), "Done"},
+		{[]jobState{jobDone}, exited(2), "Exit 2"},
+		{[]jobState{jobDone}, syscall.WaitStatus(syscall.SIGKILL), "Killed"},
+	}
+
+	for _, tt := range tests {
+		j := &job{procs: make(map[int]jobState), status: tt.status}
+		for pid, state := range tt.procs {
+			j.procs[pid] = state
+		}
+		if got := j.describe(); got != tt.expected {
+			t.Errorf("describe() of %v with status %#x = %q, expected %q", tt.procs, tt.status, got, tt.expected)
+		}
+	}
+}
+
+func TestJobLookup(t *testing.T) {
+	table := &jobTable{terminal: -1}
+	for i := 0; i < 3; i++ {
+		table.add(&job{procs: map[int]jobState{i: jobRunning}})
+	}
+	table.remove(table.jobs[1])
+	table.touch(table.jobs[0])
+
+	tests := []struct {
+		spec     string
+		expected int
+		err      bool
+	}{
+		{"", 1, false},
+		{"%+", 1, false},
+		{"%%", 1, false},
+		{"%-", 3, false},
+		{"%3", 3, false},
+		{"3", 3, false},
+		{"%2", 0, true},
+		{"%x", 0, true},
+	}
+
+	for _, tt := range tests {
+		j, err := table.lookup(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("lookup(%q) error = %v, expected error = %v", tt.spec, err, tt.err)
+			continue
+		}
+		if err == nil && j.id != tt.expected {
+			t.Errorf("lookup(%q) = job %d, expected %d", tt.spec, j.id, tt.expected)
+		}
+	}
+
+	table.add(&job{procs: map[int]jobState{9: jobRunning}})
+	if id := table.jobs[len(table.jobs)-1].id; id != 4 {
+		t.Errorf("new job numbered %d, expected 4", id)
+	}
+}
+
+// openPTY opens a new pseudo-terminal and returns its master and slave.
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, nil, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		master.Close()
+		return nil, nil, errno
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// With job control, Ctrl-Z stops the foreground job and gives the terminal
+// back to the shell, and fg gives it to the job again.
+func TestJobControl(t *testing.T) {
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skip("no pseudo-terminal:", err)
+	}
+	defer master.Close()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DEV08_SHELL=1", "GORACE=atexit_sleep_ms=0")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	slave.Close()
+	shell := cmd.Process.Pid
+	defer cmd.Process.Kill()
+
+	var mu sync.Mutex
+	var out bytes.Buffer
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := master.Read(buf)
+			mu.Lock()
+			out.Write(buf[:n])
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	output := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.String()
+	}
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s; output:\n%s", what, output())
+			}
+		}
+	}
+	prompts := func(n int) func() bool {
+		return func() bool { return strings.Count(output(), "my_shell> ") >= n }
+	}
+	foreground := func() int {
+		pgid, _ := tcgetpgrp(int(master.Fd()))
+		return pgid
+	}
+
+	waitFor("the prompt", prompts(1))
+	if foreground() != shell {
+		t.Fatalf("foreground group %d, expected the shell %d", foreground(), shell)
+	}
+	master.WriteString("sleep 1\n")
+	waitFor("sleep in the foreground", func() bool { pgid := foreground(); return pgid != 0 && pgid != shell })
+	master.WriteString("\x1a")
+	waitFor("the stopped job", prompts(2))
+	if !strings.Contains(output(), "[1]+  Stopped                 sleep 1\r\n") {
+		t.Errorf("stopped job not reported:\n%s", output())
+	}
+	if foreground() != shell {
+		t.Errorf("foreground group %d after Ctrl-Z, expected the shell %d", foreground(), shell)
+	}
+
+	master.WriteString("fg\n")
+	waitFor("the job to finish", prompts(3))
+	master.WriteString("jobs\n")
+	waitFor("the jobs", prompts(4))
+	resumed := output()[strings.Index(output(), "fg\r\n"):]
+	if resumed != "fg\r\nsleep 1\r\nmy_shell> jobs\r\nmy_shell> " {
+		t.Errorf("output after fg %q", resumed)
+	}
+
+	master.WriteString("exit\n")
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("shell exited with %v:\n%s", err, output())
+	}
+}
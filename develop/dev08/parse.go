@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A command line is parsed into a tree following this grammar:
+//
+//	list     = andOr { (";" | "&") andOr } [";" | "&"]
+//	andOr    = pipeline { ("&&" | "||") pipeline }
+//	pipeline = command { "|" command }
+//	command  = word { word } | "(" list ")"
+//
+// Words may be quoted: single quotes keep everything up to the closing
+// quote, double quotes keep everything but the backslash escapes of \, ",
+// $ and `, and outside of quotes a backslash escapes any character. A #
+// at the start of a word comments out the rest of the line.
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenPipe
+	tokenOr
+	tokenBackground
+	tokenAnd
+	tokenSemicolon
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+// token is a word, with its quotes and escapes removed, or an operator,
+// found at byte offset pos of the input.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// syntaxError reports input that is not a valid command line.
+type syntaxError struct {
+	pos     int
+	message string
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("syntax error at column %d: %s", e.pos+1, e.message)
+}
+
+// operators are the operator tokens, longest first.
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	{"||", tokenOr},
+	{"&&", tokenAnd},
+	{"|", tokenPipe},
+	{"&", tokenBackground},
+	{";", tokenSemicolon},
+	{"(", tokenOpen},
+	{")", tokenClose},
+}
+
+// tokenize splits the input into words and operators, ending with a
+// tokenEnd.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+next:
+	for i < len(input) {
+		switch input[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+			continue
+		case '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		for _, op := range operators {
+			if strings.HasPrefix(input[i:], op.text) {
+				tokens = append(tokens, token{kind: op.kind, text: op.text, pos: i})
+				i += len(op.text)
+				continue next
+			}
+		}
+
+		word, end, err := scanWord(input, i)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token{kind: tokenWord, text: word, pos: i})
+		i = end
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(input)}), nil
+}
+
+// scanWord reads the word starting at i up to the next unquoted blank or
+// operator and returns it without quotes and escapes, along with the
+// offset it ends at.
+func scanWord(input string, i int) (string, int, error) {
+	var b strings.Builder
+	for i < len(input) {
+		switch c := input[i]; c {
+		case ' ', '\t', '\r', '\n', '|', '&', ';', '(', ')':
+			return b.String(), i, nil
+		case '\\':
+			if i+1 == len(input) {
+				return "", 0, &syntaxError{i, "unexpected end of input after \\"}
+			}
+			// An escaped newline continues the line.
+			if input[i+1] != '\n' {
+				b.WriteByte(input[i+1])
+			}
+			i += 2
+		case '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end < 0 {
+				return "", 0, &syntaxError{i, "unterminated single quote"}
+			}
+			b.WriteString(input[i+1 : i+1+end])
+			i += end + 2
+		case '"':
+			start := i
+			for i++; ; i++ {
+				if i == len(input) {
+					return "", 0, &syntaxError{start, "unterminated double quote"}
+				}
+				if input[i] == '"' {
+					i++
+					break
+				}
+				if input[i] == '\\' && i+1 < len(input) && strings.IndexByte("\\\"$`\n", input[i+1]) >= 0 {
+					i++
+					if input[i] == '\n' {
+						continue
+					}
+				}
+				b.WriteByte(input[i])
+			}
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), i, nil
+}
+
+// list is a sequence of and-or lists, each run in the foreground or, when
+// it is followed by &, as a background job.
+type list struct {
+	items []listItem
+}
+
+type listItem struct {
+	andOr      *andOr
+	background bool
+}
+
+// andOr is a chain of pipelines; ops[i] is && or || and decides from the
+// status of pipelines[i] whether pipelines[i+1] runs.
+type andOr struct {
+	pipelines []*pipeline
+	ops       []tokenKind
+}
+
+type pipeline struct {
+	commands []command
+}
+
+// command is a simpleCommand or a subshell.
+type command interface {
+	String() string
+}
+
+type simpleCommand struct {
+	args []string
+}
+
+type subshell struct {
+	body *list
+}
+
+// The String methods print the tree back as a command line that parses
+// into the same tree.
+
+func (l *list) String() string {
+	var b strings.Builder
+	for i, item := range l.items {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(item.andOr.String())
+		if item.background {
+			b.WriteString(" &")
+		} else if i < len(l.items)-1 {
+			b.WriteString(";")
+		}
+	}
+	return b.String()
+}
+
+func (a *andOr) String() string {
+	var b strings.Builder
+	b.WriteString(a.pipelines[0].String())
+	for i, op := range a.ops {
+		if op == tokenAnd {
+			b.WriteString(" && ")
+		} else {
+			b.WriteString(" || ")
+		}
+		b.WriteString(a.pipelines[i+1].String())
+	}
+	return b.String()
+}
+
+func (p *pipeline) String() string {
+	commands := make([]string, len(p.commands))
+	for i, cmd := range p.commands {
+		commands[i] = cmd.String()
+	}
+	return strings.Join(commands, " | ")
+}
+
+func (c *simpleCommand) String() string {
+	words := make([]string, len(c.args))
+	for i, arg := range c.args {
+		words[i] = quote(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+func (s *subshell) String() string {
+	return "(" + s.body.String() + ")"
+}
+
+// quote returns the word as is when the lexer reads it back unchanged and
+// single-quoted otherwise.
+func quote(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\r\n|&;()'\"\\#") {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a command line. A blank line or a comment is an empty list.
+func parse(input string) (*list, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	l, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEnd {
+		return nil, p.unexpected(tok)
+	}
+	return l, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok
+}
+
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokenEnd {
+		return &syntaxError{tok.pos, "unexpected end of input"}
+	}
+	return &syntaxError{tok.pos, fmt.Sprintf("unexpected %q", tok.text)}
+}
+
+// startsCommand reports whether the token can begin a command.
+func startsCommand(tok token) bool {
+	return tok.kind == tokenWord || tok.kind == tokenOpen
+}
+
+func (p *parser) list() (*list, error) {
+	l := &list{}
+	for startsCommand(p.peek()) {
+		a, err := p.andOr()
+		if err != nil {
+			return nil, err
+		}
+		item := listItem{andOr: a}
+		switch p.peek().kind {
+		case tokenBackground:
+			item.background = true
+			p.next()
+		case tokenSemicolon:
+			p.next()
+		}
+		l.items = append(l.items, item)
+		if kind := p.tokens[p.pos-1].kind; kind != tokenBackground && kind != tokenSemicolon {
+			break
+		}
+	}
+	return l, nil
+}
+
+func (p *parser) andOr() (*andOr, error) {
+	first, err := p.pipeline()
+	if err != nil {
+		return nil, err
+	}
+	a := &andOr{pipelines: []*pipeline{first}}
+	for kind := p.peek().kind; kind == tokenAnd || kind == tokenOr; kind = p.peek().kind {
+		p.next()
+		next, err := p.pipeline()
+		if err != nil {
+			return nil, err
+		}
+		a.ops = append(a.ops, kind)
+		a.pipelines = append(a.pipelines, next)
+	}
+	return a, nil
+}
+
+func (p *parser) pipeline() (*pipeline, error) {
+	pl := &pipeline{}
+	for {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		pl.commands = append(pl.commands, cmd)
+		if p.peek().kind != tokenPipe {
+			return pl, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) command() (command, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenWord:
+		cmd := &simpleCommand{}
+		for p.peek().kind == tokenWord {
+			cmd.args = append(cmd.args, p.next().text)
+		}
+		return cmd, nil
+	case tokenOpen:
+		p.next()
+		body, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		if len(body.items) == 0 || p.peek().kind != tokenClose {
+			return nil, p.unexpected(p.peek())
+		}
+		p.next()
+		return &subshell{body: body}, nil
+	default:
+		return nil, p.unexpected(tok)
+	}
+}
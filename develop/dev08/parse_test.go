@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`echo "a | b"`, []string{"echo", "a | b"}},
+		{`echo 'it''s' "say \"hi\" \n" a\ b`, []string{"echo", "its", `say "hi" \n`, "a b"}},
+		{`echo ""`, []string{"echo", ""}},
+		{"ls|wc -l&&echo ok||(pwd;cd)&", []string{"ls", "|", "wc", "-l", "&&", "echo", "ok", "||", "(", "pwd", ";", "cd", ")", "&"}},
+		{"echo a#b # comment", []string{"echo", "a#b"}},
+		{"echo 'a\nb' c\\\nd", []string{"echo", "a\nb", "cd"}},
+		{"  # only a comment", nil},
+	}
+
+	for _, tt := range tests {
+		tokens, err := tokenize(tt.input)
+		if err != nil {
+			t.Errorf("tokenize(%q) error: %v", tt.input, err)
+			continue
+		}
+		var got []string
+		for _, tok := range tokens[:len(tokens)-1] {
+			got = append(got, tok.text)
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("tokenize(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{"", "", ""},
+		{`echo "a | b" | tr a b`, "echo 'a | b' | tr a b", ""},
+		{"cd /tmp;pwd;", "cd /tmp; pwd", ""},
+		{"sleep 1 & sleep 2 &", "sleep 1 & sleep 2 &", ""},
+		{"false && echo a || echo b", "false && echo a || echo b", ""},
+		{"(cd /; ls | wc) | cat && (true)", "(cd /; ls | wc) | cat && (true)", ""},
+		{`echo "it's"`, `echo 'it'\''s'`, ""},
+		{"echo 'a", "", "syntax error at column 6: unterminated single quote"},
+		{`echo "a`, "", "syntax error at column 6: unterminated double quote"},
+		{`echo a\`, "", `syntax error at column 7: unexpected end of input after \`},
+		{"ls |", "", "syntax error at column 5: unexpected end of input"},
+		{"| ls", "", `syntax error at column 1: unexpected "|"`},
+		{"ls && ; pwd", "", `syntax error at column 7: unexpected ";"`},
+		{"ls;;", "", `syntax error at column 4: unexpected ";"`},
+		{"(ls", "", "syntax error at column 4: unexpected end of input"},
+		{"()", "", `syntax error at column 2: unexpected ")"`},
+		{"ls)", "", `syntax error at column 3: unexpected ")"`},
+		{"(ls) pwd", "", `syntax error at column 6: unexpected "pwd"`},
+	}
+
+	for _, tt := range tests {
+		tree, err := parse(tt.input)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parse(%q) error = %v, expected %q", tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%q) error: %v", tt.input, err)
+			continue
+		}
+		if got := tree.String(); got != tt.expected {
+			t.Errorf("parse(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+		// The printed tree is what subshells and job listings run and show.
+		if again, err := parse(tree.String()); err != nil || !reflect.DeepEqual(again, tree) {
+			t.Errorf("parse(%q) does not give back the tree of %q", tree.String(), tt.input)
+		}
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	jobs = newJobTable(false)
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"true", 0},
+		{"false", 1},
+		{"false && true", 1},
+		{"false || true", 0},
+		{"true || false && false", 1},
+		{"false; true", 0},
+		{"true | false", 1},
+		{"cd", 1},
+		{"no-such-command-here", 127},
+	}
+
+	for _, tt := range tests {
+		tree, err := parse(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := run(tree); got != tt.expected {
+			t.Errorf("run(%q) = %d, expected %d", tt.input, got, tt.expected)
+		}
+	}
+}
@@ -3,60 +3,146 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
+// shellPath is the program run for subshells, with -c and their body.
+var shellPath = "/proc/self/exe"
+
 func main() {
+	if path, err := os.Executable(); err == nil {
+		shellPath = path
+	}
+	if len(os.Args) > 2 && os.Args[1] == "-c" {
+		jobs = newJobTable(false)
+		tree, err := parse(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		os.Exit(run(tree))
+	}
+
 	reader := bufio.NewReader(os.Stdin)
+	jobs = newJobTable(true)
 
 	for {
+		jobs.notify()
 		fmt.Print("my_shell> ")
 		input, err := reader.ReadString('\n')
-		if err != nil {
+		if err == io.EOF && input == "" {
+			fmt.Println()
+			return
+		}
+		if err != nil && err != io.EOF {
 			fmt.Println("Error reading input:", err)
 			continue
 		}
 
-		input = strings.TrimSpace(input)
-
-		if input == "exit" {
-			break
+		tree, err := parse(input)
+		if err != nil {
+			fmt.Println(err)
+			continue
 		}
+		run(tree)
+	}
+}
 
-		commands := strings.Split(input, "|")
-
-		if len(commands) > 1 {
-			handlePipelines(commands)
+// run executes a command line and returns the status of the last and-or
+// list run.
+func run(l *list) int {
+	status := 0
+	for _, item := range l.items {
+		if item.background {
+			status = runBackground(item.andOr)
 		} else {
-			executeCommand(strings.Fields(input))
+			status = runAndOr(item.andOr)
 		}
 	}
+	return status
 }
 
-func executeCommand(args []string) {
-	if len(args) == 0 {
-		return
+// runAndOr runs the first pipeline, then each following one whose operator
+// matches the last status: && runs it after a success and || after a
+// failure.
+func runAndOr(a *andOr) int {
+	status := runPipeline(a.pipelines[0], false)
+	for i, op := range a.ops {
+		if (status == 0) == (op == tokenAnd) {
+			status = runPipeline(a.pipelines[i+1], false)
+		}
+	}
+	return status
+}
+
+// runBackground starts an and-or list as a background job. A chain of
+// pipelines runs in a subshell, which waits for them in turn.
+func runBackground(a *andOr) int {
+	if len(a.pipelines) == 1 {
+		return runPipeline(a.pipelines[0], true)
+	}
+	return jobs.start([][]string{subshellArgs(a.String())}, a.String(), true)
+}
+
+// runPipeline runs a lone simple command through executeCommand, so that
+// builtins run in the shell itself. A builtin run in the background runs
+// in a subshell instead, as in other shells, so that cd & cannot change
+// the directory of the shell behind its back. In a longer pipeline every
+// simple command is a program and every subshell a new shell process.
+func runPipeline(p *pipeline, background bool) int {
+	if cmd, ok := p.commands[0].(*simpleCommand); ok && len(p.commands) == 1 {
+		if background && builtins[cmd.args[0]] {
+			return jobs.start([][]string{subshellArgs(p.String())}, p.String(), true)
+		}
+		return executeCommand(cmd.args, p.String(), background)
 	}
+	stages := make([][]string, len(p.commands))
+	for i, cmd := range p.commands {
+		switch cmd := cmd.(type) {
+		case *simpleCommand:
+			stages[i] = cmd.args
+		case *subshell:
+			stages[i] = subshellArgs(cmd.body.String())
+		}
+	}
+	return jobs.start(stages, p.String(), background)
+}
+
+func subshellArgs(script string) []string {
+	return []string{shellPath, "-c", script}
+}
+
+var builtins = map[string]bool{
+	"cd": true, "pwd": true, "echo": true, "kill": true, "ps": true,
+	"jobs": true, "fg": true, "bg": true, "exit": true,
+}
 
+// executeCommand runs a builtin or starts a program as a job, and returns
+// its status.
+func executeCommand(args []string, command string, background bool) int {
 	switch args[0] {
 	case "cd":
 		if len(args) < 2 {
 			fmt.Println("cd: argument required")
-			return
+			return 1
 		}
 		if err := os.Chdir(args[1]); err != nil {
 			fmt.Println("cd error:", err)
+			return 1
 		}
 
 	case "pwd":
-		if dir, err := os.Getwd(); err == nil {
-			fmt.Println(dir)
-		} else {
+		dir, err := os.Getwd()
+		if err != nil {
 			fmt.Println("pwd error:", err)
+			return 1
 		}
+		fmt.Println(dir)
 
 	case "echo":
 		fmt.Println(strings.Join(args[1:], " "))
@@ -64,83 +150,76 @@ func executeCommand(args []string) {
 	case "kill":
 		if len(args) < 2 {
 			fmt.Println("kill: argument required")
-			return
+			return 1
+		}
+		if strings.HasPrefix(args[1], "%") {
+			return killJob(args[1])
 		}
 		pid, err := strconv.Atoi(args[1])
 		if err != nil {
 			fmt.Println("kill error:", err)
-			return
+			return 1
 		}
-		terminateProcess(pid)
+		return terminateProcess(pid)
 	case "ps":
 		cmd := exec.Command("ps")
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
 			fmt.Println("ps error:", err)
+			return 1
 		}
 
-	default:
-		externalCommand(args)
-	}
-}
-
-func handlePipelines(commands []string) {
-	var cmds []*exec.Cmd
+	case "jobs":
+		return handleJobs()
 
-	for i, command := range commands {
-		args := strings.Fields(strings.TrimSpace(command))
-		if len(args) == 0 {
-			continue
-		}
+	case "fg":
+		return handleFg(args)
 
-		cmd := exec.Command(args[0], args[1:]...)
-		if i > 0 {
-			// Set the input of the current command to the output of the previous one
-			cmd.Stdin, _ = cmds[i-1].StdoutPipe()
-		}
-		if i < len(commands)-1 {
-			// The output of the current command goes to the input of the next one
-			cmd.Stdout = nil
-		} else {
-			// Last command in pipeline outputs to stdout
-			cmd.Stdout = os.Stdout
-		}
-		cmd.Stderr = os.Stderr
+	case "bg":
+		return handleBg(args)
 
-		if err := cmd.Start(); err != nil {
-			fmt.Println("Error starting command:", err)
-			return
+	case "exit":
+		status := 0
+		if len(args) > 1 {
+			var err error
+			if status, err = strconv.Atoi(args[1]); err != nil {
+				fmt.Println("exit error:", err)
+				return 1
+			}
 		}
+		os.Exit(status)
 
-		cmds = append(cmds, cmd)
-	}
-
-	for _, cmd := range cmds {
-		cmd.Wait()
-	}
-}
-
-func externalCommand(args []string) {
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Command execution error: %s\n", err)
+	default:
+		return jobs.start([][]string{args}, command, background)
 	}
+	return 0
 }
 
-func terminateProcess(pid int) {
+func terminateProcess(pid int) int {
 	proc, err := os.FindProcess(pid)
 	if err != nil {
 		fmt.Printf("kill error: %v\n", err)
-		return
+		return 1
 	}
 	if err := proc.Kill(); err != nil {
 		fmt.Printf("kill error: %v\n", err)
-	} else {
-		fmt.Printf("Process %d killed\n", pid)
+		return 1
+	}
+	fmt.Printf("Process %d killed\n", pid)
+	return 0
+}
+
+// killJob kills every process of a job given as %n.
+func killJob(spec string) int {
+	j, err := jobs.lookup(spec)
+	if err != nil {
+		fmt.Println("kill:", err)
+		return 1
+	}
+	if err := j.signal(syscall.SIGKILL); err != nil {
+		fmt.Printf("kill error: %v\n", err)
+		return 1
 	}
+	return 0
 }
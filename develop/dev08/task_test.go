@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// With DEV08_SHELL set the test binary is the shell, so that the tests can
+// run it as a process, and so can the shell for its subshells.
+func TestMain(m *testing.M) {
+	if os.Getenv("DEV08_SHELL") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+var jobStarted = regexp.MustCompile(`\[(\d+)\] \d+\n`)
+
+// runShell runs the shell with the arguments in dir, feeding it input, and
+// returns its output without the prompts and with the PIDs of started
+// jobs left out, and its exit status.
+func runShell(t *testing.T, dir, input string, args ...string) (string, int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], args...)
+	cmd.Dir = dir
+	// Under the race detector every process would otherwise sleep a second
+	// before it exits, subshells included.
+	cmd.Env = append(os.Environ(), "DEV08_SHELL=1", "GORACE=atexit_sleep_ms=0")
+	cmd.Stdin = strings.NewReader(input)
+	// A job left running must not keep the output open.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		t.Fatalf("shell did not finish: %s", out)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	return jobStarted.ReplaceAllString(strings.ReplaceAll(string(out), "my_shell> ", ""), "[$1] PID\n"), cmd.ProcessState.ExitCode()
+}
+
+func TestShellJobs(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"fail.sh":  "sleep 0.2; exit 1\n",
+		"stop.sh":  "kill -STOP $$; sleep 0.2; echo resumed\n",
+		"stdin.sh": "sleep 0.1; readlink /proc/self/fd/0\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"finished job reported and reaped",
+			"sleep 0.1 &\njobs\nsleep 0.5\njobs\necho end\nexit\n",
+			"[1] PID\n" +
+				"[1]+  Running                 sleep 0.1 &\n" +
+				"[1]+  Done                    sleep 0.1\n" +
+				"end\n"},
+		{"failed and killed jobs",
+			"sleep 100 &\nsh fail.sh &\nkill %1\nsleep 0.5\necho end\nexit\n",
+			"[1] PID\n[2] PID\n" +
+				"[1]-  Killed                  sleep 100\n" +
+				"[2]+  Exit 1                  sh fail.sh\n" +
+				"end\n"},
+		{"stopped job resumed with bg and waited for with fg",
+			"sh stop.sh &\nsleep 0.3\njobs\nbg\nfg %1\njobs\necho end\nexit\n",
+			"[1] PID\n" +
+				"[1]+  Stopped                 sh stop.sh\n" +
+				"[1]+  Stopped                 sh stop.sh\n" +
+				"[1]+ sh stop.sh &\n" +
+				"sh stop.sh\n" +
+				"resumed\n" +
+				"end\n"},
+		{"no jobs",
+			"fg\nbg %3\necho end\nexit\n",
+			"fg: no current job\nbg: %3: no such job\nend\n"},
+		{"builtin in the background",
+			"cd / &\nsleep 0.3\npwd\nexit\n",
+			"[1] PID\n[1]+  Done                    cd /\n" + dir + "\n"},
+		{"background job reads /dev/null",
+			"sh stdin.sh &\nsleep 0.3\necho end\nexit\n",
+			"[1] PID\n/dev/null\n[1]+  Done                    sh stdin.sh\nend\n"},
+		{"and-or list in the background",
+			"false || echo recovered &\nsleep 0.3\necho end\nexit\n",
+			"[1] PID\nrecovered\n[1]+  Done                    false || echo recovered\nend\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := runShell(t, dir, tt.input); got != tt.expected {
+				t.Errorf("output:\n%s\nexpected:\n%s", got, tt.expected)
+			}
+		})
+	}
+}
+
+// Subshells run in a new shell process, the shell itself started again
+// with -c and the subshell as its script.
+func TestShellSubshells(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		script   string
+		expected string
+		status   int
+	}{
+		{"(echo a; echo b) | cat", "a\nb\n", 0},
+		{"false || (echo ok)", "ok\n", 0},
+		{"true && (false)", "", 1},
+		{"(exit 3) || echo failed", "failed\n", 0},
+		{"(exit 3)", "", 3},
+		{"(cd /; pwd); pwd", "/\n" + dir + "\n", 0},
+		{"((echo inner; echo 'with space') | cat) | tr a-z A-Z", "INNER\nWITH SPACE\n", 0},
+		{"(echo x | (cat; echo y)) && echo done", "x\ny\ndone\n", 0},
+		{"(echo unterminated", "syntax error at column 19: unexpected end of input\n", 2},
+	}
+
+	for _, tt := range tests {
+		got, status := runShell(t, dir, "", "-c", tt.script)
+		if got != tt.expected || status != tt.status {
+			t.Errorf("-c %q: output %q, status %d, expected %q, %d", tt.script, got, status, tt.expected, tt.status)
+		}
+	}
+
+	// The same lines typed at the prompt.
+	got, _ := runShell(t, dir, "(echo a; echo b) | cat\nfalse || (echo ok)\n")
+	if got != "a\nb\nok\n\n" {
+		t.Errorf("interactive output %q", got)
+	}
+}
+
+// The shell reaps its background jobs without waiting for them, and only
+// forgets them once their end has been reported.
+func TestNotifyReaps(t *testing.T) {
+	jobs = newJobTable(false)
+	stdout := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	tree, err := parse("true & true | true &")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(tree)
+	if len(jobs.jobs) != 2 {
+		t.Fatalf("%d jobs started, expected 2", len(jobs.jobs))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(jobs.jobs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		jobs.notify()
+	}
+	if len(jobs.jobs) != 0 {
+		t.Fatalf("jobs left after they finished: %d", len(jobs.jobs))
+	}
+	if _, err := syscall.Wait4(-1, nil, syscall.WNOHANG, nil); err != syscall.ECHILD {
+		t.Errorf("children left unreaped: %v", err)
+	}
+}
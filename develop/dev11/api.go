@@ -0,0 +1,339 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The /api/v1/events resource exposes the calendar as a REST collection.
+// Request bodies may be JSON or form-encoded and carry the same fields as
+// /create_event; the occurrence of a recurring series is addressed with the
+// occurrence query parameter. Events are sent with their version as ETag;
+// updates and deletions honour If-Match and GET honours If-None-Match.
+
+func handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		listAPIEvents(w, r)
+	case http.MethodPost:
+		createAPIEvent(w, r)
+	default:
+		methodNotAllowed(w, "GET, HEAD, POST")
+	}
+}
+
+func handleAPIEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, &httpError{status: http.StatusNotFound, message: "event not found"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		event, err := calendar.GetEvent(id)
+		if err == nil && !canView(r, event) {
+			err = errForbidden
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		setETag(w, event)
+		if notModified(r, event) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, event)
+	case http.MethodPut, http.MethodPatch:
+		updateAPIEvent(w, r, id)
+	case http.MethodDelete:
+		deleteAPIEvent(w, r, id)
+	default:
+		methodNotAllowed(w, "GET, HEAD, PUT, PATCH, DELETE")
+	}
+}
+
+func listAPIEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var userID int
+	if userIDStr := query.Get("user_id"); userIDStr != "" {
+		id, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			writeError(w, badRequest("invalid user_id"))
+			return
+		}
+		userID = id
+	}
+
+	if query.Get("from") != "" || query.Get("to") != "" {
+		loc, err := parseLocation(query.Get("tz"))
+		if err != nil {
+			writeError(w, badRequest("invalid tz"))
+			return
+		}
+		from, _, err := parseDateIn(query.Get("from"), loc)
+		if err != nil {
+			writeError(w, badRequest("invalid from"))
+			return
+		}
+		to, _, err := parseDateIn(query.Get("to"), loc)
+		if err != nil || !to.After(from) {
+			writeError(w, badRequest("invalid to"))
+			return
+		}
+		serveQuery(w, r, EventQuery{Start: from, End: to, UserID: userID})
+		return
+	}
+
+	filtered := []Event{}
+	for _, event := range visibleEvents(r, calendar.Events()) {
+		if userID == 0 || event.inCalendarOf(userID) {
+			filtered = append(filtered, event)
+		}
+	}
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+// maxPageLimit caps the limit query parameter.
+const maxPageLimit = 1000
+
+// serveQuery answers a range query, paginated when the request has a limit
+// or a cursor. The cursor of the next page is sent in the X-Next-Cursor
+// header and as a Link to the next page.
+func serveQuery(w http.ResponseWriter, r *http.Request, q EventQuery) {
+	if caller, ok := callerFrom(r); ok && caller.Role != roleAdmin {
+		if q.UserID != 0 && q.UserID != caller.ID {
+			writeError(w, errForbidden)
+			return
+		}
+		q.UserID = caller.ID
+	}
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			writeError(w, badRequest("invalid limit"))
+			return
+		}
+		q.Limit = limit
+	}
+	if cursorStr := r.FormValue("cursor"); cursorStr != "" {
+		cursor, err := parseCursor(cursorStr)
+		if err != nil {
+			writeError(w, badRequest("invalid cursor"))
+			return
+		}
+		q.After = cursor
+	}
+
+	events, more := calendar.QueryEvents(q)
+	if events == nil {
+		events = []Event{}
+	}
+	if more {
+		next := cursorOf(events[len(events)-1], q.Start.Location()).String()
+		link := *r.URL
+		query := link.Query()
+		query.Set("cursor", next)
+		link.RawQuery = query.Encode()
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", "<"+link.RequestURI()+`>; rel="next"`)
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func createAPIEvent(w http.ResponseWriter, r *http.Request) {
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	defaultOwner(r, r.Form)
+	var event Event
+	if err := parseEvent(r.Form, &event); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !canAccess(r, event.UserID) {
+		writeError(w, errForbidden)
+		return
+	}
+	policy, err := parseConflictPolicy(r.Form)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	created, err := calendar.CreateEvent(actorOf(r), event, policy)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	warnConflicts(w, created)
+	setETag(w, created)
+	w.Header().Set("Location", "/api/v1/events/"+strconv.Itoa(created.ID))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// updateAPIEvent handles PUT, which replaces the event with the request,
+// and PATCH, which only changes the fields present in the request.
+func updateAPIEvent(w http.ResponseWriter, r *http.Request, id int) {
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	occurrence, hasOccurrence, err := parseOccurrence(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	form := r.Form
+	if r.Method == http.MethodPut {
+		defaultOwner(r, form)
+	} else {
+		existing, err := calendar.GetEvent(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if hasOccurrence {
+			existing = existing.occurrence(occurrence)
+		}
+		form = eventValues(existing)
+		for key, values := range r.Form {
+			form[key] = values
+		}
+		// A new start or duration without a new end moves the end along
+		// instead of keeping it in place.
+		if r.Form.Get("end") == "" && (r.Form.Get("date") != "" || r.Form.Get("duration") != "") {
+			form.Del("end")
+		}
+	}
+
+	var event Event
+	if err := parseEvent(form, &event); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorizeChange(r, id, event.UserID); err != nil {
+		writeError(w, err)
+		return
+	}
+	policy, err := parseConflictPolicy(r.Form)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if event.Version, err = ifMatch(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var updated Event
+	if hasOccurrence {
+		updated, err = calendar.UpdateOccurrence(actorOf(r), id, occurrence, event, policy)
+	} else {
+		updated, err = calendar.UpdateEvent(actorOf(r), id, event, policy)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	warnConflicts(w, updated)
+	setETag(w, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func deleteAPIEvent(w http.ResponseWriter, r *http.Request, id int) {
+	occurrence, hasOccurrence, err := parseOccurrence(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := authorizeChange(r, id, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := ifMatch(r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if hasOccurrence {
+		err = calendar.DeleteOccurrence(actorOf(r), id, occurrence, version)
+	} else {
+		err = calendar.DeleteEvent(actorOf(r), id, version)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseOccurrence(r *http.Request) (time.Time, bool, error) {
+	occurrenceStr := r.URL.Query().Get("occurrence")
+	if occurrenceStr == "" {
+		return time.Time{}, false, nil
+	}
+	occurrence, err := parseDate(occurrenceStr)
+	if err != nil {
+		return time.Time{}, false, badRequest("invalid occurrence")
+	}
+	return occurrence, true, nil
+}
+
+// eventValues is the inverse of parseEvent. The end is given both as is
+// and as a duration so that a patch can either keep or move it.
+func eventValues(event Event) url.Values {
+	values := url.Values{}
+	values.Set("title", event.Title)
+	values.Set("description", event.Description)
+	values.Set("user_id", strconv.Itoa(event.UserID))
+	if event.TimeZone != "" {
+		values.Set("timezone", event.TimeZone)
+	}
+
+	format := func(t time.Time) string {
+		if event.AllDay {
+			return t.Format("2006-01-02")
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	values.Set("date", format(event.Date))
+	if event.duration() > 0 {
+		values.Set("end", format(event.Date.Add(event.duration())))
+	}
+	values.Set("duration", event.duration().String())
+
+	if event.RRule != "" {
+		values.Set("rrule", event.RRule)
+	}
+	if len(event.Reminders) > 0 {
+		reminders := make([]string, len(event.Reminders))
+		for i, reminder := range event.Reminders {
+			reminders[i] = reminder.String()
+		}
+		values.Set("reminders", strings.Join(reminders, ","))
+	}
+	if len(event.Attendees) > 0 {
+		attendees := make([]string, len(event.Attendees))
+		for i, attendee := range event.Attendees {
+			attendees[i] = strconv.Itoa(attendee.UserID)
+		}
+		values.Set("attendees", strings.Join(attendees, ","))
+	}
+	if len(event.Tags) > 0 {
+		values.Set("tags", strings.Join(event.Tags, ","))
+	}
+	if len(event.ExDates) > 0 {
+		exdates := make([]string, len(event.ExDates))
+		for i, exdate := range event.ExDates {
+			exdates[i] = format(exdate)
+		}
+		values.Set("exdate", strings.Join(exdates, ","))
+	}
+	return values
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIEvents(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+
+	// The steps run in order against the same calendar. body is matched
+	// against the response, header as name, value pairs; the error of a
+	// failed request is expected in the JSON envelope, naming field when
+	// given.
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		request     string
+		status      int
+		body        string
+		field       string
+		header      []string
+	}{
+		{"create json", http.MethodPost, "/api/v1/events", "application/json",
+			`{"title":"standup","user_id":1,"date":"2024-05-06T09:00:00Z","duration":"15m","rrule":"FREQ=DAILY;COUNT=3"}`,
+			http.StatusCreated, `"id":1,"title":"standup"`, "", []string{"Location", "/api/v1/events/1", "ETag", `"1"`}},
+		{"create form", http.MethodPost, "/api/v1/events", "application/x-www-form-urlencoded",
+			"title=review&user_id=2&date=2024-05-07",
+			http.StatusCreated, `"id":2,"title":"review"`, "", []string{"Location", "/api/v1/events/2"}},
+		{"create malformed json", http.MethodPost, "/api/v1/events", "application/json", `{"title":`,
+			http.StatusBadRequest, "", "", nil},
+		{"create without title", http.MethodPost, "/api/v1/events", "application/json", `{"user_id":1,"date":"2024-05-06"}`,
+			http.StatusUnprocessableEntity, "", "title", nil},
+		{"create with a bad conflict policy", http.MethodPost, "/api/v1/events?conflicts=maybe", "application/json",
+			`{"title":"a","user_id":1,"date":"2024-05-06"}`, http.StatusUnprocessableEntity, "", "conflicts", nil},
+
+		{"list", http.MethodGet, "/api/v1/events", "", "", http.StatusOK, `"title":"review"`, "", []string{"Content-Type", "application/json"}},
+		{"list of a user", http.MethodGet, "/api/v1/events?user_id=2", "", "", http.StatusOK, `[{"id":2,`, "", nil},
+		{"list with a bad user", http.MethodGet, "/api/v1/events?user_id=x", "", "", http.StatusBadRequest, "invalid user_id", "", nil},
+		{"range", http.MethodGet, "/api/v1/events?from=2024-05-07&to=2024-05-08", "", "", http.StatusOK,
+			`"series_id":1,"recurrence_id":"2024-05-07T09:00:00Z"`, "", nil},
+		{"page", http.MethodGet, "/api/v1/events?from=2024-05-06&to=2024-05-09&limit=1", "", "", http.StatusOK,
+			`[{"id":1,`, "", nil},
+		{"reversed range", http.MethodGet, "/api/v1/events?from=2024-05-08&to=2024-05-07", "", "", http.StatusBadRequest, "invalid to", "", nil},
+		{"bad limit", http.MethodGet, "/api/v1/events?from=2024-05-06&to=2024-05-07&limit=0", "", "", http.StatusBadRequest, "invalid limit", "", nil},
+		{"head", http.MethodHead, "/api/v1/events", "", "", http.StatusOK, "", "", nil},
+
+		{"get", http.MethodGet, "/api/v1/events/1", "", "", http.StatusOK, `"rrule":"FREQ=DAILY;COUNT=3"`, "", []string{"ETag", `"1"`}},
+		{"get missing", http.MethodGet, "/api/v1/events/99", "", "", http.StatusNotFound, "", "", nil},
+		{"get bad id", http.MethodGet, "/api/v1/events/abc", "", "", http.StatusNotFound, "event not found", "", nil},
+
+		{"patch", http.MethodPatch, "/api/v1/events/1", "application/json", `{"title":"daily"}`, http.StatusOK,
+			`"title":"daily","description":"","user_id":1,"date":"2024-05-06T09:00:00Z","end":"2024-05-06T09:15:00Z"`, "", []string{"ETag", `"2"`}},
+		{"patch invalid", http.MethodPatch, "/api/v1/events/1", "application/json", `{"date":"someday"}`,
+			http.StatusUnprocessableEntity, "", "date", nil},
+		{"put incomplete", http.MethodPut, "/api/v1/events/2", "application/json", `{"title":"retro","user_id":2}`,
+			http.StatusUnprocessableEntity, "", "date", nil},
+		{"put", http.MethodPut, "/api/v1/events/2", "application/json", `{"title":"retro","user_id":2,"date":"2024-05-07T15:00:00Z"}`,
+			http.StatusOK, `"title":"retro"`, "", []string{"ETag", `"2"`}},
+		{"put missing", http.MethodPut, "/api/v1/events/99", "application/json", `{"title":"x","user_id":1,"date":"2024-05-07"}`,
+			http.StatusNotFound, "", "", nil},
+		{"patch occurrence", http.MethodPatch, "/api/v1/events/1?occurrence=2024-05-07T09:00:00Z", "application/json",
+			`{"title":"late","date":"2024-05-07T11:00:00Z"}`, http.StatusOK, `"end":"2024-05-07T11:15:00Z"`, "", nil},
+		{"patch bad occurrence", http.MethodPatch, "/api/v1/events/1?occurrence=tuesday", "application/json", `{"title":"x"}`,
+			http.StatusBadRequest, "invalid occurrence", "", nil},
+
+		{"delete occurrence", http.MethodDelete, "/api/v1/events/1?occurrence=2024-05-08T09:00:00Z", "", "", http.StatusNoContent, "", "", nil},
+		{"delete no occurrence", http.MethodDelete, "/api/v1/events/1?occurrence=2024-05-08T10:00:00Z", "", "", http.StatusNotFound, "", "", nil},
+		{"delete", http.MethodDelete, "/api/v1/events/2", "", "", http.StatusNoContent, "", "", nil},
+		{"get deleted", http.MethodGet, "/api/v1/events/2", "", "", http.StatusNotFound, "", "", nil},
+		{"delete again", http.MethodDelete, "/api/v1/events/2", "", "", http.StatusNotFound, "", "", nil},
+
+		{"delete collection", http.MethodDelete, "/api/v1/events", "", "", http.StatusMethodNotAllowed,
+			"method not allowed", "", []string{"Allow", "GET, HEAD, POST"}},
+		{"put collection", http.MethodPut, "/api/v1/events", "application/json", `[]`, http.StatusMethodNotAllowed,
+			"", "", []string{"Allow", "GET, HEAD, POST"}},
+		{"post event", http.MethodPost, "/api/v1/events/1", "application/json", `{}`, http.StatusMethodNotAllowed,
+			"", "", []string{"Allow", "GET, HEAD, PUT, PATCH, DELETE"}},
+		{"post history", http.MethodPost, "/api/v1/events/1/history", "", "", http.StatusMethodNotAllowed,
+			"", "", []string{"Allow", "GET"}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.request))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: body %s, expected it to contain %s", tt.name, rec.Body, tt.body)
+		}
+		for i := 0; i+1 < len(tt.header); i += 2 {
+			if got := rec.Header().Get(tt.header[i]); got != tt.header[i+1] {
+				t.Errorf("%s: %s %q, expected %q", tt.name, tt.header[i], got, tt.header[i+1])
+			}
+		}
+		if rec.Code < 400 {
+			continue
+		}
+		var response errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || response.Error == "" {
+			t.Errorf("%s: error response %s: %v", tt.name, rec.Body, err)
+		}
+		if response.Field != tt.field || (tt.field != "" && (len(response.Errors) == 0 || response.Errors[0].Field != tt.field)) {
+			t.Errorf("%s: error %+v, expected field %q", tt.name, response, tt.field)
+		}
+	}
+}
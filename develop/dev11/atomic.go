@@ -0,0 +1,73 @@
+package main
+
+// undoState is how an event changed atomically was before the change.
+type undoState struct {
+	version int
+	deleted *Revision
+}
+
+// atomically makes the changes of apply in a single transaction of the
+// store, which commits when apply succeeds, and publishes them on the
+// change feed once it has committed. When apply or the commit fails, the
+// changes are undone and its error returned. Must be called with c.mu
+// held.
+func (c *Calendar) atomically(apply func() error) error {
+	store, nextID := c.store, c.nextID
+	tx := store.Begin()
+	c.store, c.undo = tx, make(map[int]undoState)
+	c.feed.hold()
+	err := apply()
+	if err == nil {
+		err = tx.Commit()
+	}
+	c.store = store
+	undo := c.undo
+	c.undo = nil
+
+	if err != nil {
+		c.rollback(undo, nextID)
+		c.feed.release(false)
+		return err
+	}
+	c.feed.release(true)
+	return nil
+}
+
+// saveUndo remembers the version and deletion of the event before it is
+// changed atomically for the first time. Must be called with c.mu held.
+func (c *Calendar) saveUndo(id int) {
+	if c.undo == nil {
+		return
+	}
+	if _, saved := c.undo[id]; saved {
+		return
+	}
+	state := undoState{version: c.versions[id]}
+	if revision, ok := c.deleted[id]; ok {
+		state.deleted = &revision
+	}
+	c.undo[id] = state
+}
+
+// rollback undoes changes whose writes never reached the store: the events
+// they changed are indexed again as they are stored. Must be called with
+// c.mu held.
+func (c *Calendar) rollback(undo map[int]undoState, nextID int) {
+	for id, state := range undo {
+		c.index.remove(id)
+		if event, ok := c.store.Get(id); ok {
+			c.index.add(event)
+		}
+		if state.version == 0 {
+			delete(c.versions, id)
+		} else {
+			c.versions[id] = state.version
+		}
+		if state.deleted != nil {
+			c.deleted[id] = *state.deleted
+		} else {
+			delete(c.deleted, id)
+		}
+	}
+	c.nextID = nextID
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The replies of an attendee, as in the PARTSTAT of iCalendar.
+const (
+	statusNeedsAction = "needs-action"
+	statusAccepted    = "accepted"
+	statusDeclined    = "declined"
+	statusTentative   = "tentative"
+)
+
+const maxAttendees = 200
+
+// Attendee is a user invited to an event by its organizer.
+type Attendee struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+}
+
+func validStatus(status string) bool {
+	switch status {
+	case statusNeedsAction, statusAccepted, statusDeclined, statusTentative:
+		return true
+	}
+	return false
+}
+
+// involves reports whether the user organises the event or is invited to
+// it, which lets the user see it.
+func (e Event) involves(userID int) bool {
+	if e.UserID == userID {
+		return true
+	}
+	for _, attendee := range e.Attendees {
+		if attendee.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// inCalendarOf reports whether the event shows up in the calendar of the
+// user.
+func (e Event) inCalendarOf(userID int) bool {
+	for _, participant := range e.participants() {
+		if participant == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// participants returns the organizer and the attendees that have not
+// declined, whose calendars the event shows up in.
+func (e Event) participants() []int {
+	users := []int{e.UserID}
+	for _, attendee := range e.Attendees {
+		if attendee.Status != statusDeclined && attendee.UserID != e.UserID {
+			users = append(users, attendee.UserID)
+		}
+	}
+	return users
+}
+
+// mergeAttendees returns the attendees of an updated event: users invited
+// before keep their reply, new ones have yet to reply, and the organizer
+// and duplicates are dropped.
+func mergeAttendees(organizer int, invited, existing []Attendee) []Attendee {
+	status := make(map[int]string, len(existing))
+	for _, attendee := range existing {
+		status[attendee.UserID] = attendee.Status
+	}
+	var merged []Attendee
+	seen := make(map[int]bool)
+	for _, attendee := range invited {
+		if attendee.UserID == organizer || seen[attendee.UserID] {
+			continue
+		}
+		seen[attendee.UserID] = true
+		if s, ok := status[attendee.UserID]; ok {
+			attendee.Status = s
+		} else {
+			attendee.Status = statusNeedsAction
+		}
+		merged = append(merged, attendee)
+	}
+	return merged
+}
+
+// parseAttendees parses a list of user IDs such as "2,3".
+func parseAttendees(s string) ([]Attendee, error) {
+	var attendees []Attendee
+	for _, idStr := range strings.Split(s, ",") {
+		if idStr = strings.TrimSpace(idStr); idStr == "" {
+			continue
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid attendee %q", idStr)
+		}
+		attendees = append(attendees, Attendee{UserID: id})
+	}
+	return attendees, nil
+}
+
+// InviteAttendees adds users to the attendees of an event; users already
+// invited keep their reply. A non-zero version makes the invitation
+// conditional like in UpdateEvent.
+func (c *Calendar) InviteAttendees(actor, id int, userIDs []int, version int) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	event, exists := c.store.Get(id)
+	if !exists {
+		return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if err := checkVersion(event, version); err != nil {
+		return Event{}, err
+	}
+	invited := append([]Attendee(nil), event.Attendees...)
+	for _, userID := range userIDs {
+		invited = append(invited, Attendee{UserID: userID})
+	}
+	if len(invited) > maxAttendees {
+		return Event{}, invalidField("attendees", fmt.Sprintf("attendees must have at most %d items", maxAttendees))
+	}
+	event.Attendees = mergeAttendees(event.UserID, invited, event.Attendees)
+	return c.put(actor, "invite", event, time.Now().UTC())
+}
+
+// RespondToEvent records the reply of an attendee. The reply to a series
+// also applies to the detached occurrences the user is invited to.
+func (c *Calendar) RespondToEvent(actor, id, userID int, status string) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	event, exists := c.store.Get(id)
+	if !exists {
+		return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if !validStatus(status) {
+		return Event{}, invalidField("status", "status must be needs-action, accepted, declined or tentative")
+	}
+
+	respond := func(event Event) (Event, bool, error) {
+		for i, attendee := range event.Attendees {
+			if attendee.UserID != userID {
+				continue
+			}
+			if attendee.Status == status {
+				return event, true, nil
+			}
+			event.Attendees = append([]Attendee(nil), event.Attendees...)
+			event.Attendees[i].Status = status
+			event, err := c.put(actor, "rsvp", event, time.Now().UTC())
+			return event, true, err
+		}
+		return event, false, nil
+	}
+	event, invited, err := respond(event)
+	if err != nil {
+		return Event{}, err
+	}
+	if !invited {
+		return Event{}, fmt.Errorf("user %d is not invited to event %d: %w", userID, id, errForbidden)
+	}
+	if event.RRule != "" {
+		for detached := range c.index.detached[id] {
+			if _, _, err := respond(c.index.indexed[detached]); err != nil {
+				return Event{}, err
+			}
+		}
+	}
+	return event, nil
+}
+
+// handleInvite invites users to an event of the caller:
+//
+//	POST /api/v1/events/{id}/invite
+//	{"user_ids": [2, 3]}
+func handleInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, &httpError{status: http.StatusNotFound, message: "event not found"})
+		return
+	}
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	attendees, err := parseAttendees(r.Form.Get("user_ids"))
+	if err != nil || len(attendees) == 0 {
+		writeError(w, invalidField("user_ids", "at least one valid user id is required"))
+		return
+	}
+	if err := authorizeChange(r, id, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := ifMatch(r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	userIDs := make([]int, len(attendees))
+	for i, attendee := range attendees {
+		userIDs[i] = attendee.UserID
+	}
+	event, err := calendar.InviteAttendees(actorOf(r), id, userIDs, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setETag(w, event)
+	writeJSON(w, http.StatusOK, event)
+}
+
+// handleRSVP records the reply of the caller, or of the user given by an
+// admin, to an invitation:
+//
+//	POST /api/v1/events/{id}/rsvp
+//	{"status": "accepted"}
+//
+// With authentication disabled the user_id is required.
+func handleRSVP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, &httpError{status: http.StatusNotFound, message: "event not found"})
+		return
+	}
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := actorOf(r)
+	if userIDStr := r.Form.Get("user_id"); userIDStr != "" {
+		if userID, err = strconv.Atoi(userIDStr); err != nil || userID <= 0 {
+			writeError(w, invalidField("user_id", "invalid user_id"))
+			return
+		}
+	}
+	if userID == 0 {
+		writeError(w, invalidField("user_id", "user_id is required"))
+		return
+	}
+	if !canAccess(r, userID) {
+		writeError(w, errForbidden)
+		return
+	}
+
+	event, err := calendar.RespondToEvent(actorOf(r), id, userID, r.Form.Get("status"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setETag(w, event)
+	writeJSON(w, http.StatusOK, event)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statuses returns the replies of the attendees, e.g. "2:accepted 3:declined".
+func statuses(event Event) string {
+	var s []string
+	for _, attendee := range event.Attendees {
+		s = append(s, strconv.Itoa(attendee.UserID)+":"+attendee.Status)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestAttendees(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	day := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	meeting, err := c.CreateEvent(0, Event{Title: "meeting", UserID: 1, Date: day.Add(10 * time.Hour),
+		Attendees: []Attendee{{UserID: 2}, {UserID: 3, Status: statusAccepted}, {UserID: 1}, {UserID: 2}}}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(meeting); got != "2:needs-action 3:needs-action" {
+		t.Fatalf("attendees after create = %s", got)
+	}
+
+	if _, err := c.RespondToEvent(2, meeting.ID, 2, statusAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RespondToEvent(3, meeting.ID, 3, statusDeclined); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RespondToEvent(4, meeting.ID, 4, statusAccepted); !errors.Is(err, errForbidden) {
+		t.Errorf("reply of a user not invited: error = %v", err)
+	}
+	var validationErr *validationError
+	if _, err := c.RespondToEvent(2, meeting.ID, 2, "maybe"); !errors.As(err, &validationErr) {
+		t.Errorf("invalid reply: error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		userID int
+		count  int
+	}{{1, 1}, {2, 1}, {3, 0}, {4, 0}} {
+		events, _ := c.QueryEvents(EventQuery{Start: day, End: day.AddDate(0, 0, 1), UserID: tt.userID})
+		if len(events) != tt.count {
+			t.Errorf("day of user %d: %d events, expected %d", tt.userID, len(events), tt.count)
+		}
+	}
+
+	update := meeting
+	update.Title = "renamed"
+	update.Attendees = nil
+	update.Version = 0
+	updated, err := c.UpdateEvent(1, meeting.ID, update, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(updated); got != "2:accepted 3:declined" {
+		t.Errorf("attendees after an update without them = %s", got)
+	}
+	update.Attendees = []Attendee{{UserID: 2}, {UserID: 4}}
+	if updated, err = c.UpdateEvent(1, meeting.ID, update, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(updated); got != "2:accepted 4:needs-action" {
+		t.Errorf("attendees after replacing them = %s", got)
+	}
+	if invited, err := c.InviteAttendees(1, meeting.ID, []int{3, 4}, 0); err != nil || statuses(invited) != "2:accepted 4:needs-action 3:needs-action" {
+		t.Errorf("attendees after inviting = %s, %v", statuses(invited), err)
+	}
+
+	if counts := c.EventCountsByUser(); len(counts) != 1 || counts[1] != 1 {
+		t.Errorf("event counts = %v, expected only the organizer", counts)
+	}
+}
+
+func TestInviteAndRSVP(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/v1/events", `{"title":"review","user_id":1,"date":"2024-05-06T10:00:00Z","attendees":[2]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		check  string
+	}{
+		{"invite", http.MethodPost, "/api/v1/events/1/invite", `{"user_ids":[3,2]}`, http.StatusOK, "2:needs-action 3:needs-action"},
+		{"invite nobody", http.MethodPost, "/api/v1/events/1/invite", `{"user_ids":[]}`, http.StatusUnprocessableEntity, ""},
+		{"accept", http.MethodPost, "/api/v1/events/1/rsvp", `{"user_id":3,"status":"accepted"}`, http.StatusOK, "2:needs-action 3:accepted"},
+		{"anonymous reply", http.MethodPost, "/api/v1/events/1/rsvp", `{"status":"accepted"}`, http.StatusUnprocessableEntity, ""},
+		{"not invited", http.MethodPost, "/api/v1/events/1/rsvp", `{"user_id":9,"status":"declined"}`, http.StatusForbidden, ""},
+		{"patch keeps replies", http.MethodPatch, "/api/v1/events/1", `{"title":"final review"}`, http.StatusOK, "2:needs-action 3:accepted"},
+		{"put sends attendees back", http.MethodPut, "/api/v1/events/1",
+			`{"title":"review","user_id":1,"date":"2024-05-06T10:00:00Z","attendees":[{"user_id":3,"status":"declined"}]}`,
+			http.StatusOK, "3:accepted"},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if tt.check == "" {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(rec.Body.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if got := statuses(event); got != tt.check {
+			t.Errorf("%s: attendees %s, expected %s", tt.name, got, tt.check)
+		}
+	}
+
+	rec = do(http.MethodGet, "/events_for_day?date=2024-05-06&user_id=3", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"title":"review"`) {
+		t.Errorf("day of an attendee: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+
+	tokenPrefix = "dev11_"
+)
+
+var errForbidden = errors.New("access denied")
+
+// User is an account that authenticates with API tokens. Only SHA-256
+// hashes of the tokens are stored; the tokens themselves are shown once,
+// when they are issued.
+type User struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Role        string   `json:"role"`
+	TokenHashes []string `json:"token_hashes,omitempty"`
+}
+
+// userStore keeps users in a JSON file.
+type userStore struct {
+	mu    sync.RWMutex
+	path  string
+	users []User
+}
+
+func loadUsers(path string) (*userStore, error) {
+	s := &userStore{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("corrupted users file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *userStore) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *userStore) authenticate(token string) (User, bool) {
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		for _, known := range user.TokenHashes {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(known)) == 1 {
+				return user, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+func (s *userStore) add(name, role string) (User, error) {
+	if name == "" {
+		return User{}, fmt.Errorf("name is required")
+	}
+	if role != roleUser && role != roleAdmin {
+		return User{}, fmt.Errorf("unknown role %q", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := User{ID: 1, Name: name, Role: role}
+	for _, existing := range s.users {
+		if existing.Name == name {
+			return User{}, fmt.Errorf("user %q already exists", name)
+		}
+		if existing.ID >= user.ID {
+			user.ID = existing.ID + 1
+		}
+	}
+	s.users = append(s.users, user)
+	return user, s.save()
+}
+
+// issueToken creates a new API token for the user.
+func (s *userStore) issueToken(userID int) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(token))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID == userID {
+			s.users[i].TokenHashes = append(s.users[i].TokenHashes, hex.EncodeToString(sum[:]))
+			return token, s.save()
+		}
+	}
+	return "", fmt.Errorf("user with id %d does not exist", userID)
+}
+
+// revokeTokens removes every token of the user.
+func (s *userStore) revokeTokens(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.users {
+		if s.users[i].ID == userID {
+			s.users[i].TokenHashes = nil
+			return s.save()
+		}
+	}
+	return fmt.Errorf("user with id %d does not exist", userID)
+}
+
+func (s *userStore) list() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]User(nil), s.users...)
+}
+
+type callerKey struct{}
+
+// authMiddleware resolves the caller from the bearer token and rejects
+// requests without a valid one. Calendar clients only speak Basic
+// authentication, so the token is also accepted as its password. With no
+// user store authentication is disabled and every request is let through
+// anonymously.
+func authMiddleware(users *userStore, next http.Handler) http.Handler {
+	if users == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			_, token, found = r.BasicAuth()
+		}
+		user, ok := users.authenticate(strings.TrimSpace(token))
+		if !found || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dev11"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="dev11"`)
+			writeError(w, &httpError{status: http.StatusUnauthorized, message: "missing or invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, user)))
+	})
+}
+
+func callerFrom(r *http.Request) (User, bool) {
+	user, ok := r.Context().Value(callerKey{}).(User)
+	return user, ok
+}
+
+// actorOf returns the ID of the caller for the history of the events it
+// changes, or zero for an anonymous request.
+func actorOf(r *http.Request) int {
+	caller, _ := callerFrom(r)
+	return caller.ID
+}
+
+// canAccess reports whether the caller may see and change the events of
+// the given user. Anonymous requests are only possible with
+// authentication disabled and may access everything.
+func canAccess(r *http.Request, userID int) bool {
+	caller, ok := callerFrom(r)
+	return !ok || caller.Role == roleAdmin || caller.ID == userID
+}
+
+// authorizeChange checks that the caller may modify the stored event and,
+// when owner is not zero, hand it to that user.
+func authorizeChange(r *http.Request, id, owner int) error {
+	existing, err := calendar.GetEvent(id)
+	if err != nil {
+		return err
+	}
+	if !canAccess(r, existing.UserID) || (owner != 0 && !canAccess(r, owner)) {
+		return fmt.Errorf("event with id %d: %w", id, errForbidden)
+	}
+	return nil
+}
+
+// canView reports whether the caller may see the event, which its
+// attendees may as well as its organizer.
+func canView(r *http.Request, event Event) bool {
+	caller, ok := callerFrom(r)
+	return !ok || caller.Role == roleAdmin || event.involves(caller.ID)
+}
+
+// visibleEvents drops the events the caller may not see.
+func visibleEvents(r *http.Request, events []Event) []Event {
+	if _, ok := callerFrom(r); !ok {
+		return events
+	}
+	visible := make([]Event, 0, len(events))
+	for _, event := range events {
+		if canView(r, event) {
+			visible = append(visible, event)
+		}
+	}
+	return visible
+}
+
+// defaultOwner makes the caller the owner of an event created without an
+// explicit user_id.
+func defaultOwner(r *http.Request, form url.Values) {
+	if caller, ok := callerFrom(r); ok && form.Get("user_id") == "" {
+		form.Set("user_id", strconv.Itoa(caller.ID))
+	}
+}
+
+// runUserCommand implements the "user" subcommand used to provision
+// accounts and tokens:
+//
+//	dev11 user add -name alice [-role admin]
+//	dev11 user token -id 1
+//	dev11 user revoke -id 1
+//	dev11 user list
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: dev11 user add|token|revoke|list [flags]")
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	path := fs.String("users", "users.json", "users file")
+	name := fs.String("name", "", "user name")
+	role := fs.String("role", roleUser, "role: user or admin")
+	id := fs.Int("id", 0, "user id")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(*path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	users, err := loadUsers(*path)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		user, err := users.add(*name, *role)
+		if err != nil {
+			return err
+		}
+		token, err := users.issueToken(user.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id: %d\nname: %s\nrole: %s\ntoken: %s\n", user.ID, user.Name, user.Role, token)
+	case "token":
+		token, err := users.issueToken(*id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("token: %s\n", token)
+	case "revoke":
+		if err := users.revokeTokens(*id); err != nil {
+			return err
+		}
+		fmt.Printf("tokens of user %d revoked\n", *id)
+	case "list":
+		for _, user := range users.list() {
+			fmt.Printf("%d\t%s\t%s\t%d token(s)\n", user.ID, user.Name, user.Role, len(user.TokenHashes))
+		}
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorization(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	users, err := loadUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(map[string]string)
+	for _, account := range []struct{ name, role string }{{"alice", roleUser}, {"bob", roleUser}, {"root", roleAdmin}, {"gone", roleUser}} {
+		user, err := users.add(account.name, account.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens[account.name], err = users.issueToken(user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.revokeTokens(4); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHandler(users, newMetrics(), requestLimits{})
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	for _, userID := range []int{1, 2} {
+		if _, err := calendar.CreateEvent(userID, Event{Title: "mine", UserID: userID, Date: date}, AllowConflicts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bearer := func(name string) string { return "Bearer " + tokens[name] }
+	basic := func(name string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(name, tokens[name])
+		return req.Header.Get("Authorization")
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		authorization string
+		status        int
+	}{
+		{"no token", http.MethodGet, "/api/v1/events", "", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/api/v1/events", "", "Bearer dev11_0000", http.StatusUnauthorized},
+		{"unknown scheme", http.MethodGet, "/api/v1/events", "", "Token " + tokens["alice"], http.StatusUnauthorized},
+		{"wrong basic password", http.MethodGet, "/api/v1/events", "", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized},
+		{"revoked token", http.MethodGet, "/api/v1/events", "", bearer("gone"), http.StatusUnauthorized},
+		{"probe without token", http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{"bearer", http.MethodGet, "/api/v1/events", "", bearer("alice"), http.StatusOK},
+		{"basic", http.MethodGet, "/api/v1/events", "", basic("alice"), http.StatusOK},
+		{"create for another user", http.MethodPost, "/api/v1/events",
+			`{"title":"theirs","user_id":2,"date":"2024-05-07T10:00:00Z"}`, bearer("alice"), http.StatusForbidden},
+		{"update another user's event", http.MethodPatch, "/api/v1/events/2", `{"title":"taken"}`, bearer("alice"), http.StatusForbidden},
+		{"legacy update of another user's event", http.MethodPost, "/update_event",
+			`{"id":2,"title":"taken","date":"2024-05-06T10:00:00Z"}`, bearer("alice"), http.StatusForbidden},
+		{"give away an event", http.MethodPatch, "/api/v1/events/1", `{"user_id":2}`, bearer("alice"), http.StatusForbidden},
+		{"delete another user's event", http.MethodDelete, "/api/v1/events/2", "", basic("alice"), http.StatusForbidden},
+		{"get another user's event", http.MethodGet, "/api/v1/events/2", "", bearer("alice"), http.StatusForbidden},
+		{"update own event", http.MethodPatch, "/api/v1/events/1", `{"title":"still mine"}`, bearer("alice"), http.StatusOK},
+		{"admin update", http.MethodPatch, "/api/v1/events/1", `{"title":"by root","user_id":2}`, bearer("root"), http.StatusOK},
+		{"admin create for a user", http.MethodPost, "/api/v1/events",
+			`{"title":"for bob","user_id":2,"date":"2024-05-07T10:00:00Z"}`, bearer("root"), http.StatusCreated},
+		{"admin delete", http.MethodDelete, "/api/v1/events/2", "", basic("root"), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, expected %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if challenges := rec.Header().Values("WWW-Authenticate"); (rec.Code == http.StatusUnauthorized) != (len(challenges) == 2) {
+				t.Errorf("WWW-Authenticate %q with status %d", challenges, rec.Code)
+			}
+		})
+	}
+
+	// Events are owned by whoever the admin gave them to, and the ones
+	// refused are untouched.
+	if event, err := calendar.GetEvent(1); err != nil || event.UserID != 2 || event.Title != "by root" {
+		t.Errorf("event 1 = %+v, %v", event, err)
+	}
+	if len(calendar.Events()) != 2 {
+		t.Errorf("events %+v, expected 1 and 3", calendar.Events())
+	}
+}
+
+// runUser runs the user subcommand and returns what it printed.
+func runUser(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = runUserCommand(args)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	return string(out), err
+}
+
+func TestUserCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf", "users.json")
+	out, err := runUser(t, "add", "-users", path, "-name", "alice", "-role", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, _ := strings.Cut(out, "token: ")
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(out, "id: 1\nname: alice\nrole: admin\n") || !strings.HasPrefix(token, tokenPrefix) {
+		t.Fatalf("add printed %q", out)
+	}
+	if out, err = runUser(t, "token", "-users", path, "-id", "1"); err != nil || !strings.HasPrefix(out, "token: "+tokenPrefix) {
+		t.Fatalf("token printed %q, %v", out, err)
+	}
+	second := strings.TrimSpace(strings.TrimPrefix(out, "token: "))
+
+	// Only the hashes of the tokens are written, to a file only the owner
+	// can read.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || strings.Contains(string(data), second) {
+		t.Errorf("users file holds a token:\n%s", data)
+	}
+	sum := sha256.Sum256([]byte(token))
+	if !strings.Contains(string(data), hex.EncodeToString(sum[:])) {
+		t.Errorf("users file lacks the hash of the token:\n%s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("users file mode %v, %v", info.Mode(), err)
+	}
+	users, err := loadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{token, second} {
+		if user, ok := users.authenticate(token); !ok || user.Name != "alice" || user.Role != roleAdmin {
+			t.Errorf("token authenticates %+v, %v", user, ok)
+		}
+	}
+
+	if out, err = runUser(t, "add", "-users", path, "-name", "bob"); err != nil || !strings.HasPrefix(out, "id: 2\nname: bob\nrole: user\n") {
+		t.Errorf("second add printed %q, %v", out, err)
+	}
+	if out, err = runUser(t, "revoke", "-users", path, "-id", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = runUser(t, "list", "-users", path); err != nil || out != "1\talice\tadmin\t0 token(s)\n2\tbob\tuser\t1 token(s)\n" {
+		t.Errorf("list printed %q, %v", out, err)
+	}
+	if users, err = loadUsers(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := users.authenticate(token); ok {
+		t.Errorf("revoked token authenticates")
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"add", "-users", path, "-name", "alice"},
+		{"add", "-users", path},
+		{"add", "-users", path, "-name", "carol", "-role", "root"},
+		{"token", "-users", path, "-id", "7"},
+		{"revoke", "-users", path, "-id", "7"},
+		{"rename", "-users", path},
+	} {
+		if out, err := runUser(t, args...); err == nil {
+			t.Errorf("user %q succeeded: %q", args, out)
+		}
+	}
+}
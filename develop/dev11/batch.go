@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var errBatchAborted = errors.New("batch aborted")
+
+// maxBatchOps caps the operations of a single batch.
+const maxBatchOps = 10000
+
+// BatchOp is an operation of a batch: the creation of Event, or the update
+// or deletion of the event ID, or of a single occurrence of it when
+// Occurrence is set. A non-zero Version makes an update or deletion
+// conditional like in UpdateEvent. Err is an error found before the batch
+// was applied, such as an invalid event; it fails the operation.
+type BatchOp struct {
+	Op         string
+	ID         int
+	Occurrence *time.Time
+	Version    int
+	Event      Event
+	Policy     ConflictPolicy
+	Err        error
+}
+
+// BatchResult is the outcome of an operation of a batch: the stored event,
+// or the error the operation failed with.
+type BatchResult struct {
+	Event Event
+	Err   error
+}
+
+// Batch applies the operations in order under a single lock; allowed
+// reports whether the actor may change the events of a user.
+//
+// An atomic batch is all-or-nothing. Its changes are written in a single
+// transaction of the store and published on the change feed only once the
+// transaction has committed. When an operation fails, the changes made
+// before it are undone and every other operation fails with
+// errBatchAborted. Invalid operations fail the batch before anything is
+// changed. The error is that of the commit, after which nothing is kept
+// either.
+//
+// Otherwise the operations are applied one by one, and a failed operation
+// does not affect the others.
+func (c *Calendar) Batch(actor int, ops []BatchOp, atomic bool, allowed func(userID int) bool) ([]BatchResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	at := time.Now().UTC()
+	results := make([]BatchResult, len(ops))
+	if !atomic {
+		for i, op := range ops {
+			results[i] = c.applyOp(actor, op, allowed, at)
+		}
+		return results, nil
+	}
+
+	failed := -1
+	for i, op := range ops {
+		if op.Err != nil {
+			results[i].Err = op.Err
+			if failed < 0 {
+				failed = i
+			}
+		}
+	}
+	if failed >= 0 {
+		abortBatch(results, failed)
+		return results, nil
+	}
+
+	err := c.atomically(func() error {
+		for i, op := range ops {
+			if results[i] = c.applyOp(actor, op, allowed, at); results[i].Err != nil {
+				failed = i
+				return results[i].Err
+			}
+		}
+		return nil
+	})
+	if failed >= 0 {
+		abortBatch(results, failed)
+		return results, nil
+	}
+	return results, err
+}
+
+// abortBatch fails the operations of an atomic batch other than the one
+// that failed it.
+func abortBatch(results []BatchResult, failed int) {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = BatchResult{Err: fmt.Errorf("operation %d failed: %w", failed, errBatchAborted)}
+		}
+	}
+}
+
+// applyOp applies an operation of a batch. Must be called with c.mu held.
+func (c *Calendar) applyOp(actor int, op BatchOp, allowed func(userID int) bool, at time.Time) BatchResult {
+	if op.Err != nil {
+		return BatchResult{Err: op.Err}
+	}
+
+	var event Event
+	var err error
+	switch op.Op {
+	case "create":
+		if !allowed(op.Event.UserID) {
+			return BatchResult{Err: fmt.Errorf("user %d: %w", op.Event.UserID, errForbidden)}
+		}
+		event, err = c.create(actor, op.Event, nil, op.Policy, at)
+	case "update":
+		if err := c.authorize(op.ID, op.Event.UserID, allowed); err != nil {
+			return BatchResult{Err: err}
+		}
+		op.Event.Version = op.Version
+		if op.Occurrence != nil {
+			event, err = c.updateOccurrence(actor, op.ID, *op.Occurrence, op.Event, op.Policy, at)
+		} else {
+			event, err = c.update(actor, op.ID, op.Event, op.Policy, at)
+		}
+	case "delete":
+		if err := c.authorize(op.ID, 0, allowed); err != nil {
+			return BatchResult{Err: err}
+		}
+		if op.Occurrence != nil {
+			err = c.deleteOccurrence(actor, op.ID, *op.Occurrence, op.Version, at)
+		} else {
+			err = c.delete(actor, op.ID, op.Version, at)
+		}
+		event = Event{ID: op.ID}
+	default:
+		err = fmt.Errorf("unknown batch operation %q", op.Op)
+	}
+	if err != nil {
+		return BatchResult{Err: err}
+	}
+	return BatchResult{Event: event}
+}
+
+// authorize checks like authorizeChange that the stored event may be
+// changed and, when owner is not zero, handed to that user. Must be called
+// with c.mu held.
+func (c *Calendar) authorize(id, owner int, allowed func(userID int) bool) error {
+	existing, exists := c.store.Get(id)
+	if !exists {
+		return fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if !allowed(existing.UserID) || (owner != 0 && !allowed(owner)) {
+		return fmt.Errorf("event with id %d: %w", id, errForbidden)
+	}
+	return nil
+}
+
+// batchResult is the outcome of an operation as reported by /batch.
+type batchResult struct {
+	Index  int                `json:"index"`
+	Op     string             `json:"op"`
+	Status int                `json:"status"`
+	ID     int                `json:"id,omitempty"`
+	Event  *Event             `json:"event,omitempty"`
+	Error  string             `json:"error,omitempty"`
+	Field  string             `json:"field,omitempty"`
+	Errors []*validationError `json:"errors,omitempty"`
+}
+
+// handleBatch applies a JSON array of operations. Every operation is the
+// body of the matching /create_event, /update_event or /delete_event
+// request with the operation named in op:
+//
+//	[{"op": "create", "title": "Standup", "date": "2024-05-06T09:00:00Z"},
+//	 {"op": "update", "id": 7, "version": 2, "title": "Review", ...},
+//	 {"op": "delete", "id": 8, "occurrence": "2024-05-13T09:00:00Z"}]
+//
+// The mode parameter is atomic, the default, or best_effort; the conflicts
+// parameter applies to the operations that do not give their own. Every
+// operation is reported with the status its own request would have got,
+// or with 424 when an atomic batch was aborted because of another
+// operation. Like /import, a batch that could be read is answered with 200
+// whatever the outcome of its operations.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var atomic bool
+	switch query.Get("mode") {
+	case "", "atomic":
+		atomic = true
+	case "best_effort":
+	default:
+		writeError(w, invalidField("mode", "mode must be atomic or best_effort"))
+		return
+	}
+	if _, err := parseConflictPolicy(query); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var items []map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&items); err != nil {
+		writeError(w, bodyError(err, fmt.Sprintf("malformed JSON body: %v", err)))
+		return
+	}
+	if len(items) > maxBatchOps {
+		writeError(w, badRequest(fmt.Sprintf("a batch may have at most %d operations", maxBatchOps)))
+		return
+	}
+
+	ops := make([]BatchOp, len(items))
+	for i, item := range items {
+		ops[i] = parseBatchOp(r, item)
+	}
+	results, err := calendar.Batch(actorOf(r), ops, atomic, func(userID int) bool {
+		return canAccess(r, userID)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	applied := 0
+	response := make([]batchResult, len(results))
+	for i, result := range results {
+		response[i] = batchResultOf(i, ops[i], result)
+		if result.Err == nil {
+			applied++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"applied": applied,
+		"failed":  len(results) - applied,
+		"results": response,
+	})
+}
+
+func batchResultOf(index int, op BatchOp, result BatchResult) batchResult {
+	reply := batchResult{Index: index, Op: op.Op, ID: op.ID}
+	if result.Err != nil {
+		reply.Status = errorStatus(result.Err)
+		reply.Error = result.Err.Error()
+		var validationErr *validationError
+		var validationErrs validationErrors
+		if errors.As(result.Err, &validationErr) {
+			reply.Field = validationErr.Field
+			reply.Errors = validationErrors{validationErr}
+		}
+		if errors.As(result.Err, &validationErrs) {
+			reply.Field = validationErrs[0].Field
+			reply.Errors = validationErrs
+		}
+		return reply
+	}
+
+	reply.ID = result.Event.ID
+	switch op.Op {
+	case "create":
+		reply.Status = http.StatusCreated
+		reply.Event = &result.Event
+	case "update":
+		reply.Status = http.StatusOK
+		reply.Event = &result.Event
+	default:
+		reply.Status = http.StatusNoContent
+	}
+	return reply
+}
+
+// parseBatchOp reads an operation of a batch the way the handler of its
+// own request reads the request.
+func parseBatchOp(r *http.Request, item map[string]interface{}) BatchOp {
+	form := url.Values{}
+	if conflicts := r.URL.Query().Get("conflicts"); conflicts != "" {
+		form.Set("conflicts", conflicts)
+	}
+	err := setJSONValues(form, item)
+	op := BatchOp{Op: form.Get("op")}
+	if err != nil {
+		op.Err = err
+		return op
+	}
+
+	switch op.Op {
+	case "create", "update":
+		defaultOwner(r, form)
+		if op.Err = parseEvent(form, &op.Event); op.Err != nil {
+			return op
+		}
+	case "delete":
+	default:
+		op.Err = invalidField("op", "op must be create, update or delete")
+		return op
+	}
+
+	if op.Op != "create" {
+		id, err := strconv.Atoi(form.Get("id"))
+		if err != nil || id <= 0 {
+			op.Err = invalidField("id", "invalid event id")
+			return op
+		}
+		op.ID = id
+		if versionStr := form.Get("version"); versionStr != "" {
+			version, err := strconv.Atoi(versionStr)
+			if err != nil || version <= 0 {
+				op.Err = invalidField("version", "invalid version")
+				return op
+			}
+			op.Version = version
+		}
+		if occurrenceStr := form.Get("occurrence"); occurrenceStr != "" {
+			occurrence, err := parseDate(occurrenceStr)
+			if err != nil {
+				op.Err = invalidField("occurrence", "invalid occurrence")
+				return op
+			}
+			op.Occurrence = &occurrence
+		}
+	}
+	op.Policy, op.Err = parseConflictPolicy(form)
+	return op
+}
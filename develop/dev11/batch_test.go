@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchErrors returns the errors of the results, nil for the operations
+// that succeeded.
+func batchErrors(results []BatchResult) []error {
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = result.Err
+	}
+	return errs
+}
+
+func TestBatch(t *testing.T) {
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	everyone := func(int) bool { return true }
+	stores := []struct {
+		name string
+		open func(t *testing.T) EventStore
+	}{
+		{"memory", func(t *testing.T) EventStore { return newMemoryStore() }},
+		{"file", func(t *testing.T) EventStore {
+			store, err := openFileStore(t.TempDir(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		}},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			c := NewCalendar(s.open(t))
+			kept, _ := c.CreateEvent(1, Event{Title: "kept", UserID: 1, Date: date}, AllowConflicts)
+			series, _ := c.CreateEvent(1, Event{Title: "standup", UserID: 1, Date: date.Add(-time.Hour), RRule: "FREQ=DAILY;COUNT=5"}, AllowConflicts)
+			seq := c.feed.last()
+
+			occurrence := date.Add(23 * time.Hour)
+			results, err := c.Batch(1, []BatchOp{
+				{Op: "create", Event: Event{Title: "new", UserID: 1, Date: date.AddDate(0, 0, 1)}},
+				{Op: "update", ID: kept.ID, Event: Event{Title: "renamed", UserID: 1, Date: date}},
+				{Op: "update", ID: series.ID, Occurrence: &occurrence, Event: Event{Title: "moved", UserID: 1, Date: occurrence.Add(time.Hour)}},
+				{Op: "delete", ID: series.ID},
+				{Op: "update", ID: kept.ID, Version: 1, Event: Event{Title: "stale", UserID: 1, Date: date}},
+			}, true, everyone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs := batchErrors(results)
+			for i, err := range errs[:4] {
+				if !errors.Is(err, errBatchAborted) {
+					t.Errorf("operation %d of the aborted batch: error %v", i, err)
+				}
+			}
+			if !errors.Is(errs[4], errStaleVersion) {
+				t.Errorf("failed operation: error %v", errs[4])
+			}
+
+			if events := c.Events(); len(events) != 2 || events[0].Title != "kept" || events[0].Version != 1 ||
+				events[1].ExDates != nil || events[1].Version != 1 {
+				t.Errorf("events after the aborted batch = %+v", events)
+			}
+			if history, _ := c.History(kept.ID); ops(history) != "1 create" {
+				t.Errorf("history after the aborted batch = %s", ops(history))
+			}
+			if found := c.GetEventsForDay(date.AddDate(0, 0, 1)); len(found) != 1 || found[0].SeriesID != series.ID {
+				t.Errorf("index after the aborted batch = %+v", found)
+			}
+			if deleted := c.DeletedEvents(); len(deleted) != 0 {
+				t.Errorf("deleted events after the aborted batch = %+v", deleted)
+			}
+			if c.feed.last() != seq {
+				t.Errorf("aborted batch published %d changes", c.feed.last()-seq)
+			}
+
+			results, err = c.Batch(1, []BatchOp{
+				{Op: "create", Event: Event{Title: "new", UserID: 1, Date: date.AddDate(0, 0, 1)}},
+				{Op: "update", ID: kept.ID, Version: 1, Event: Event{Title: "renamed", UserID: 1, Date: date}},
+				{Op: "delete", ID: series.ID},
+			}, true, everyone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, err := range batchErrors(results) {
+				if err != nil {
+					t.Errorf("operation %d: error %v", i, err)
+				}
+			}
+			if results[0].Event.ID != series.ID+1 || results[1].Event.Version != 2 || c.feed.last() != seq+3 {
+				t.Errorf("results %+v, %d changes published", results, c.feed.last()-seq)
+			}
+			if events := c.Events(); len(events) != 2 || events[0].Title != "renamed" || events[1].Title != "new" {
+				t.Errorf("events after the batch = %+v", events)
+			}
+
+			results, _ = c.Batch(2, []BatchOp{
+				{Op: "create", Event: Event{Title: "mine", UserID: 2, Date: date}},
+				{Op: "delete", ID: 99},
+				{Op: "delete", ID: kept.ID},
+				{Op: "create", Err: invalidField("date", "invalid date")},
+			}, false, func(userID int) bool { return userID == 2 })
+			errs = batchErrors(results)
+			if errs[0] != nil || !errors.Is(errs[1], errEventNotFound) || !errors.Is(errs[2], errForbidden) || errs[3] == nil {
+				t.Errorf("best effort batch: errors %v", errs)
+			}
+			if events := c.Events(); len(events) != 3 {
+				t.Errorf("events after the best effort batch = %+v", events)
+			}
+		})
+	}
+}
+
+func TestFileStoreBatch(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCalendar(store)
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	batch := make([]BatchOp, 3)
+	for i := range batch {
+		batch[i] = BatchOp{Op: "create", Event: Event{Title: "migrated", UserID: 1, Date: date.AddDate(0, 0, i)}}
+	}
+	if _, err := c.Batch(0, batch, true, func(int) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(dir, journalFile)
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Fatalf("batch written as %d journal lines", lines)
+	}
+	store.journal.Close()
+
+	// A batch cut off by a crash is lost as a whole.
+	for _, tt := range []struct {
+		name   string
+		data   string
+		events int
+	}{
+		{"complete", string(data), 3},
+		{"torn", string(data[:len(data)/2]), 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, journalFile), []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := openFileStore(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if events := reopened.All(); len(events) != tt.events {
+				t.Errorf("%d events replayed, expected %d", len(events), tt.events)
+			}
+			if revisions := reopened.Revisions(); len(revisions) != tt.events {
+				t.Errorf("%d revisions replayed, expected %d", len(revisions), tt.events)
+			}
+		})
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	calendar.CreateEvent(0, Event{Title: "existing", UserID: 1, Date: time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)}, AllowConflicts)
+
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		status   int
+		statuses []int
+		events   int
+	}{
+		{"atomic with an invalid operation", "/batch",
+			`[{"op":"create","title":"a","user_id":1,"date":"2024-05-07"},{"op":"update","id":1,"title":"b","user_id":1,"date":"never"}]`,
+			200, []int{424, 422}, 1},
+		{"atomic with a stale version", "/batch",
+			`[{"op":"create","title":"a","user_id":1,"date":"2024-05-07"},{"op":"delete","id":1,"version":3}]`,
+			200, []int{424, 412}, 1},
+		{"atomic", "/batch",
+			`[{"op":"create","title":"a","user_id":1,"date":"2024-05-07"},{"op":"update","id":1,"version":1,"title":"b","user_id":1,"date":"2024-05-06T10:00:00Z"}]`,
+			200, []int{201, 200}, 2},
+		{"conflicts rejected by the batch", "/batch?conflicts=reject",
+			`[{"op":"create","title":"clash","user_id":1,"date":"2024-05-06T10:00:00Z","duration":"1h"},{"op":"create","title":"allowed","user_id":1,"date":"2024-05-06T10:00:00Z","conflicts":"warn"}]`,
+			200, []int{409, 424}, 2},
+		{"best effort", "/batch?mode=best_effort",
+			`[{"op":"delete","id":2},{"op":"move","id":1},{"op":"delete","id":2}]`,
+			200, []int{204, 422, 404}, 1},
+		{"unknown mode", "/batch?mode=all", `[]`, 422, nil, 1},
+		{"not an array", "/batch", `{"op":"create"}`, 400, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, expected %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if len(calendar.Events()) != tt.events {
+				t.Errorf("%d events, expected %d", len(calendar.Events()), tt.events)
+			}
+			if tt.statuses == nil {
+				return
+			}
+			var response struct {
+				Applied int           `json:"applied"`
+				Results []batchResult `json:"results"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			var statuses []int
+			for _, result := range response.Results {
+				statuses = append(statuses, result.Status)
+			}
+			if len(statuses) != len(tt.statuses) {
+				t.Fatalf("statuses %v, expected %v", statuses, tt.statuses)
+			}
+			for i := range statuses {
+				if statuses[i] != tt.statuses[i] {
+					t.Errorf("statuses %v, expected %v", statuses, tt.statuses)
+					break
+				}
+			}
+		})
+	}
+}
+
+// The probes ping the store itself, never the transaction of a batch in
+// progress, and do not wait for the batch.
+func TestBatchWithProbes(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	// Without the middleware, which would order the requests by its own
+	// locks and hide a race from the detector.
+	api := routes()
+	body := `[{"op":"create","title":"a","user_id":1,"date":"2024-05-07"},{"op":"create","title":"b","user_id":1,"date":"2024-05-08"}]`
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			api.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		rec := httptest.NewRecorder()
+		handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("readyz status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	<-done
+	if len(calendar.Events()) != 100 {
+		t.Errorf("%d events, expected 100", len(calendar.Events()))
+	}
+}
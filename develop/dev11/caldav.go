@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The calendars are also served over CalDAV (RFC 4791). Every user has a
+// principal and a calendar home holding a single calendar, whose members
+// are the events in the calendar of the user:
+//
+//	/dav/                                   the root, naming the principal of the caller
+//	/dav/principals/{user}/                 the principal, naming the calendar home
+//	/dav/calendars/{user}/                  the calendar home
+//	/dav/calendars/{user}/events/           the calendar
+//	/dav/calendars/{user}/events/{uid}.ics  an event or a series with its detached occurrences
+//
+// Calendar clients find the root through /.well-known/caldav (RFC 6764).
+const (
+	davRoot         = "/dav/"
+	davCalendarName = "events"
+
+	davNS            = "DAV:"
+	calDAVNS         = "urn:ietf:params:xml:ns:caldav"
+	calendarServerNS = "http://calendarserver.org/ns/"
+)
+
+// calendarObject is the CalDAV resource of an event: the event or series
+// master first, followed by the detached occurrences of the series in the
+// order of their IDs.
+type calendarObject []Event
+
+func (o calendarObject) uid() string {
+	return o[0].uid()
+}
+
+// etag is the entity tag of the object, made of the versions of its
+// events. It is the ETag of the event itself when there is only one.
+func (o calendarObject) etag() string {
+	versions := make([]string, len(o))
+	for i, event := range o {
+		versions[i] = strconv.Itoa(event.Version)
+	}
+	return `"` + strings.Join(versions, "-") + `"`
+}
+
+// occursBetween reports whether any event of the object occurs in the
+// range.
+func (o calendarObject) occursBetween(start, end time.Time) bool {
+	for _, event := range o {
+		if event.occursBetween(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// calendarCTag identifies the state of a calendar collection: it changes
+// whenever an object is added to it, changed or removed.
+func calendarCTag(objects []calendarObject) string {
+	h := fnv.New64a()
+	for _, object := range objects {
+		fmt.Fprintf(h, "%s %s\n", object.uid(), object.etag())
+	}
+	return `"` + strconv.FormatUint(h.Sum64(), 16) + `"`
+}
+
+// objectOf returns the calendar object of an event that is not a detached
+// occurrence. Must be called with c.mu held.
+func (c *Calendar) objectOf(master Event) calendarObject {
+	ids := make([]int, 0, len(c.index.detached[master.ID]))
+	for id := range c.index.detached[master.ID] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	object := calendarObject{master}
+	for _, id := range ids {
+		object = append(object, c.index.indexed[id])
+	}
+	return object
+}
+
+// lookupUID finds the event exported under uid. Must be called with c.mu
+// held.
+func (c *Calendar) lookupUID(uid string) (Event, bool) {
+	if id, ok := c.index.byUID[uid]; ok {
+		return c.index.indexed[id], true
+	}
+	event, ok := c.index.indexed[icsEventID(uid)]
+	return event, ok && event.UID == "" && event.SeriesID == 0
+}
+
+// CalendarObjects returns the objects of the events in the calendar of the
+// user, ordered by UID.
+func (c *Calendar) CalendarObjects(userID int) []calendarObject {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var objects []calendarObject
+	for _, event := range c.index.indexed {
+		if event.SeriesID == 0 && event.inCalendarOf(userID) {
+			objects = append(objects, c.objectOf(event))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].uid() < objects[j].uid() })
+	return objects
+}
+
+// CalendarObject returns the object exported under uid.
+func (c *Calendar) CalendarObject(uid string) (calendarObject, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	master, exists := c.lookupUID(uid)
+	if !exists {
+		return nil, fmt.Errorf("event with uid %q: %w", uid, errEventNotFound)
+	}
+	return c.objectOf(master), nil
+}
+
+// PutCalendarObject replaces the object exported under uid, or creates it,
+// and reports whether it was created. The first event is the event or the
+// series master and the others are detached occurrences of the series:
+// detached occurrences left out go back to the series, the ones given
+// replace the stored ones with the same recurrence ID or are detached.
+// ifMatch and ifNoneMatch are the values of the HTTP headers the change is
+// conditional on. Conflicts are allowed, as calendar clients have no way
+// to ask otherwise.
+func (c *Calendar) PutCalendarObject(actor int, uid string, events []Event, ifMatch, ifNoneMatch string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	master, exists := c.lookupUID(uid)
+	var current calendarObject
+	if exists {
+		current = c.objectOf(master)
+	}
+	if err := checkObjectPreconditions(uid, current, ifMatch, ifNoneMatch); err != nil {
+		return false, err
+	}
+
+	// The recurrence IDs are compared as instants, whatever their zone.
+	key := func(t *time.Time) int64 { return t.UnixNano() }
+	series := events[0]
+	overridden := make(map[int64]bool)
+	for _, occurrence := range events[1:] {
+		overridden[key(occurrence.RecurrenceID)] = true
+	}
+	var exdates []time.Time
+	for _, exdate := range series.ExDates {
+		if !overridden[key(&exdate)] {
+			exdates = append(exdates, exdate)
+		}
+	}
+	series.ExDates = exdates
+
+	// The object is replaced as a whole or not at all: a RECURRENCE-ID that
+	// is not an occurrence of the new series fails the change after part
+	// of it has been made.
+	now := time.Now().UTC()
+	err := c.atomically(func() error {
+		kept := make(map[int64]int)
+		if exists {
+			for _, detached := range current[1:] {
+				if !overridden[key(detached.RecurrenceID)] {
+					if err := c.delete(actor, detached.ID, 0, now); err != nil {
+						return err
+					}
+					continue
+				}
+				kept[key(detached.RecurrenceID)] = detached.ID
+				series.ExDates = append(series.ExDates, *detached.RecurrenceID)
+			}
+		}
+		// A missing EXDATE or CATEGORIES clears them: the object is replaced
+		// as a whole.
+		if series.ExDates == nil {
+			series.ExDates = []time.Time{}
+		}
+
+		if exists {
+			series.Version = 0
+			updated, err := c.update(actor, master.ID, series, AllowConflicts, now)
+			if err != nil {
+				return err
+			}
+			master = updated
+		} else {
+			series.ID, series.UID = 0, uid
+			created, err := c.create(actor, series, nil, AllowConflicts, now)
+			if err != nil {
+				return err
+			}
+			master = created
+		}
+
+		for _, occurrence := range events[1:] {
+			var err error
+			if id, ok := kept[key(occurrence.RecurrenceID)]; ok {
+				occurrence.SeriesID, occurrence.Version = master.ID, 0
+				_, err = c.update(actor, id, occurrence, AllowConflicts, now)
+			} else {
+				_, err = c.updateOccurrence(actor, master.ID, *occurrence.RecurrenceID, occurrence, AllowConflicts, now)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// DeleteCalendarObject deletes the object exported under uid like
+// DeleteEvent, conditional on the If-Match header ifMatch.
+func (c *Calendar) DeleteCalendarObject(actor int, uid string, ifMatch string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	master, exists := c.lookupUID(uid)
+	if !exists {
+		return fmt.Errorf("event with uid %q: %w", uid, errEventNotFound)
+	}
+	if err := checkObjectPreconditions(uid, c.objectOf(master), ifMatch, ""); err != nil {
+		return err
+	}
+	return c.delete(actor, master.ID, 0, time.Now().UTC())
+}
+
+// checkObjectPreconditions evaluates the If-Match and If-None-Match
+// headers of a change to a calendar object; current is nil when the object
+// does not exist.
+func checkObjectPreconditions(uid string, current calendarObject, ifMatch, ifNoneMatch string) error {
+	if ifMatch != "" && (current == nil || !matchesETag(ifMatch, current.etag())) {
+		return fmt.Errorf("event with uid %q: %w", uid, errStaleVersion)
+	}
+	if ifNoneMatch != "" && current != nil && matchesETag(ifNoneMatch, current.etag()) {
+		return fmt.Errorf("event with uid %q: %w", uid, errStaleVersion)
+	}
+	return nil
+}
+
+// matchesETag reports whether the list of entity tags of an If-Match or
+// If-None-Match header contains etag or is "*".
+func matchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func davPrincipalHref(userID int) string {
+	return davRoot + "principals/" + strconv.Itoa(userID) + "/"
+}
+
+func davHomeHref(userID int) string {
+	return davRoot + "calendars/" + strconv.Itoa(userID) + "/"
+}
+
+func davCalendarHref(userID int) string {
+	return davHomeHref(userID) + davCalendarName + "/"
+}
+
+func davObjectHref(userID int, uid string) string {
+	return davCalendarHref(userID) + url.PathEscape(uid) + ".ics"
+}
+
+// calendarData is not returned for allprop (RFC 4791, section 9.6).
+var calendarData = xml.Name{Space: calDAVNS, Local: "calendar-data"}
+
+// commonProps are the properties of every resource.
+func commonProps(r *http.Request, resourceType string) []davProp {
+	principal := "<D:unauthenticated/>"
+	if caller, ok := callerFrom(r); ok {
+		principal = davHref(davPrincipalHref(caller.ID))
+	}
+	return []davProp{
+		{davName(davNS, "resourcetype"), resourceType},
+		{davName(davNS, "current-user-principal"), principal},
+	}
+}
+
+func rootResource(r *http.Request) davResource {
+	return davResource{href: davRoot, props: commonProps(r, "<D:collection/>")}
+}
+
+func principalResource(r *http.Request, userID int) davResource {
+	props := append(commonProps(r, "<D:principal/>"),
+		davProp{davName(davNS, "displayname"), "user " + strconv.Itoa(userID)},
+		davProp{davName(davNS, "principal-URL"), davHref(davPrincipalHref(userID))},
+		davProp{davName(calDAVNS, "calendar-home-set"), davHref(davHomeHref(userID))},
+		davProp{davName(calDAVNS, "calendar-user-address-set"), davHref(icsUserAddress(userID))})
+	return davResource{href: davPrincipalHref(userID), props: props}
+}
+
+func homeResource(r *http.Request, userID int) davResource {
+	props := append(commonProps(r, "<D:collection/>"),
+		davProp{davName(davNS, "owner"), davHref(davPrincipalHref(userID))})
+	return davResource{href: davHomeHref(userID), props: props}
+}
+
+func calendarResource(r *http.Request, userID int, objects []calendarObject) davResource {
+	ctag := calendarCTag(objects)
+	props := append(commonProps(r, "<D:collection/><C:calendar/>"),
+		davProp{davName(davNS, "displayname"), "calendar of user " + strconv.Itoa(userID)},
+		davProp{davName(davNS, "owner"), davHref(davPrincipalHref(userID))},
+		davProp{davName(davNS, "getetag"), xmlText(ctag)},
+		davProp{davName(calendarServerNS, "getctag"), xmlText(ctag)},
+		davProp{davName(calDAVNS, "supported-calendar-component-set"), `<C:comp name="VEVENT"/>`},
+		davProp{davName(davNS, "supported-report-set"),
+			"<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>" +
+				"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>"})
+	return davResource{href: davCalendarHref(userID), props: props}
+}
+
+func objectResource(r *http.Request, userID int, object calendarObject) davResource {
+	var data bytes.Buffer
+	writeICS(&data, object)
+	props := append(commonProps(r, ""),
+		davProp{davName(davNS, "getetag"), xmlText(object.etag())},
+		davProp{davName(davNS, "getcontenttype"), "text/calendar; charset=utf-8; component=vevent"},
+		davProp{calendarData, xmlText(data.String())})
+	return davResource{href: davObjectHref(userID, object.uid()), props: props}
+}
+
+// errNoResource answers the paths of the tree that name no resource.
+var errNoResource = &httpError{status: http.StatusNotFound, message: "no such resource"}
+
+// davUser returns the user whose resource the request is for, after
+// checking that the path names the resource exactly and that the caller
+// may access it.
+func davUser(w http.ResponseWriter, r *http.Request, href func(int) string) (int, bool) {
+	userID, err := strconv.Atoi(r.PathValue("user"))
+	if err != nil || userID <= 0 {
+		writeError(w, errNoResource)
+		return 0, false
+	}
+	// Clients escape paths in different ways.
+	if path, err := url.PathUnescape(href(userID)); err != nil || r.URL.Path != path {
+		writeError(w, errNoResource)
+		return 0, false
+	}
+	if !canAccess(r, userID) {
+		writeError(w, fmt.Errorf("calendar of user %d: %w", userID, errForbidden))
+		return 0, false
+	}
+	return userID, true
+}
+
+func handleWellKnownCalDAV(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, davRoot, http.StatusMovedPermanently)
+}
+
+var handleDAVRoot = davMethods(map[string]http.HandlerFunc{
+	"PROPFIND": func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != davRoot {
+			writeError(w, errNoResource)
+			return
+		}
+		propfind(w, r, rootResource(r), nil)
+	},
+})
+
+var handleDAVPrincipal = davMethods(map[string]http.HandlerFunc{
+	"PROPFIND": func(w http.ResponseWriter, r *http.Request) {
+		if userID, ok := davUser(w, r, davPrincipalHref); ok {
+			propfind(w, r, principalResource(r, userID), nil)
+		}
+	},
+})
+
+var handleDAVHome = davMethods(map[string]http.HandlerFunc{
+	"PROPFIND": func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := davUser(w, r, davHomeHref)
+		if !ok {
+			return
+		}
+		propfind(w, r, homeResource(r, userID), func() []davResource {
+			return []davResource{calendarResource(r, userID, calendar.CalendarObjects(userID))}
+		})
+	},
+})
+
+var handleDAVCalendar = davMethods(map[string]http.HandlerFunc{
+	"PROPFIND": func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := davUser(w, r, davCalendarHref)
+		if !ok {
+			return
+		}
+		objects := calendar.CalendarObjects(userID)
+		propfind(w, r, calendarResource(r, userID, objects), func() []davResource {
+			members := make([]davResource, len(objects))
+			for i, object := range objects {
+				members[i] = objectResource(r, userID, object)
+			}
+			return members
+		})
+	},
+	"REPORT": reportCalendar,
+})
+
+var handleDAVObject = davMethods(map[string]http.HandlerFunc{
+	"PROPFIND": func(w http.ResponseWriter, r *http.Request) {
+		if userID, object, ok := davObject(w, r); ok {
+			propfind(w, r, objectResource(r, userID, object), nil)
+		}
+	},
+	http.MethodGet:    getCalendarObject,
+	http.MethodHead:   getCalendarObject,
+	http.MethodPut:    putCalendarObject,
+	http.MethodDelete: deleteCalendarObject,
+})
+
+// objectUID returns the UID of the object a request is for, which is the
+// name of the resource without the .ics extension.
+func objectUID(r *http.Request) (string, bool) {
+	return strings.CutSuffix(r.PathValue("resource"), ".ics")
+}
+
+// davObject returns the object a request is for, answering with 404 when
+// it is not in the calendar.
+func davObject(w http.ResponseWriter, r *http.Request) (int, calendarObject, bool) {
+	uid, _ := objectUID(r)
+	userID, ok := davUser(w, r, func(userID int) string { return davObjectHref(userID, uid) })
+	if !ok {
+		return 0, nil, false
+	}
+	object, err := calendar.CalendarObject(uid)
+	if err == nil && !object[0].inCalendarOf(userID) {
+		err = fmt.Errorf("event with uid %q in the calendar of user %d: %w", uid, userID, errEventNotFound)
+	}
+	if err != nil {
+		writeError(w, err)
+		return 0, nil, false
+	}
+	return userID, object, true
+}
+
+func getCalendarObject(w http.ResponseWriter, r *http.Request) {
+	_, object, ok := davObject(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("ETag", object.etag())
+	if header := r.Header.Get("If-None-Match"); header != "" && matchesETag(header, object.etag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	writeICS(w, object)
+}
+
+// putCalendarObject stores the object sent by a calendar client. It must
+// hold the events of a single UID, which the name of the resource is made
+// of, and they stay organised by the user they were first put for. No ETag
+// is returned, as the object is stored in another form than it was sent
+// (RFC 4791, section 5.3.4).
+func putCalendarObject(w http.ResponseWriter, r *http.Request) {
+	uid, ok := objectUID(r)
+	userID, found := davUser(w, r, func(userID int) string { return davObjectHref(userID, uid) })
+	if !found {
+		return
+	}
+	if !ok || uid == "" {
+		writeError(w, errNoResource)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/calendar" {
+		davPrecondition(w, http.StatusForbidden, davName(calDAVNS, "supported-calendar-data"), "")
+		return
+	}
+
+	organizer := userID
+	current, err := calendar.CalendarObject(uid)
+	switch {
+	case err == nil && !current[0].inCalendarOf(userID):
+		davPrecondition(w, http.StatusForbidden, davName(calDAVNS, "no-uid-conflict"), davHref(davObjectHref(current[0].UserID, uid)))
+		return
+	case err == nil:
+		organizer = current[0].UserID
+	case icsEventID(uid) != 0:
+		// The UIDs of the exported events are reserved for them.
+		davPrecondition(w, http.StatusForbidden, davName(calDAVNS, "no-uid-conflict"), "")
+		return
+	}
+	if !canAccess(r, organizer) {
+		writeError(w, fmt.Errorf("event with uid %q: %w", uid, errForbidden))
+		return
+	}
+
+	items, err := parseICS(r.Body, organizer)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, bodyError(err, ""))
+			return
+		}
+		davPrecondition(w, http.StatusForbidden, davName(calDAVNS, "valid-calendar-data"), "")
+		return
+	}
+	events, err := objectEvents(uid, organizer, items)
+	if err != nil {
+		davPrecondition(w, http.StatusForbidden, davName(calDAVNS, "valid-calendar-object-resource"), "")
+		return
+	}
+	for _, event := range events {
+		if errs := validateEvent(event, nil); len(errs) > 0 {
+			writeError(w, errs)
+			return
+		}
+	}
+
+	created, err := calendar.PutCalendarObject(actorOf(r), uid, events, r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if created {
+		w.Header().Set("Location", davObjectHref(userID, uid))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// objectEvents checks that the decoded VEVENTs make up a calendar object
+// for uid: a single event or series master, and detached occurrences only
+// for a series. The events are returned with the master first, organised
+// by organizer.
+func objectEvents(uid string, organizer int, items []icsItem) ([]Event, error) {
+	var master *Event
+	var occurrences []Event
+	for _, item := range items {
+		if item.Err != nil {
+			return nil, item.Err
+		}
+		if item.UID != uid {
+			return nil, fmt.Errorf("UID %q does not match the resource", item.UID)
+		}
+		event := item.Event
+		event.ID, event.SeriesID, event.UserID = 0, 0, organizer
+		if event.Tags == nil {
+			event.Tags = []string{}
+		}
+		if event.Attendees == nil {
+			event.Attendees = []Attendee{}
+		}
+		if event.RecurrenceID != nil {
+			occurrences = append(occurrences, event)
+			continue
+		}
+		if master != nil {
+			return nil, fmt.Errorf("more than one VEVENT without RECURRENCE-ID")
+		}
+		master = &event
+	}
+	if master == nil {
+		return nil, fmt.Errorf("no VEVENT without RECURRENCE-ID")
+	}
+	if len(occurrences) > 0 && master.RRule == "" {
+		return nil, fmt.Errorf("RECURRENCE-ID for an event that does not recur")
+	}
+	return append([]Event{*master}, occurrences...), nil
+}
+
+func deleteCalendarObject(w http.ResponseWriter, r *http.Request) {
+	_, object, ok := davObject(w, r)
+	if !ok {
+		return
+	}
+	if !canAccess(r, object[0].UserID) {
+		writeError(w, fmt.Errorf("event with uid %q: %w", object.uid(), errForbidden))
+		return
+	}
+	if err := calendar.DeleteCalendarObject(actorOf(r), object.uid(), r.Header.Get("If-Match")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// calendarReport is the body of a calendar-query or calendar-multiget
+// REPORT.
+type calendarReport struct {
+	XMLName xml.Name
+	davPropRequest
+	Hrefs  []string `xml:"DAV: href"`
+	Filter *struct {
+		CompFilter compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+// compFilter is a CALDAV:comp-filter. Of the filters only the components
+// and their time ranges are supported.
+type compFilter struct {
+	Name         string       `xml:"name,attr"`
+	IsNotDefined *struct{}    `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TimeRange    *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	CompFilters  []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	PropFilters  []struct{}   `xml:"urn:ietf:params:xml:ns:caldav prop-filter"`
+}
+
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// errUnsupportedFilter and errInvalidFilter are the CALDAV preconditions a
+// calendar-query fails, under their element names.
+var (
+	errUnsupportedFilter = errors.New("supported-filter")
+	errInvalidFilter     = errors.New("valid-filter")
+)
+
+// bounds returns the range of the time-range, which may be open at either
+// end but not both.
+func (t timeRange) bounds() (time.Time, time.Time, error) {
+	start, end := minEventDate, maxEventDate
+	var err error
+	if t.Start == "" && t.End == "" {
+		return start, end, errInvalidFilter
+	}
+	if t.Start != "" {
+		if start, err = parseICalTime(t.Start); err != nil {
+			return start, end, errInvalidFilter
+		}
+	}
+	if t.End != "" {
+		if end, err = parseICalTime(t.End); err != nil || !end.After(start) {
+			return start, end, errInvalidFilter
+		}
+	}
+	return start, end, nil
+}
+
+// matchCalendar reports whether the object passes the filter of its
+// VCALENDAR, whose nested filters must all be passed.
+func (f compFilter) matchCalendar(object calendarObject) (bool, error) {
+	if f.Name != "VCALENDAR" || f.TimeRange != nil {
+		return false, errInvalidFilter
+	}
+	if len(f.PropFilters) > 0 {
+		return false, errUnsupportedFilter
+	}
+	if f.IsNotDefined != nil {
+		return false, nil
+	}
+	for _, nested := range f.CompFilters {
+		if ok, err := nested.matchComponent(object); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchComponent reports whether the object passes a filter of a component
+// of the VCALENDAR. Every object has a VEVENT and nothing else.
+func (f compFilter) matchComponent(object calendarObject) (bool, error) {
+	if len(f.PropFilters) > 0 || len(f.CompFilters) > 0 {
+		return false, errUnsupportedFilter
+	}
+	if f.Name != "VEVENT" {
+		return f.IsNotDefined != nil, nil
+	}
+	if f.IsNotDefined != nil {
+		return false, nil
+	}
+	if f.TimeRange == nil {
+		return true, nil
+	}
+	start, end, err := f.TimeRange.bounds()
+	if err != nil {
+		return false, err
+	}
+	return object.occursBetween(start, end), nil
+}
+
+// reportCalendar answers a calendar-query, with the objects of the
+// calendar passing the filter, or a calendar-multiget, with the objects
+// named by the hrefs.
+func reportCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := davUser(w, r, davCalendarHref)
+	if !ok {
+		return
+	}
+	var q calendarReport
+	if found, err := readXMLBody(r, &q); err != nil || !found {
+		if err == nil {
+			err = badRequest("a REPORT needs a body")
+		}
+		writeError(w, err)
+		return
+	}
+
+	var responses []davResponse
+	switch q.XMLName {
+	case davName(calDAVNS, "calendar-query"):
+		if q.Filter == nil {
+			davPrecondition(w, http.StatusForbidden, davName(calDAVNS, errInvalidFilter.Error()), "")
+			return
+		}
+		for _, object := range calendar.CalendarObjects(userID) {
+			ok, err := q.Filter.CompFilter.matchCalendar(object)
+			if err != nil {
+				davPrecondition(w, http.StatusForbidden, davName(calDAVNS, err.Error()), "")
+				return
+			}
+			if ok {
+				responses = append(responses, q.response(objectResource(r, userID, object)))
+			}
+		}
+	case davName(calDAVNS, "calendar-multiget"):
+		for _, href := range q.Hrefs {
+			responses = append(responses, multigetResponse(r, userID, href, q.davPropRequest))
+		}
+	default:
+		davPrecondition(w, http.StatusForbidden, davName(davNS, "supported-report"), "")
+		return
+	}
+	writeMultistatus(w, responses)
+}
+
+// multigetResponse returns the response for an href of a
+// calendar-multiget, which may be a full URL.
+func multigetResponse(r *http.Request, userID int, href string, q davPropRequest) davResponse {
+	missing := davResponse{href: href, status: http.StatusNotFound}
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return missing
+	}
+	name, found := strings.CutPrefix(u.EscapedPath(), davCalendarHref(userID))
+	escaped, isObject := strings.CutSuffix(name, ".ics")
+	uid, err := url.PathUnescape(escaped)
+	if !found || !isObject || err != nil || strings.Contains(escaped, "/") {
+		return missing
+	}
+	object, err := calendar.CalendarObject(uid)
+	if err != nil || !object[0].inCalendarOf(userID) {
+		return missing
+	}
+	return q.response(objectResource(r, userID, object))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// multistatus is a DAV:multistatus response.
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Status    string `xml:"DAV: status"`
+		Propstats []struct {
+			Prop struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// found returns the properties found for every href of the response, as
+// XML, or the status of the hrefs that were not found.
+func (m multistatus) found() map[string]string {
+	found := make(map[string]string)
+	for _, response := range m.Responses {
+		found[response.Href] = response.Status
+		for _, propstat := range response.Propstats {
+			if strings.Contains(propstat.Status, " 200 ") {
+				found[response.Href] = propstat.Prop.Inner
+			}
+		}
+	}
+	return found
+}
+
+const (
+	standupICS = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:standup@example.com\r\nDTSTAMP:20240501T000000Z\r\nDTSTART:20240506T080000Z\r\nDTEND:20240506T081500Z\r\n" +
+		"RRULE:FREQ=DAILY;COUNT=5\r\nSUMMARY:Standup\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:standup@example.com\r\nDTSTAMP:20240501T000000Z\r\nRECURRENCE-ID:20240508T080000Z\r\n" +
+		"DTSTART:20240508T100000Z\r\nDTEND:20240508T101500Z\r\nSUMMARY:Late standup\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	lunchICS = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:lunch/1\r\nDTSTAMP:20240501T000000Z\r\nDTSTART:20240520T120000Z\r\nDTEND:20240520T130000Z\r\n" +
+		"SUMMARY:Lunch\r\nCATEGORIES:team\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+)
+
+func TestCalDAV(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	users, err := loadUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, name := range []string{"alice", "bob"} {
+		user, err := users.add(name, roleUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := users.issueToken(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	server := httptest.NewServer(newHandler(users, newMetrics(), requestLimits{}))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// dav sends a request as alice, or as bob when the path starts with
+	// "bob:", with headers given as name, value pairs.
+	dav := func(method, path, body string, header ...string) (*http.Response, string) {
+		t.Helper()
+		token := tokens[0]
+		if rest, ok := strings.CutPrefix(path, "bob:"); ok {
+			path, token = rest, tokens[1]
+		}
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("alice", token)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+	// propfind returns the properties found for every href.
+	propfind := func(method, path, depth, body string) map[string]string {
+		t.Helper()
+		resp, data := dav(method, path, body, "Depth", depth, "Content-Type", "application/xml")
+		if resp.StatusCode != http.StatusMultiStatus {
+			t.Fatalf("%s %s: status %d: %s", method, path, resp.StatusCode, data)
+		}
+		var m multistatus
+		if err := xml.Unmarshal([]byte(data), &m); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, data)
+		}
+		return m.found()
+	}
+	props := func(names ...string) string {
+		return `<?xml version="1.0"?><D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/"><D:prop>` +
+			strings.Join(names, "") + `</D:prop></D:propfind>`
+	}
+	const calendarPath = "/dav/calendars/1/events/"
+	ctag := func() string {
+		t.Helper()
+		found := propfind("PROPFIND", calendarPath, "0", props("<CS:getctag/>"))
+		return found[calendarPath]
+	}
+
+	// Discovery: the well-known URL, the principal of the caller, its
+	// calendar home and the calendar in it.
+	if resp, _ := dav("PROPFIND", "/.well-known/caldav", ""); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != davRoot {
+		t.Errorf("well-known: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ := dav(http.MethodOptions, calendarPath, ""); !strings.Contains(resp.Header.Get("DAV"), "calendar-access") ||
+		!strings.Contains(resp.Header.Get("Allow"), "REPORT") {
+		t.Errorf("OPTIONS: DAV %q, Allow %q", resp.Header.Get("DAV"), resp.Header.Get("Allow"))
+	}
+	found := propfind("PROPFIND", "/dav/", "0", props("<D:current-user-principal/>"))
+	if !strings.Contains(found["/dav/"], "<D:href>/dav/principals/1/</D:href>") {
+		t.Errorf("root: %v", found)
+	}
+	found = propfind("PROPFIND", "/dav/principals/1/", "0", props("<C:calendar-home-set/>", "<C:calendar-user-address-set/>", "<D:quota-used-bytes/>"))
+	if !strings.Contains(found["/dav/principals/1/"], "<D:href>/dav/calendars/1/</D:href>") ||
+		!strings.Contains(found["/dav/principals/1/"], "<D:href>urn:x-dev11:user:1</D:href>") {
+		t.Errorf("principal: %v", found)
+	}
+	found = propfind("PROPFIND", "/dav/calendars/1/", "1", "")
+	if len(found) != 2 || !strings.Contains(found[calendarPath], "<C:calendar/>") || !strings.Contains(found[calendarPath], `<C:comp name="VEVENT"/>`) {
+		t.Errorf("home: %v", found)
+	}
+	emptyCTag := ctag()
+
+	// Objects put by the client are served under the name they were put
+	// at, with their detached occurrences.
+	standup, lunch := calendarPath+"standup@example.com.ics", calendarPath+"lunch%2F1.ics"
+	for _, put := range []struct {
+		path, body string
+		header     []string
+		status     int
+	}{
+		{standup, standupICS, []string{"If-None-Match", "*"}, http.StatusCreated},
+		{standup, standupICS, []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		{lunch, lunchICS, nil, http.StatusCreated},
+		{calendarPath + "other.ics", lunchICS, nil, http.StatusForbidden},
+		{calendarPath + "1@dev11.ics", strings.ReplaceAll(lunchICS, "lunch/1", "1@dev11"), nil, http.StatusForbidden},
+		{"bob:" + calendarPath + "x.ics", strings.ReplaceAll(lunchICS, "lunch/1", "x"), nil, http.StatusForbidden},
+	} {
+		resp, data := dav(http.MethodPut, put.path, put.body, append([]string{"Content-Type", "text/calendar"}, put.header...)...)
+		if resp.StatusCode != put.status {
+			t.Errorf("PUT %s: status %d, expected %d: %s", put.path, resp.StatusCode, put.status, data)
+		}
+	}
+	events := calendar.Events()
+	if len(events) != 3 || events[0].UID != "standup@example.com" || events[1].SeriesID != events[0].ID || events[2].Tags[0] != "team" {
+		t.Fatalf("stored %+v", events)
+	}
+	if !events[0].hasExDate(*events[1].RecurrenceID) {
+		t.Error("detached occurrence not excluded from the series")
+	}
+	// An event created through the API that alice attends is in her
+	// calendar too, under the UID it is exported with.
+	invited, err := calendar.CreateEvent(0, Event{Title: "Review", UserID: 2, Date: events[2].Date.AddDate(0, 0, 1), Attendees: []Attendee{{UserID: 1}}}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := calendarPath + icsUID(invited.ID) + ".ics"
+
+	found = propfind("PROPFIND", calendarPath, "1", props("<D:getetag/>", "<D:resourcetype/>"))
+	if len(found) != 4 || !strings.Contains(found[standup], "<D:getetag>&#34;2-1&#34;</D:getetag>") || !strings.Contains(found[review], "<D:getetag>&#34;1&#34;</D:getetag>") {
+		t.Errorf("calendar members: %v", found)
+	}
+	initialCTag := ctag()
+	if initialCTag == emptyCTag {
+		t.Error("ctag did not change with the new objects")
+	}
+
+	resp, data := dav(http.MethodGet, standup, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2-1"` || strings.Count(data, "BEGIN:VEVENT") != 2 ||
+		!strings.Contains(data, "RECURRENCE-ID:20240508T080000Z") || strings.Count(data, "UID:standup@example.com") != 2 {
+		t.Errorf("GET: status %d, ETag %s:\n%s", resp.StatusCode, resp.Header.Get("ETag"), data)
+	}
+
+	// Queries by time range, and fetching objects by href.
+	query := func(start, end string) string {
+		return `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/></D:prop>` +
+			`<C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="` + start + `" end="` + end + `"/>` +
+			`</C:comp-filter></C:comp-filter></C:filter></C:calendar-query>`
+	}
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"detached occurrence", query("20240508T090000Z", "20240508T110000Z"), []string{standup}},
+		{"excluded occurrence", query("20240508T073000Z", "20240508T090000Z"), nil},
+		{"lunch and review", query("20240520T000000Z", "20240522T000000Z"), []string{lunch, review}},
+		{"open end", query("20240509T000000Z", ""), []string{standup, lunch, review}},
+		{"todos", `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/></D:prop>` +
+			`<C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VTODO"/></C:comp-filter></C:filter></C:calendar-query>`, nil},
+	}
+	for _, tt := range tests {
+		found := propfind("REPORT", calendarPath, "1", tt.body)
+		if len(found) != len(tt.expected) {
+			t.Errorf("%s: found %v, expected %v", tt.name, found, tt.expected)
+		}
+		for _, href := range tt.expected {
+			if _, ok := found[href]; !ok {
+				t.Errorf("%s: %s not found in %v", tt.name, href, found)
+			}
+		}
+	}
+	multiget := `<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/><C:calendar-data/></D:prop>` +
+		`<D:href>` + server.URL + lunch + `</D:href><D:href>` + calendarPath + `missing.ics</D:href></C:calendar-multiget>`
+	found = propfind("REPORT", calendarPath, "1", multiget)
+	if !strings.Contains(found[lunch], "SUMMARY:Lunch&#xD;&#xA;") || !strings.Contains(found[calendarPath+"missing.ics"], "404") {
+		t.Errorf("multiget: %v", found)
+	}
+
+	// Changes are conditional on the ETag of the object, and a change of
+	// any object changes the ctag.
+	update := strings.ReplaceAll(standupICS, "SUMMARY:Late standup", "SUMMARY:Later standup")
+	for _, put := range []struct {
+		etag   string
+		status int
+	}{
+		{`"1"`, http.StatusPreconditionFailed},
+		{`"2-1"`, http.StatusNoContent},
+	} {
+		if resp, data := dav(http.MethodPut, standup, update, "Content-Type", "text/calendar", "If-Match", put.etag); resp.StatusCode != put.status {
+			t.Errorf("PUT If-Match %s: status %d: %s", put.etag, resp.StatusCode, data)
+		}
+	}
+	if _, data := dav(http.MethodGet, standup, ""); !strings.Contains(data, "SUMMARY:Later standup") {
+		t.Errorf("updated object:\n%s", data)
+	}
+	updatedCTag := ctag()
+	if updatedCTag == initialCTag {
+		t.Error("ctag did not change with the update")
+	}
+	// Leaving out the detached occurrence puts it back into the series.
+	series := strings.SplitN(standupICS, "BEGIN:VEVENT", 3)
+	if resp, data := dav(http.MethodPut, standup, series[0]+"BEGIN:VEVENT"+series[1]+"END:VCALENDAR\r\n", "Content-Type", "text/calendar"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT without the occurrence: status %d: %s", resp.StatusCode, data)
+	}
+	if events := calendar.Events(); len(events) != 3 || len(events[0].ExDates) != 0 {
+		t.Errorf("occurrence not reattached: %+v", events)
+	}
+
+	// Errors.
+	for _, tt := range []struct {
+		method, path, body string
+		header             []string
+		status             int
+		contains           string
+	}{
+		{"PROPFIND", calendarPath, "", []string{"Depth", "infinity"}, http.StatusForbidden, "<D:propfind-finite-depth/>"},
+		{"PROPFIND", calendarPath, "<D:prop", []string{"Depth", "0"}, http.StatusBadRequest, "invalid XML body"},
+		{"REPORT", calendarPath, `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav"><C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">` +
+			`<C:prop-filter name="SUMMARY"/></C:comp-filter></C:comp-filter></C:filter></C:calendar-query>`, nil, http.StatusForbidden, "<C:supported-filter/>"},
+		{"REPORT", calendarPath, `<D:sync-collection xmlns:D="DAV:"/>`, nil, http.StatusForbidden, "<D:supported-report/>"},
+		{"PROPFIND", "bob:" + calendarPath, "", []string{"Depth", "0"}, http.StatusForbidden, "access denied"},
+		{http.MethodGet, "bob:/dav/calendars/2/events/" + icsUID(invited.ID) + ".ics", "", nil, http.StatusOK, "SUMMARY:Review"},
+		{http.MethodGet, "bob:/dav/calendars/2/events/standup@example.com.ics", "", nil, http.StatusNotFound, "calendar of user 2"},
+		{http.MethodDelete, review, "", nil, http.StatusForbidden, "access denied"},
+		{http.MethodPut, calendarPath + "x.ics", strings.ReplaceAll(lunchICS, "UID:lunch/1", "UID:x\r\nRECURRENCE-ID:20240520T120000Z"), []string{"Content-Type", "text/calendar"},
+			http.StatusForbidden, "<C:valid-calendar-object-resource/>"},
+		{http.MethodPut, calendarPath + "x.ics", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", []string{"Content-Type", "text/calendar"}, http.StatusForbidden, "<C:valid-calendar-data/>"},
+		{http.MethodPut, calendarPath + "x.ics", strings.ReplaceAll(strings.ReplaceAll(lunchICS, "lunch/1", "x"), "SUMMARY:Lunch", "SUMMARY:"), []string{"Content-Type", "text/calendar"},
+			http.StatusUnprocessableEntity, `"field":"title"`},
+		{"MKCALENDAR", calendarPath, "", nil, http.StatusMethodNotAllowed, "method not allowed"},
+		{"PROPFIND", "/dav/calendars/1/other/", "", []string{"Depth", "0"}, http.StatusNotFound, "no such resource"},
+	} {
+		resp, data := dav(tt.method, tt.path, tt.body, tt.header...)
+		if resp.StatusCode != tt.status || !strings.Contains(data, tt.contains) {
+			t.Errorf("%s %s: status %d: %s", tt.method, tt.path, resp.StatusCode, data)
+		}
+	}
+
+	if resp, data := dav(http.MethodDelete, lunch, "", "If-Match", `"1"`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d: %s", resp.StatusCode, data)
+	}
+	if resp, _ := dav(http.MethodGet, lunch, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted object: status %d", resp.StatusCode)
+	}
+	if ctag() == updatedCTag {
+		t.Error("ctag did not change with the deletion")
+	}
+}
+
+func TestPutCalendarObjectAtomic(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	// put puts the object as the CalDAV handler does.
+	put := func(ics string) error {
+		t.Helper()
+		items, err := parseICS(strings.NewReader(ics), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := objectEvents("standup@example.com", 1, items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.PutCalendarObject(1, "standup@example.com", events, "", "")
+		return err
+	}
+	if err := put(standupICS); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := c.CalendarObject("standup@example.com")
+	stored, seq := c.Events(), c.feed.last()
+
+	// The master is renamed and the detached occurrence left out, which
+	// deletes it, before the second occurrence is found not to be one.
+	broken := strings.Replace(standupICS, "SUMMARY:Standup", "SUMMARY:Renamed", 1)
+	broken = strings.Replace(broken, "RECURRENCE-ID:20240508T080000Z", "RECURRENCE-ID:20240508T090000Z", 1)
+	if err := put(broken); !errors.Is(err, errNoOccurrence) {
+		t.Fatalf("PUT with a bad RECURRENCE-ID: error %v", err)
+	}
+
+	after, _ := c.CalendarObject("standup@example.com")
+	if after.etag() != before.etag() || !reflect.DeepEqual(c.Events(), stored) {
+		t.Errorf("object changed by the failed PUT: %+v", c.Events())
+	}
+	if c.feed.last() != seq {
+		t.Errorf("failed PUT published %d changes", c.feed.last()-seq)
+	}
+	if deleted := c.DeletedEvents(); len(deleted) != 0 {
+		t.Errorf("deleted events after the failed PUT: %+v", deleted)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errEventNotFound = errors.New("event does not exist")
+	errEventExists   = errors.New("event already exists")
+	errNoOccurrence  = errors.New("no such occurrence")
+	errStaleVersion  = errors.New("event has been changed since the given version")
+)
+
+// Calendar is safe for concurrent use. IDs are allocated from a counter
+// that starts after the largest ID the store has ever held, so that the ID
+// of an event is never handed out again, even once the event has been
+// deleted and purged. Queries are answered from an in-memory index that is
+// built when the calendar is created and kept in step with every change
+// written to the store; every change is also recorded in the history of
+// the event and published on the change feed.
+//
+// The mutating methods take the ID of the user making the change, which
+// is zero when authentication is disabled. Every stored event carries the
+// version of its last change; updates and deletions may be made
+// conditional on the version the caller has seen.
+type Calendar struct {
+	// WeekStart is the first day of the weeks returned by GetEventsForWeek.
+	WeekStart time.Weekday
+
+	mu    sync.RWMutex
+	store EventStore
+	// base is the store itself: store is swapped for a transaction while
+	// changes are made atomically, base never is.
+	base   EventStore
+	index  *eventIndex
+	feed   *changeFeed
+	nextID int
+	// versions holds the last version of every event with a history, and
+	// deleted the revision that deleted each event still kept.
+	versions map[int]int
+	deleted  map[int]Revision
+	// undo is set while changes are made atomically; see atomically.
+	undo map[int]undoState
+}
+
+func NewCalendar(store EventStore) *Calendar {
+	c := &Calendar{
+		WeekStart: time.Monday,
+		store:     store,
+		base:      store,
+		index:     newEventIndex(),
+		feed:      newChangeFeed(),
+		nextID:    store.MaxID() + 1,
+		versions:  make(map[int]int),
+		deleted:   make(map[int]Revision),
+	}
+	for _, event := range store.All() {
+		c.index.add(event)
+	}
+	for _, revision := range store.Revisions() {
+		c.versions[revision.EventID] = revision.Version
+		if revision.Op == "delete" {
+			c.deleted[revision.EventID] = revision
+		} else {
+			delete(c.deleted, revision.EventID)
+		}
+	}
+	return c
+}
+
+// put stores the event under its next version, records the change as op
+// and returns the stored event. Must be called with c.mu held.
+func (c *Calendar) put(actor int, op string, event Event, at time.Time) (Event, error) {
+	event.Version = c.versions[event.ID] + 1
+	if err := c.store.Put(event); err != nil {
+		return Event{}, err
+	}
+	previous, existed := c.index.indexed[event.ID]
+	c.index.add(event)
+	if existed {
+		c.feed.publish("update", event, &previous)
+		return event, c.record(actor, op, &previous, &event, at)
+	}
+	c.feed.publish("create", event, nil)
+	return event, c.record(actor, op, nil, &event, at)
+}
+
+// checkVersion fails with errStaleVersion when a version is given and the
+// stored event is at another one.
+func checkVersion(existing Event, version int) error {
+	if version != 0 && version != existing.Version {
+		return fmt.Errorf("event with id %d at version %d: %w", existing.ID, existing.Version, errStaleVersion)
+	}
+	return nil
+}
+
+// remove deletes the event from the store; it is kept in its history. Must
+// be called with c.mu held.
+func (c *Calendar) remove(actor, id int, at time.Time) error {
+	if err := c.store.Delete(id); err != nil {
+		return err
+	}
+	event := c.index.indexed[id]
+	c.index.remove(id)
+	c.feed.publish("delete", event, nil)
+	return c.record(actor, "delete", &event, nil, at)
+}
+
+// Ping reports whether the underlying store is available. It does not wait
+// for a batch in progress.
+func (c *Calendar) Ping() error {
+	return c.base.Ping()
+}
+
+func (c *Calendar) GetEvent(id int) (Event, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	event, exists := c.store.Get(id)
+	if !exists {
+		return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	return event, nil
+}
+
+// CreateEvent stores the event and returns it with its ID filled in. A zero
+// ID asks the calendar to allocate one; a client-supplied ID must be free.
+// A UID must not be taken by another event either.
+func (c *Calendar) CreateEvent(actor int, event Event, policy ConflictPolicy) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.create(actor, event, nil, policy, time.Now().UTC())
+}
+
+// ImportEvent creates an event read from an iCalendar file like
+// CreateEvent, except that its attendees keep the replies the file gives
+// them.
+func (c *Calendar) ImportEvent(actor int, event Event) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.create(actor, event, event.Attendees, AllowConflicts, time.Now().UTC())
+}
+
+// create implements CreateEvent; replies are the replies the attendees
+// have already given, which new events have none of. Must be called with
+// c.mu held.
+func (c *Calendar) create(actor int, event Event, replies []Attendee, policy ConflictPolicy, at time.Time) (Event, error) {
+	if event.ID == 0 {
+		event.ID = c.nextID
+	} else if _, exists := c.store.Get(event.ID); exists || c.versions[event.ID] > 0 {
+		return Event{}, fmt.Errorf("event with id %d: %w", event.ID, errEventExists)
+	}
+	if _, taken := c.index.byUID[event.UID]; taken && event.SeriesID == 0 {
+		return Event{}, fmt.Errorf("event with uid %q: %w", event.UID, errEventExists)
+	}
+	event.Attendees = mergeAttendees(event.UserID, event.Attendees, replies)
+	event.Tags = normalizeTags(event.Tags)
+	if err := c.checkConflicts(event, policy); err != nil {
+		return Event{}, err
+	}
+	event, err := c.put(actor, "create", event, at)
+	if err != nil {
+		return Event{}, err
+	}
+	if event.ID >= c.nextID {
+		c.nextID = event.ID + 1
+	}
+	return event, nil
+}
+
+// UpdateEvent replaces the event, or the whole series when the event is
+// recurring. Exceptions of a series, attendees and tags are kept unless new
+// ones are given; attendees invited before keep their replies. The UID of
+// an event never changes.
+// A non-zero event.Version makes the update conditional on the stored
+// event still being at that version.
+func (c *Calendar) UpdateEvent(actor, id int, event Event, policy ConflictPolicy) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.update(actor, id, event, policy, time.Now().UTC())
+}
+
+// update implements UpdateEvent. Must be called with c.mu held.
+func (c *Calendar) update(actor, id int, event Event, policy ConflictPolicy, at time.Time) (Event, error) {
+	existing, exists := c.store.Get(id)
+	if !exists {
+		return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if err := checkVersion(existing, event.Version); err != nil {
+		return Event{}, err
+	}
+	event.ID = id
+	event.UID = existing.UID
+	if event.RRule != "" && event.ExDates == nil {
+		event.ExDates = existing.ExDates
+	}
+	if event.Attendees == nil {
+		event.Attendees = existing.Attendees
+	}
+	event.Attendees = mergeAttendees(event.UserID, event.Attendees, existing.Attendees)
+	if event.Tags == nil {
+		event.Tags = existing.Tags
+	}
+	event.Tags = normalizeTags(event.Tags)
+	if err := c.checkConflicts(event, policy); err != nil {
+		return Event{}, err
+	}
+	return c.put(actor, "update", event, at)
+}
+
+// UpdateOccurrence detaches a single occurrence from the series: the
+// occurrence is excluded from the series and stored as a separate event.
+// A non-zero event.Version is the version the series is expected at.
+func (c *Calendar) UpdateOccurrence(actor, id int, occurrence time.Time, event Event, policy ConflictPolicy) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updateOccurrence(actor, id, occurrence, event, policy, time.Now().UTC())
+}
+
+// updateOccurrence implements UpdateOccurrence. Must be called with c.mu
+// held.
+func (c *Calendar) updateOccurrence(actor, id int, occurrence time.Time, event Event, policy ConflictPolicy, at time.Time) (Event, error) {
+	series, err := c.getOccurrence(id, occurrence)
+	if err != nil {
+		return Event{}, err
+	}
+	if err := checkVersion(series, event.Version); err != nil {
+		return Event{}, err
+	}
+	event.RRule = ""
+	event.ExDates = nil
+	if event.Attendees == nil {
+		event.Attendees = series.Attendees
+	}
+	event.Attendees = mergeAttendees(event.UserID, event.Attendees, series.Attendees)
+	if event.Tags == nil {
+		event.Tags = series.Tags
+	}
+	event.Tags = normalizeTags(event.Tags)
+	event.UID = series.UID
+	event.SeriesID = id
+	event.RecurrenceID = &occurrence
+	if err := c.checkConflicts(event, policy); err != nil {
+		return Event{}, err
+	}
+
+	series.ExDates = append(append([]time.Time(nil), series.ExDates...), occurrence)
+	if _, err := c.put(actor, "update", series, at); err != nil {
+		return Event{}, err
+	}
+
+	event.ID = c.nextID
+	event, err = c.put(actor, "create", event, at)
+	if err != nil {
+		return Event{}, err
+	}
+	c.nextID++
+	return event, nil
+}
+
+// DeleteEvent removes the event, or the whole series together with its
+// detached occurrences when the event is recurring. Deleted events are kept
+// in their history and can be restored with RestoreEvent. A non-zero
+// version makes the deletion conditional like in UpdateEvent.
+func (c *Calendar) DeleteEvent(actor, id, version int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(actor, id, version, time.Now().UTC())
+}
+
+// delete implements DeleteEvent. Must be called with c.mu held.
+func (c *Calendar) delete(actor, id, version int, at time.Time) error {
+	event, exists := c.store.Get(id)
+	if !exists {
+		return fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if err := checkVersion(event, version); err != nil {
+		return err
+	}
+	// The detached occurrences are deleted at the same instant as the
+	// series, which is how RestoreEvent finds them.
+	if event.RRule != "" {
+		for detached := range c.index.detached[id] {
+			if err := c.remove(actor, detached, at); err != nil {
+				return err
+			}
+		}
+	}
+	return c.remove(actor, id, at)
+}
+
+// DeleteOccurrence removes a single occurrence from the series, which a
+// non-zero version expects to be at that version.
+func (c *Calendar) DeleteOccurrence(actor, id int, occurrence time.Time, version int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deleteOccurrence(actor, id, occurrence, version, time.Now().UTC())
+}
+
+// deleteOccurrence implements DeleteOccurrence. Must be called with c.mu
+// held.
+func (c *Calendar) deleteOccurrence(actor, id int, occurrence time.Time, version int, at time.Time) error {
+	series, err := c.getOccurrence(id, occurrence)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(series, version); err != nil {
+		return err
+	}
+	series.ExDates = append(append([]time.Time(nil), series.ExDates...), occurrence)
+	_, err = c.put(actor, "update", series, at)
+	return err
+}
+
+func (c *Calendar) getOccurrence(id int, occurrence time.Time) (Event, error) {
+	series, exists := c.store.Get(id)
+	if !exists {
+		return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+	}
+	if series.RRule == "" || !series.hasOccurrence(occurrence) {
+		return Event{}, fmt.Errorf("event with id %d at %s: %w", id, occurrence.Format(time.RFC3339), errNoOccurrence)
+	}
+	return series, nil
+}
+
+// Events returns the stored events ordered by ID, with recurring series
+// unexpanded.
+func (c *Calendar) Events() []Event {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	events := c.store.All()
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
+
+// EventCountsByUser returns the number of stored events every user
+// organises.
+func (c *Calendar) EventCountsByUser() map[int]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[int]int, len(c.index.organized))
+	for userID, n := range c.index.organized {
+		counts[userID] = n
+	}
+	return counts
+}
+
+// GetEventsForDay returns the events overlapping the calendar day of date,
+// with the day boundaries taken in the location of date.
+func (c *Calendar) GetEventsForDay(date time.Time) []Event {
+	start := startOfDay(date)
+	return c.GetEventsForRange(start, start.AddDate(0, 0, 1))
+}
+
+func (c *Calendar) GetEventsForWeek(date time.Time) []Event {
+	return c.GetEventsForRange(weekWindow(date, c.WeekStart))
+}
+
+func (c *Calendar) GetEventsForMonth(date time.Time) []Event {
+	return c.GetEventsForRange(monthWindow(date))
+}
+
+// GetEventsForRange returns the events overlapping [start, end) ordered by
+// start.
+func (c *Calendar) GetEventsForRange(start, end time.Time) []Event {
+	events, _ := c.QueryEvents(EventQuery{Start: start, End: end})
+	return events
+}
+
+// QueryEvents returns a page of the events matching q, ordered by their
+// start in the location of q.Start and then by ID, and whether more events
+// follow the page.
+func (c *Calendar) QueryEvents(q EventQuery) ([]Event, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	page := &resultPage{limit: q.Limit}
+	c.index.query(q, page)
+	sort.Sort(page)
+	if page.full() {
+		return page.events[:q.Limit], true
+	}
+	return page.events, false
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// weekWindow returns the week containing t that starts on firstDay. The
+// arithmetic is done on calendar dates, so weeks crossing a DST change are
+// 167 or 169 hours long.
+func weekWindow(t time.Time, firstDay time.Weekday) (time.Time, time.Time) {
+	offset := (int(t.Weekday()) - int(firstDay) + 7) % 7
+	start := startOfDay(t).AddDate(0, 0, -offset)
+	return start, start.AddDate(0, 0, 7)
+}
+
+// monthWindow returns the calendar month containing t.
+func monthWindow(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// parseISOWeek parses an ISO 8601 week such as 2024-W05 and returns the
+// Monday it starts on.
+func parseISOWeek(s string, loc *time.Location) (time.Time, error) {
+	var year, week int
+	if _, err := fmt.Sscanf(s, "%4d-W%2d", &year, &week); err != nil || len(s) != len("2006-W01") {
+		return time.Time{}, fmt.Errorf("invalid ISO week %q", s)
+	}
+	// January 4th always falls into the first ISO week.
+	monday, _ := weekWindow(time.Date(year, time.January, 4, 0, 0, 0, 0, loc), time.Monday)
+	start := monday.AddDate(0, 0, 7*(week-1))
+	if y, w := start.ISOWeek(); week < 1 || y != year || w != week {
+		return time.Time{}, fmt.Errorf("invalid ISO week %q", s)
+	}
+	return start, nil
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseWeekday accepts a full or three-letter English weekday name.
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	for name, weekday := range weekdayNames {
+		if len(s) >= 3 && strings.HasPrefix(name, s) {
+			return weekday, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid weekday %q", s)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateEventAssignsIDs(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	first, err := c.CreateEvent(0, Event{Title: "a", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.CreateEvent(0, Event{Title: "b", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 || second.ID != 2 {
+		t.Errorf("got ids %d and %d, expected 1 and 2", first.ID, second.ID)
+	}
+
+	if _, err := c.CreateEvent(0, Event{ID: 2, Title: "c", UserID: 1, Date: date}, AllowConflicts); !errors.Is(err, errEventExists) {
+		t.Errorf("CreateEvent with taken id: error = %v, expected errEventExists", err)
+	}
+
+	explicit, err := c.CreateEvent(0, Event{ID: 10, Title: "d", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := c.CreateEvent(0, Event{Title: "e", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if explicit.ID != 10 || next.ID != 11 {
+		t.Errorf("got ids %d and %d, expected 10 and 11", explicit.ID, next.ID)
+	}
+}
+
+func TestCalendarConcurrentAccess(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	const workers = 16
+	const perWorker = 100
+
+	var wg sync.WaitGroup
+	ids := make(chan int, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				event, err := c.CreateEvent(0, Event{Title: "stress", UserID: w + 1, Date: date}, AllowConflicts)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- event.ID
+
+				event.Title = "updated"
+				if _, err := c.UpdateEvent(0, event.ID, event, AllowConflicts); err != nil {
+					t.Error(err)
+				}
+				c.GetEventsForDay(date)
+				c.GetEventsForWeek(date)
+				c.GetEventsForMonth(date)
+				if i%2 == 0 {
+					if err := c.DeleteEvent(0, event.ID, 0); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d allocated twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("got %d ids, expected %d", len(seen), workers*perWorker)
+	}
+	if got := len(c.store.All()); got != workers*perWorker/2 {
+		t.Errorf("store holds %d events, expected %d", got, workers*perWorker/2)
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s is not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestWeekWindow(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	tests := []struct {
+		name      string
+		date      time.Time
+		firstDay  time.Weekday
+		start     time.Time
+		end       time.Time
+		wantHours float64
+	}{
+		{"monday itself", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), time.Monday,
+			time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), 168},
+		{"sunday with monday start", time.Date(2024, 1, 14, 23, 59, 0, 0, time.UTC), time.Monday,
+			time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), 168},
+		{"sunday with sunday start", time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC), time.Sunday,
+			time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC), 168},
+		{"across year boundary", time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC), time.Monday,
+			time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC), 168},
+		{"across month boundary", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Monday,
+			time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), 168},
+		{"spring forward", time.Date(2024, 3, 12, 9, 0, 0, 0, newYork), time.Monday,
+			time.Date(2024, 3, 11, 0, 0, 0, 0, newYork), time.Date(2024, 3, 18, 0, 0, 0, 0, newYork), 168},
+		{"spring forward inside the week", time.Date(2024, 3, 10, 9, 0, 0, 0, newYork), time.Monday,
+			time.Date(2024, 3, 4, 0, 0, 0, 0, newYork), time.Date(2024, 3, 11, 0, 0, 0, 0, newYork), 167},
+		{"fall back inside the week", time.Date(2024, 10, 27, 12, 0, 0, 0, berlin), time.Monday,
+			time.Date(2024, 10, 21, 0, 0, 0, 0, berlin), time.Date(2024, 10, 28, 0, 0, 0, 0, berlin), 169},
+	}
+
+	for _, tt := range tests {
+		start, end := weekWindow(tt.date, tt.firstDay)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: weekWindow(%v, %v) = [%v, %v), expected [%v, %v)", tt.name, tt.date, tt.firstDay, start, end, tt.start, tt.end)
+		}
+		if hours := end.Sub(start).Hours(); hours != tt.wantHours {
+			t.Errorf("%s: week is %v hours long, expected %v", tt.name, hours, tt.wantHours)
+		}
+	}
+}
+
+func TestMonthWindow(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name  string
+		date  time.Time
+		start time.Time
+		end   time.Time
+	}{
+		{"first day", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"last instant", time.Date(2024, 5, 31, 23, 59, 59, 0, time.UTC),
+			time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap february", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"december", time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"with dst change", time.Date(2024, 11, 20, 0, 0, 0, 0, newYork),
+			time.Date(2024, 11, 1, 0, 0, 0, 0, newYork), time.Date(2024, 12, 1, 0, 0, 0, 0, newYork)},
+	}
+
+	for _, tt := range tests {
+		start, end := monthWindow(tt.date)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s: monthWindow(%v) = [%v, %v), expected [%v, %v)", tt.name, tt.date, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestParseISOWeek(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Time
+		err      bool
+	}{
+		{"2024-W01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2024-W10", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), false},
+		{"2025-W01", time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), false},
+		{"2020-W53", time.Date(2020, 12, 28, 0, 0, 0, 0, time.UTC), false},
+		{"2021-W01", time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC), false},
+		{"2021-W53", time.Time{}, true},
+		{"2024-W00", time.Time{}, true},
+		{"2024-05", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		result, err := parseISOWeek(tt.input, time.UTC)
+		if (err != nil) != tt.err {
+			t.Errorf("parseISOWeek(%q) error = %v, expected error = %v", tt.input, err, tt.err)
+			continue
+		}
+		if !result.Equal(tt.expected) {
+			t.Errorf("parseISOWeek(%q) = %v, expected %v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestCalendarQueryBoundaries(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	c := NewCalendar(newMemoryStore())
+	add := func(title string, date time.Time) {
+		if _, err := c.CreateEvent(0, Event{Title: title, UserID: 1, Date: date.UTC(), End: date.UTC()}, AllowConflicts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("first of month", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	add("last of month", time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC))
+	add("first of next month", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC))
+	add("new year", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	add("new york monday", time.Date(2024, 3, 11, 0, 0, 0, 0, newYork))
+
+	titles := func(events []Event) map[string]bool {
+		result := make(map[string]bool)
+		for _, event := range events {
+			result[event.Title] = true
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		events   []Event
+		expected []string
+	}{
+		{"march in utc", c.GetEventsForMonth(time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)),
+			[]string{"first of month", "last of month", "new york monday"}},
+		{"march in new york", c.GetEventsForMonth(time.Date(2024, 3, 15, 0, 0, 0, 0, newYork)),
+			[]string{"last of month", "first of next month", "new york monday"}},
+		{"week with new year", c.GetEventsForWeek(time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)),
+			[]string{"new year"}},
+		{"week starting on dst monday", c.GetEventsForWeek(time.Date(2024, 3, 11, 12, 0, 0, 0, newYork)),
+			[]string{"new york monday"}},
+		{"week before dst monday", c.GetEventsForWeek(time.Date(2024, 3, 10, 12, 0, 0, 0, newYork)),
+			nil},
+		{"day start is inclusive", c.GetEventsForDay(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)),
+			[]string{"first of month"}},
+	}
+
+	for _, tt := range tests {
+		got := titles(tt.events)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+			continue
+		}
+		for _, title := range tt.expected {
+			if !got[title] {
+				t.Errorf("%s: got %v, expected %v", tt.name, got, tt.expected)
+				break
+			}
+		}
+	}
+}
+
+// scanEvents is the full scan the index replaces.
+func scanEvents(events []Event, start, end time.Time, userID int) []Event {
+	var result []Event
+	for _, event := range events {
+		if userID != 0 && event.UserID != userID {
+			continue
+		}
+		event.occurrences(start, end, func(occurrence Event) bool {
+			result = append(result, occurrence)
+			return true
+		})
+	}
+	loc := start.Location()
+	sort.Slice(result, func(i, j int) bool {
+		return cursorOf(result[i], loc).before(cursorOf(result[j], loc))
+	})
+	return result
+}
+
+// randomCalendar fills a calendar with n events of 10 users spread over a
+// year, a few of them all-day, long or recurring.
+func randomCalendar(tb testing.TB, n int) *Calendar {
+	rnd := rand.New(rand.NewSource(1))
+	c := NewCalendar(newMemoryStore())
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		start := base.Add(time.Duration(rnd.Int63n(int64(365 * 24 * time.Hour)))).Truncate(time.Minute)
+		event := Event{Title: fmt.Sprintf("event %d", i), UserID: rnd.Intn(10) + 1, Date: start, End: start.Add(time.Hour)}
+		switch i % 50 {
+		case 0:
+			event.AllDay = true
+			event.Date = start.Truncate(24 * time.Hour)
+			event.End = event.Date.AddDate(0, 0, 2)
+		case 1:
+			event.End = start.AddDate(0, 0, 10)
+		case 2:
+			event.RRule = "FREQ=WEEKLY;COUNT=20"
+		}
+		if _, err := c.CreateEvent(0, event, AllowConflicts); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestQueryEventsPagination(t *testing.T) {
+	c := randomCalendar(t, 2000)
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+
+	tests := []struct {
+		name   string
+		start  time.Time
+		end    time.Time
+		userID int
+		limit  int
+	}{
+		{"day", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), 0, 3},
+		{"month in tokyo", time.Date(2024, 5, 1, 0, 0, 0, 0, tokyo), time.Date(2024, 6, 1, 0, 0, 0, 0, tokyo), 0, 25},
+		{"month of one user", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), 3, 7},
+		{"year", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), 0, 100},
+	}
+
+	for _, tt := range tests {
+		expected := scanEvents(c.Events(), tt.start, tt.end, tt.userID)
+
+		var got []Event
+		q := EventQuery{Start: tt.start, End: tt.end, UserID: tt.userID, Limit: tt.limit}
+		for {
+			page, more := c.QueryEvents(q)
+			if len(page) > tt.limit {
+				t.Fatalf("%s: page of %d events, expected at most %d", tt.name, len(page), tt.limit)
+			}
+			got = append(got, page...)
+			if !more {
+				break
+			}
+			q.After = cursorOf(page[len(page)-1], tt.start.Location())
+		}
+
+		if len(got) != len(expected) {
+			t.Errorf("%s: got %d events, expected %d", tt.name, len(got), len(expected))
+			continue
+		}
+		for i := range got {
+			if got[i].ID != expected[i].ID || !got[i].Date.Equal(expected[i].Date) {
+				t.Errorf("%s: event %d is %d at %s, expected %d at %s", tt.name, i,
+					got[i].ID, got[i].Date, expected[i].ID, expected[i].Date)
+				break
+			}
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	cursor := eventCursor{Start: time.Date(2024, 5, 1, 9, 30, 0, 5, time.UTC), ID: 42}
+	parsed, err := parseCursor(cursor.String())
+	if err != nil || !parsed.Start.Equal(cursor.Start) || parsed.ID != cursor.ID {
+		t.Errorf("parseCursor(%q) = %v, %v, expected %v", cursor.String(), parsed, err, cursor)
+	}
+	for _, s := range []string{"", "!!", "bm90LWEtY3Vyc29y"} {
+		if _, err := parseCursor(s); err == nil {
+			t.Errorf("parseCursor(%q): expected an error", s)
+		}
+	}
+}
+
+func BenchmarkRangeQuery(b *testing.B) {
+	c := randomCalendar(b, 200000)
+	events := c.Events()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	week := day.AddDate(0, 0, 7)
+
+	b.Run("index/day", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.GetEventsForRange(day, day.AddDate(0, 0, 1))
+		}
+	})
+	b.Run("scan/day", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanEvents(events, day, day.AddDate(0, 0, 1), 0)
+		}
+	})
+	b.Run("index/week-user", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.QueryEvents(EventQuery{Start: day, End: week, UserID: 3})
+		}
+	})
+	b.Run("scan/week-user", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanEvents(events, day, week, 3)
+		}
+	})
+	b.Run("index/year-page", func(b *testing.B) {
+		end := day.AddDate(1, 0, 0)
+		for i := 0; i < b.N; i++ {
+			c.QueryEvents(EventQuery{Start: day, End: end, Limit: 50})
+		}
+	})
+}
+
+func TestEventOverlaps(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	newYork := mustLoadLocation(t, "America/New_York")
+	at := func(hour int) time.Time { return time.Date(2024, 5, 6, hour, 0, 0, 0, time.UTC) }
+	timed := func(from, to int) Event { return Event{Date: at(from), End: at(to)} }
+	allDay := Event{Date: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 7, 0, 0, 0, 0, time.UTC), AllDay: true}
+	day := func(loc *time.Location, d int) (time.Time, time.Time) {
+		return time.Date(2024, 5, d, 0, 0, 0, 0, loc), time.Date(2024, 5, d+1, 0, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name       string
+		event      Event
+		start, end time.Time
+		expected   bool
+	}{
+		{"ends at the start", timed(8, 10), at(10), at(12), false},
+		{"starts at the end", timed(12, 13), at(10), at(12), false},
+		{"starts at the start", timed(10, 11), at(10), at(12), true},
+		{"runs through", timed(8, 14), at(10), at(12), true},
+		{"ends just after the start", Event{Date: at(8), End: at(10).Add(time.Nanosecond)}, at(10), at(12), true},
+		{"point at the start", timed(10, 10), at(10), at(12), true},
+		{"point at the end", timed(12, 12), at(10), at(12), false},
+		{"all-day in utc", allDay, at(0), at(24), true},
+		{"all-day on its date in tokyo", allDay, time.Date(2024, 5, 6, 0, 0, 0, 0, tokyo), time.Date(2024, 5, 7, 0, 0, 0, 0, tokyo), true},
+		{"all-day the next day in tokyo", allDay, time.Date(2024, 5, 7, 0, 0, 0, 0, tokyo), time.Date(2024, 5, 8, 0, 0, 0, 0, tokyo), false},
+		{"all-day the day before in new york", allDay, time.Date(2024, 5, 5, 0, 0, 0, 0, newYork), time.Date(2024, 5, 6, 0, 0, 0, 0, newYork), false},
+		{"all-day late in the evening before in new york", allDay, time.Date(2024, 5, 5, 22, 0, 0, 0, newYork), time.Date(2024, 5, 5, 23, 0, 0, 0, newYork), false},
+		{"all-day first hour in new york", allDay, time.Date(2024, 5, 6, 0, 0, 0, 0, newYork), time.Date(2024, 5, 6, 1, 0, 0, 0, newYork), true},
+	}
+	for _, tt := range tests {
+		if got := tt.event.overlaps(tt.start, tt.end); got != tt.expected {
+			t.Errorf("%s: overlaps = %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+
+	// The same holds for the queries, which go through the index.
+	c := NewCalendar(newMemoryStore())
+	for _, event := range []Event{
+		{Title: "morning", Date: time.Date(2024, 5, 5, 22, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)},
+		{Title: "holiday", Date: allDay.Date, End: allDay.End, AllDay: true},
+	} {
+		event.UserID = 1
+		if _, err := c.CreateEvent(0, event, AllowConflicts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queries := []struct {
+		name     string
+		loc      *time.Location
+		day      int
+		expected string
+	}{
+		{"utc day after the morning", time.UTC, 6, "holiday"},
+		{"utc day of the morning", time.UTC, 5, "morning"},
+		{"tokyo", tokyo, 6, "holiday morning"},
+		{"tokyo next day", tokyo, 7, ""},
+		{"new york", newYork, 6, "holiday"},
+		{"new york day before", newYork, 5, "morning"},
+	}
+	for _, tt := range queries {
+		var titles []string
+		for _, event := range c.GetEventsForRange(day(tt.loc, tt.day)) {
+			titles = append(titles, event.Title)
+		}
+		sort.Strings(titles)
+		if got := fmt.Sprint(titles); got != "["+tt.expected+"]" {
+			t.Errorf("%s: events %s, expected [%s]", tt.name, got, tt.expected)
+		}
+	}
+}
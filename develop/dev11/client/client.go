@@ -0,0 +1,483 @@
+// Package client is a typed Go client for the calendar API of dev11, as
+// described by the OpenAPI document the server serves at /openapi.json.
+//
+//	c := client.New("http://calendar:8080", token)
+//	event, err := c.CreateEvent(ctx, client.Event{Title: "review", Date: start, End: end}, client.RejectConflicts)
+//	if errors.Is(err, client.ErrConflict) { ... }
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the API of one dev11 server. Its fields may be changed
+// before the first call.
+type Client struct {
+	// BaseURL is the URL of the server, such as http://localhost:8080.
+	BaseURL string
+	// Token is the bearer token of the caller; it is left out when empty,
+	// for servers with authentication disabled.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL using the default HTTP
+// client.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Token: token, HTTPClient: http.DefaultClient}
+}
+
+// ConflictPolicy tells the server what to do with an event that overlaps
+// another event of the same user. The zero value is the server default,
+// WarnConflicts.
+type ConflictPolicy string
+
+const (
+	WarnConflicts   ConflictPolicy = "warn"
+	RejectConflicts ConflictPolicy = "reject"
+)
+
+// ListOptions filters ListEvents. Without From and To every event is
+// listed, recurring series as their masters; with them the occurrences in
+// [From, To) are, a page of Limit at a time when Limit is set.
+type ListOptions struct {
+	UserID   int
+	From, To time.Time
+	// TimeZone is the IANA zone all-day events are looked at from.
+	TimeZone string
+	Limit    int
+	// Cursor is the cursor returned with the previous page.
+	Cursor string
+}
+
+// ListEvents returns the events matching opts and the cursor of the next
+// page, which is empty on the last one.
+func (c *Client) ListEvents(ctx context.Context, opts ListOptions) ([]Event, string, error) {
+	query := url.Values{}
+	if opts.UserID != 0 {
+		query.Set("user_id", strconv.Itoa(opts.UserID))
+	}
+	if !opts.From.IsZero() || !opts.To.IsZero() {
+		query.Set("from", opts.From.Format(time.RFC3339Nano))
+		query.Set("to", opts.To.Format(time.RFC3339Nano))
+	}
+	if opts.TimeZone != "" {
+		query.Set("tz", opts.TimeZone)
+	}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+
+	var events []Event
+	header, err := c.do(ctx, http.MethodGet, "/api/v1/events", query, nil, nil, &events)
+	if err != nil {
+		return nil, "", err
+	}
+	return events, header.Get("X-Next-Cursor"), nil
+}
+
+// GetEvent returns an event or a detached occurrence of a series.
+func (c *Client) GetEvent(ctx context.Context, id int) (Event, error) {
+	var event Event
+	_, err := c.do(ctx, http.MethodGet, eventPath(id), nil, nil, nil, &event)
+	return event, err
+}
+
+// CreateEvent stores a new event. Without a UserID the event belongs to
+// the caller.
+func (c *Client) CreateEvent(ctx context.Context, event Event, policy ConflictPolicy) (Event, error) {
+	var created Event
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/events", policy.query(), nil, eventBody(event), &created)
+	return created, err
+}
+
+// UpdateEvent replaces the event with the ID of event. A non-zero Version
+// makes the update fail with ErrPreconditionFailed when the event has
+// changed since. Attendees and tags are kept when they are nil.
+func (c *Client) UpdateEvent(ctx context.Context, event Event, policy ConflictPolicy) (Event, error) {
+	var updated Event
+	_, err := c.do(ctx, http.MethodPut, eventPath(event.ID), policy.query(), ifMatch(event.Version), eventBody(event), &updated)
+	return updated, err
+}
+
+// UpdateOccurrence detaches the occurrence of series id originally starting
+// at occurrence and replaces it with event. A non-zero event.Version is the
+// expected version of the series.
+func (c *Client) UpdateOccurrence(ctx context.Context, id int, occurrence time.Time, event Event, policy ConflictPolicy) (Event, error) {
+	query := policy.query()
+	query.Set("occurrence", occurrence.Format(time.RFC3339Nano))
+	var updated Event
+	_, err := c.do(ctx, http.MethodPut, eventPath(id), query, ifMatch(event.Version), eventBody(event), &updated)
+	return updated, err
+}
+
+// PatchEvent changes the given fields of an event, keyed as in the request
+// bodies of the API, e.g. {"title": "new title", "duration": "1h"}.
+func (c *Client) PatchEvent(ctx context.Context, id int, changes map[string]interface{}, version int) (Event, error) {
+	var updated Event
+	_, err := c.do(ctx, http.MethodPatch, eventPath(id), nil, ifMatch(version), changes, &updated)
+	return updated, err
+}
+
+// DeleteEvent deletes an event, which can then be restored from its
+// history. A non-zero version makes the deletion conditional.
+func (c *Client) DeleteEvent(ctx context.Context, id, version int) error {
+	_, err := c.do(ctx, http.MethodDelete, eventPath(id), nil, ifMatch(version), nil, nil)
+	return err
+}
+
+// DeleteOccurrence deletes the occurrence of series id originally starting
+// at occurrence.
+func (c *Client) DeleteOccurrence(ctx context.Context, id int, occurrence time.Time, version int) error {
+	query := url.Values{"occurrence": {occurrence.Format(time.RFC3339Nano)}}
+	_, err := c.do(ctx, http.MethodDelete, eventPath(id), query, ifMatch(version), nil, nil)
+	return err
+}
+
+// History returns the revisions of an event, oldest first.
+func (c *Client) History(ctx context.Context, id int) ([]Revision, error) {
+	var history []Revision
+	_, err := c.do(ctx, http.MethodGet, eventPath(id)+"/history", nil, nil, nil, &history)
+	return history, err
+}
+
+// RestoreEvent rolls an event back to the state it had after version,
+// undeleting it if necessary.
+func (c *Client) RestoreEvent(ctx context.Context, id, version int) (Event, error) {
+	var restored Event
+	_, err := c.do(ctx, http.MethodPost, eventPath(id)+"/restore", nil, nil, map[string]interface{}{"version": version}, &restored)
+	return restored, err
+}
+
+// DeletedEvents returns the deleted events that can still be restored.
+func (c *Client) DeletedEvents(ctx context.Context) ([]Event, error) {
+	var events []Event
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/deleted_events", nil, nil, nil, &events)
+	return events, err
+}
+
+// InviteAttendees invites users to an event; users already invited keep
+// their reply.
+func (c *Client) InviteAttendees(ctx context.Context, id int, userIDs []int, version int) (Event, error) {
+	var event Event
+	_, err := c.do(ctx, http.MethodPost, eventPath(id)+"/invite", nil, ifMatch(version), map[string]interface{}{"user_ids": userIDs}, &event)
+	return event, err
+}
+
+// RespondToEvent records the reply of an attendee, one of the Status
+// constants. A zero userID stands for the caller.
+func (c *Client) RespondToEvent(ctx context.Context, id, userID int, status string) (Event, error) {
+	body := map[string]interface{}{"status": status}
+	if userID != 0 {
+		body["user_id"] = userID
+	}
+	var event Event
+	_, err := c.do(ctx, http.MethodPost, eventPath(id)+"/rsvp", nil, nil, body, &event)
+	return event, err
+}
+
+// SearchOptions filters Search. Every word of Text must occur in the title
+// or the description of an event, which must also carry all Tags; at least
+// one of them is required.
+type SearchOptions struct {
+	Text     string
+	Tags     []string
+	UserID   int
+	From, To time.Time
+	// Limit is the number of results, 50 when zero.
+	Limit int
+}
+
+// Search returns the events matching opts, the most relevant first.
+func (c *Client) Search(ctx context.Context, opts SearchOptions) ([]SearchResult, error) {
+	query := url.Values{}
+	if opts.Text != "" {
+		query.Set("q", opts.Text)
+	}
+	if len(opts.Tags) > 0 {
+		query.Set("tag", strings.Join(opts.Tags, ","))
+	}
+	if opts.UserID != 0 {
+		query.Set("user_id", strconv.Itoa(opts.UserID))
+	}
+	if !opts.From.IsZero() {
+		query.Set("from", opts.From.Format(time.RFC3339Nano))
+	}
+	if !opts.To.IsZero() {
+		query.Set("to", opts.To.Format(time.RFC3339Nano))
+	}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	var results []SearchResult
+	_, err := c.do(ctx, http.MethodGet, "/search", query, nil, nil, &results)
+	return results, err
+}
+
+// FreeSlotsQuery describes the meeting FreeSlots looks for. The working
+// hours default to 09:00-18:00 on weekdays.
+type FreeSlotsQuery struct {
+	UserIDs  []int
+	From, To time.Time
+	Duration time.Duration
+	TimeZone string
+	// WorkStart and WorkEnd are times of day such as "09:30".
+	WorkStart, WorkEnd string
+	// WorkDays are weekdays such as "mon".
+	WorkDays []string
+}
+
+// FreeSlots returns the intervals in which all the users are free.
+func (c *Client) FreeSlots(ctx context.Context, q FreeSlotsQuery) ([]Slot, error) {
+	ids := make([]string, len(q.UserIDs))
+	for i, id := range q.UserIDs {
+		ids[i] = strconv.Itoa(id)
+	}
+	query := url.Values{
+		"user_ids": {strings.Join(ids, ",")},
+		"from":     {q.From.Format(time.RFC3339Nano)},
+		"to":       {q.To.Format(time.RFC3339Nano)},
+		"duration": {q.Duration.String()},
+	}
+	if q.TimeZone != "" {
+		query.Set("tz", q.TimeZone)
+	}
+	if q.WorkStart != "" {
+		query.Set("work_start", q.WorkStart)
+	}
+	if q.WorkEnd != "" {
+		query.Set("work_end", q.WorkEnd)
+	}
+	if len(q.WorkDays) > 0 {
+		query.Set("work_days", strings.Join(q.WorkDays, ","))
+	}
+
+	var slots []Slot
+	_, err := c.do(ctx, http.MethodGet, "/free_slots", query, nil, nil, &slots)
+	return slots, err
+}
+
+// The operations of Batch.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOp is an operation of Batch: the creation of Event, or the update
+// or deletion of the event ID, or of its occurrence originally starting at
+// Occurrence when that is set. A non-zero Version makes an update or
+// deletion conditional.
+type BatchOp struct {
+	Op         string
+	ID         int
+	Occurrence time.Time
+	Version    int
+	Event      Event
+	Conflicts  ConflictPolicy
+}
+
+// BatchResult is the outcome of an operation of Batch, with the status
+// code its own request would have got: 201, 200 or 204 when it succeeded,
+// and 424 when an atomic batch failed because of another operation.
+type BatchResult struct {
+	Index  int          `json:"index"`
+	Op     string       `json:"op"`
+	Status int          `json:"status"`
+	ID     int          `json:"id,omitempty"`
+	Event  *Event       `json:"event,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Field  string       `json:"field,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// Batch applies the operations in order in a single request. An atomic
+// batch is all-or-nothing; otherwise every operation is applied on its
+// own. The operations that failed are reported in their result, not as
+// the error.
+func (c *Client) Batch(ctx context.Context, ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	body := make([]map[string]interface{}, len(ops))
+	for i, op := range ops {
+		item := map[string]interface{}{}
+		if op.Op != BatchDelete {
+			item = eventBody(op.Event)
+		}
+		item["op"] = op.Op
+		if op.ID != 0 {
+			item["id"] = op.ID
+		}
+		if !op.Occurrence.IsZero() {
+			item["occurrence"] = op.Occurrence.Format(time.RFC3339Nano)
+		}
+		if op.Version != 0 {
+			item["version"] = op.Version
+		}
+		if op.Conflicts != "" {
+			item["conflicts"] = string(op.Conflicts)
+		}
+		body[i] = item
+	}
+	query := url.Values{"mode": {"best_effort"}}
+	if atomic {
+		query.Set("mode", "atomic")
+	}
+
+	var response struct {
+		Results []BatchResult `json:"results"`
+	}
+	_, err := c.do(ctx, http.MethodPost, "/batch", query, nil, body, &response)
+	return response.Results, err
+}
+
+func eventPath(id int) string {
+	return "/api/v1/events/" + strconv.Itoa(id)
+}
+
+func (p ConflictPolicy) query() url.Values {
+	query := url.Values{}
+	if p != "" {
+		query.Set("conflicts", string(p))
+	}
+	return query
+}
+
+func ifMatch(version int) http.Header {
+	if version == 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {strconv.Quote(strconv.Itoa(version))}}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into result. Error responses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body, result interface{}) (http.Header, error) {
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return resp.Header, responseError(resp)
+	}
+	if result != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp.Header, fmt.Errorf("%s %s: decoding response: %w", method, path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// The errors an *Error matches with errors.Is, by status code.
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("access denied")
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("event has been changed since the given version")
+	ErrInvalid            = errors.New("invalid request")
+	ErrTooManyRequests    = errors.New("too many requests")
+)
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+	// Field names the first invalid field and Errors lists all of them.
+	Field  string       `json:"field,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+	// Conflicts are the events a rejected event overlaps.
+	Conflicts []Event `json:"conflicts,omitempty"`
+	// RetryAfter is how long to wait after ErrTooManyRequests.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// FieldError reports a request field whose value is unacceptable.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dev11: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusPreconditionFailed:
+		return target == ErrPreconditionFailed
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return target == ErrInvalid
+	case http.StatusTooManyRequests:
+		return target == ErrTooManyRequests
+	}
+	return false
+}
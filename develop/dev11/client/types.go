@@ -0,0 +1,171 @@
+package client
+
+import (
+	"strings"
+	"time"
+)
+
+// Event is an event of the calendar, with the JSON encoding of the API.
+type Event struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UserID      int       `json:"user_id"`
+	Date        time.Time `json:"date"`
+
+	// End is exclusive. TimeZone is the IANA zone the event was scheduled
+	// in; Date and End are sent back in UTC. All-day events cover their
+	// calendar dates in whatever zone they are looked at from.
+	End      time.Time `json:"end"`
+	TimeZone string    `json:"timezone,omitempty"`
+	AllDay   bool      `json:"all_day,omitempty"`
+
+	Reminders []Reminder `json:"reminders,omitempty"`
+
+	// UserID is the organizer of the event; Attendees are the users it
+	// invited.
+	Attendees []Attendee `json:"attendees,omitempty"`
+
+	// Tags categorise the event; the server lower-cases them.
+	Tags []string `json:"tags,omitempty"`
+
+	// UID is the iCalendar UID of an event created over CalDAV. It is
+	// read-only.
+	UID string `json:"uid,omitempty"`
+
+	// RRule and ExDates make the event the master of a recurring series.
+	RRule   string      `json:"rrule,omitempty"`
+	ExDates []time.Time `json:"exdates,omitempty"`
+
+	// A detached occurrence of a series, and every occurrence listed in a
+	// range, refers back to the series and its original start.
+	SeriesID     int        `json:"series_id,omitempty"`
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+
+	// Version is the version of the last change of the event.
+	Version int `json:"version"`
+}
+
+// Reminder asks for a notification Before the event starts.
+type Reminder struct {
+	Before  Duration `json:"before"`
+	Channel string   `json:"channel,omitempty"`
+	Target  string   `json:"target,omitempty"`
+}
+
+// Duration is a time.Duration encoded as a string such as "15m0s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// The replies of an attendee.
+const (
+	StatusNeedsAction = "needs-action"
+	StatusAccepted    = "accepted"
+	StatusDeclined    = "declined"
+	StatusTentative   = "tentative"
+)
+
+// Attendee is a user invited to an event and its reply.
+type Attendee struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// Revision is an entry of the history of an event. Before is missing for
+// the creation and After for the deletion.
+type Revision struct {
+	EventID int       `json:"event_id"`
+	Version int       `json:"version"`
+	Op      string    `json:"op"`
+	ActorID int       `json:"actor_id,omitempty"`
+	Time    time.Time `json:"time"`
+	Before  *Event    `json:"before,omitempty"`
+	After   *Event    `json:"after,omitempty"`
+}
+
+// SearchResult is an event found by Search with its relevance.
+type SearchResult struct {
+	Score float64 `json:"score"`
+	Event Event   `json:"event"`
+}
+
+// Slot is a free interval.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// eventBody encodes an event as the request body the API expects, which
+// differs from its response encoding: all-day events are sent as dates,
+// reminders in their compact form and attendees as user IDs. A nil
+// Attendees or Tags is left out, so that an update keeps them.
+func eventBody(event Event) map[string]interface{} {
+	format := func(t time.Time) string {
+		if event.AllDay {
+			return t.UTC().Format("2006-01-02")
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	body := map[string]interface{}{
+		"title":       event.Title,
+		"description": event.Description,
+		"date":        format(event.Date),
+	}
+	if event.UserID != 0 {
+		body["user_id"] = event.UserID
+	}
+	if !event.End.IsZero() {
+		body["end"] = format(event.End)
+	}
+	if event.TimeZone != "" {
+		body["timezone"] = event.TimeZone
+	}
+	if event.RRule != "" {
+		body["rrule"] = event.RRule
+	}
+	if len(event.ExDates) > 0 {
+		exdates := make([]string, len(event.ExDates))
+		for i, exdate := range event.ExDates {
+			exdates[i] = format(exdate)
+		}
+		body["exdates"] = exdates
+	}
+	if len(event.Reminders) > 0 {
+		reminders := make([]string, len(event.Reminders))
+		for i, reminder := range event.Reminders {
+			parts := []string{time.Duration(reminder.Before).String()}
+			if reminder.Channel != "" || reminder.Target != "" {
+				parts = append(parts, reminder.Channel)
+			}
+			if reminder.Target != "" {
+				parts = append(parts, reminder.Target)
+			}
+			reminders[i] = strings.Join(parts, "/")
+		}
+		body["reminders"] = reminders
+	}
+	if event.Attendees != nil {
+		attendees := make([]int, len(event.Attendees))
+		for i, attendee := range event.Attendees {
+			attendees[i] = attendee.UserID
+		}
+		body["attendees"] = attendees
+	}
+	if event.Tags != nil {
+		body["tags"] = event.Tags
+	}
+	return body
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dev11/client"
+)
+
+func TestClient(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	server := httptest.NewServer(newHandler(nil, newMetrics(), requestLimits{}))
+	defer server.Close()
+	c := client.New(server.URL, "")
+	ctx := context.Background()
+	day := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+
+	review, err := c.CreateEvent(ctx, client.Event{
+		Title: "review", UserID: 1, Date: day.Add(10 * time.Hour), End: day.Add(11 * time.Hour),
+		TimeZone:  "Europe/Berlin",
+		Reminders: []client.Reminder{{Before: client.Duration(15 * time.Minute)}, {Before: client.Duration(time.Hour), Channel: "email", Target: "a@example.com"}},
+		Attendees: []client.Attendee{{UserID: 2}},
+		Tags:      []string{"Work"},
+	}, client.RejectConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if review.ID != 1 || review.Version != 1 || len(review.Reminders) != 2 || review.Reminders[1].Target != "a@example.com" ||
+		len(review.Attendees) != 1 || review.Attendees[0].Status != client.StatusNeedsAction {
+		t.Fatalf("created %+v", review)
+	}
+	holiday, err := c.CreateEvent(ctx, client.Event{Title: "holiday", UserID: 1, Date: day, End: day.AddDate(0, 0, 2), AllDay: true}, "")
+	if err != nil || !holiday.AllDay || !holiday.End.Equal(day.AddDate(0, 0, 2)) {
+		t.Fatalf("all-day event %+v, %v", holiday, err)
+	}
+
+	_, err = c.CreateEvent(ctx, client.Event{Title: "clash", UserID: 1, Date: day.Add(10*time.Hour + 30*time.Minute)}, client.RejectConflicts)
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrConflict) || !errors.As(err, &apiErr) || len(apiErr.Conflicts) != 2 {
+		t.Errorf("conflicting event: error %v", err)
+	}
+	_, err = c.CreateEvent(ctx, client.Event{UserID: 1, Date: day}, "")
+	if !errors.Is(err, client.ErrInvalid) || !errors.As(err, &apiErr) || apiErr.Field != "title" {
+		t.Errorf("event without title: error %v", err)
+	}
+
+	got, err := c.GetEvent(ctx, review.ID)
+	if err != nil || got.Title != "review" || got.TimeZone != "Europe/Berlin" {
+		t.Errorf("GetEvent = %+v, %v", got, err)
+	}
+	if _, err := c.GetEvent(ctx, 99); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("missing event: error %v", err)
+	}
+
+	update := review
+	update.Title = "final review"
+	update.Attendees = nil
+	if update, err = c.UpdateEvent(ctx, update, ""); err != nil || update.Version != 2 || len(update.Attendees) != 1 {
+		t.Fatalf("UpdateEvent = %+v, %v", update, err)
+	}
+	if _, err := c.UpdateEvent(ctx, review, ""); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Errorf("stale update: error %v", err)
+	}
+	if patched, err := c.PatchEvent(ctx, review.ID, map[string]interface{}{"duration": "30m"}, update.Version); err != nil ||
+		!patched.End.Equal(day.Add(10*time.Hour+30*time.Minute)) {
+		t.Errorf("PatchEvent = %+v, %v", patched, err)
+	}
+	if invited, err := c.InviteAttendees(ctx, review.ID, []int{3}, 0); err != nil || len(invited.Attendees) != 2 {
+		t.Errorf("InviteAttendees = %+v, %v", invited, err)
+	}
+	if replied, err := c.RespondToEvent(ctx, review.ID, 3, client.StatusAccepted); err != nil || replied.Attendees[1].Status != client.StatusAccepted {
+		t.Errorf("RespondToEvent = %+v, %v", replied, err)
+	}
+
+	var listed []client.Event
+	cursor := ""
+	for pages := 0; pages == 0 || cursor != ""; pages++ {
+		var page []client.Event
+		page, cursor, err = c.ListEvents(ctx, client.ListOptions{UserID: 1, From: day, To: day.AddDate(0, 0, 7), Limit: 1, Cursor: cursor})
+		if err != nil || pages > 2 {
+			t.Fatalf("ListEvents: page %d: %v", pages, err)
+		}
+		listed = append(listed, page...)
+	}
+	if len(listed) != 2 || listed[0].ID != holiday.ID || listed[1].ID != review.ID {
+		t.Errorf("listed %+v", listed)
+	}
+
+	if results, err := c.Search(ctx, client.SearchOptions{Text: "REVIEW", Tags: []string{"work"}}); err != nil ||
+		len(results) != 1 || results[0].Event.ID != review.ID || results[0].Score <= 0 {
+		t.Errorf("Search = %+v, %v", results, err)
+	}
+
+	slots, err := c.FreeSlots(ctx, client.FreeSlotsQuery{UserIDs: []int{2, 3}, From: day.AddDate(0, 0, 2), To: day.AddDate(0, 0, 3), Duration: time.Hour})
+	if err != nil || len(slots) != 1 || !slots[0].Start.Equal(day.AddDate(0, 0, 2).Add(9*time.Hour)) {
+		t.Errorf("FreeSlots = %+v, %v", slots, err)
+	}
+
+	batch := []client.BatchOp{
+		{Op: client.BatchCreate, Event: client.Event{Title: "batched", UserID: 1, Date: day.AddDate(0, 0, 3)}},
+		{Op: client.BatchDelete, ID: 99},
+	}
+	if results, err := c.Batch(ctx, batch, true); err != nil || len(results) != 2 || results[0].Status != 424 || results[1].Status != 404 {
+		t.Errorf("atomic Batch = %+v, %v", results, err)
+	}
+	if results, err := c.Batch(ctx, batch, false); err != nil || results[0].Status != 201 || results[0].Event.Title != "batched" {
+		t.Errorf("best effort Batch = %+v, %v", results, err)
+	}
+
+	if err := c.DeleteEvent(ctx, review.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := c.DeletedEvents(ctx); err != nil || len(deleted) != 1 {
+		t.Errorf("DeletedEvents = %+v, %v", deleted, err)
+	}
+	history, err := c.History(ctx, review.ID)
+	if err != nil || len(history) != 6 || history[5].Op != "delete" || history[5].Before == nil {
+		t.Fatalf("History = %+v, %v", history, err)
+	}
+	if restored, err := c.RestoreEvent(ctx, review.ID, 1); err != nil || restored.Title != "review" || restored.Version != 7 {
+		t.Errorf("RestoreEvent = %+v, %v", restored, err)
+	}
+}
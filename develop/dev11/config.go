@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "DEV11_"
+
+// Config is the server configuration. Every setting is a flag; a setting
+// not given on the command line is taken from the DEV11_<NAME> environment
+// variable, then from the config file, and otherwise keeps its default.
+// The file is YAML, or JSON when its name ends in .json, and uses the flag
+// names as keys, e.g.
+//
+//	addr: ":8080"
+//	write-timeout: 30s
+//	store: file
+type Config struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	LogLevel          slog.Level
+	Limits            requestLimits
+
+	Store            string
+	DataDir          string
+	SnapshotInterval time.Duration
+	WeekStart        time.Weekday
+	UsersPath        string
+	HistoryRetention time.Duration
+
+	ReminderInterval time.Duration
+	ReminderChannel  string
+	WebhookURL       string
+	SMTPAddr         string
+	SMTPFrom         string
+	SMTPUser         string
+	SMTPPassword     string
+}
+
+// loadConfig builds the configuration from the command-line arguments,
+// the environment looked up with getenv and the config file they name.
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+	cfg := &Config{}
+	fs := flag.NewFlagSet("dev11", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML or JSON config file")
+	fs.StringVar(&cfg.Addr, "addr", ":8080", "address to listen on")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 15*time.Second, "maximum duration for reading a request, including the body")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "maximum duration for reading request headers")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "maximum duration for writing a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is kept open")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 20*time.Second, "how long in-flight requests are waited for on shutdown")
+	logLevel := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	rate := fs.String("rate-limit", "20/s:40", "requests per client and route, as COUNT/s|m|h[:BURST], or off")
+	routeRates := fs.String("route-rate-limits", "POST /create_event=2/s:10,POST /import=10/m:2,POST /batch=10/m:2",
+		"limits of single routes, as [METHOD ]ROUTE=LIMIT,...")
+	authFailures := fs.String("auth-failure-limit", "10/m:20", "requests failing authentication per client address, or off")
+	fs.BoolVar(&cfg.Limits.TrustForwardedFor, "trust-forwarded-for", false, "tell anonymous clients apart by X-Forwarded-For; only behind a proxy")
+	bodySize := fs.String("body-limit", "1MB", "maximum size of a request body, or off")
+	routeBodySizes := fs.String("route-body-limits", "/import=10MB,/batch=10MB", "body limits of single routes, as [METHOD ]ROUTE=SIZE,...")
+	fs.StringVar(&cfg.Store, "store", "memory", "event store: memory or file")
+	fs.StringVar(&cfg.DataDir, "data", "data", "directory for the file store")
+	fs.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", 5*time.Minute, "how often the file store compacts its journal")
+	weekStart := fs.String("week-start", "monday", "first day of the week for weekly queries")
+	fs.StringVar(&cfg.UsersPath, "users", "", "users file; enables token authentication")
+	fs.DurationVar(&cfg.HistoryRetention, "history-retention", 30*24*time.Hour, "how long deleted events are kept for restoring; 0 keeps them forever")
+	fs.DurationVar(&cfg.ReminderInterval, "reminder-interval", 30*time.Second, "how often due reminders are looked for")
+	fs.StringVar(&cfg.ReminderChannel, "reminder-channel", "log", "channel of reminders that do not name one")
+	fs.StringVar(&cfg.WebhookURL, "webhook-url", "", "default URL for webhook reminders")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", "", "SMTP server host:port for email reminders")
+	fs.StringVar(&cfg.SMTPFrom, "smtp-from", "", "sender address of email reminders")
+	fs.StringVar(&cfg.SMTPUser, "smtp-user", "", "SMTP user name")
+	fs.StringVar(&cfg.SMTPPassword, "smtp-password", "", "SMTP password")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["config"] {
+		*configPath = getenv(envPrefix + "CONFIG")
+	}
+
+	values := make(map[string]string)
+	if *configPath != "" {
+		fileValues, err := readConfigFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileValues {
+			if fs.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("%s: unknown setting %q", *configPath, name)
+			}
+			values[name] = value
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if value := getenv(envName(f.Name)); value != "" {
+			values[f.Name] = value
+		}
+	})
+	for name, value := range values {
+		if explicit[name] || name == "config" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+	}
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", *logLevel)
+	}
+	if err := parseLimits(&cfg.Limits, *rate, *routeRates, *authFailures, *bodySize, *routeBodySizes); err != nil {
+		return nil, err
+	}
+	firstDay, err := parseWeekday(*weekStart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid week start: %v", err)
+	}
+	cfg.WeekStart = firstDay
+	for name, d := range map[string]time.Duration{
+		"read-timeout":        cfg.ReadTimeout,
+		"read-header-timeout": cfg.ReadHeaderTimeout,
+		"write-timeout":       cfg.WriteTimeout,
+		"idle-timeout":        cfg.IdleTimeout,
+		"shutdown-timeout":    cfg.ShutdownTimeout,
+		"history-retention":   cfg.HistoryRetention,
+	} {
+		if d < 0 {
+			return nil, fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return cfg, nil
+}
+
+func parseLimits(limits *requestLimits, rate, routeRates, authFailures, bodySize, routeBodySizes string) error {
+	var err error
+	if limits.Rate, err = parseRateLimit(rate); err != nil {
+		return err
+	}
+	if limits.AuthFailureRate, err = parseRateLimit(authFailures); err != nil {
+		return fmt.Errorf("invalid auth failure limit: %v", err)
+	}
+	if limits.BodySize, err = parseSize(bodySize); err != nil {
+		return fmt.Errorf("invalid body limit: %v", err)
+	}
+
+	settings, err := parseRouteSettings(routeRates)
+	if err != nil {
+		return err
+	}
+	limits.RouteRates = make(map[string]rateLimit, len(settings))
+	for route, value := range settings {
+		if limits.RouteRates[route], err = parseRateLimit(value); err != nil {
+			return fmt.Errorf("%s: %v", route, err)
+		}
+	}
+	if settings, err = parseRouteSettings(routeBodySizes); err != nil {
+		return err
+	}
+	limits.RouteBodySizes = make(map[string]int64, len(settings))
+	for route, value := range settings {
+		if limits.RouteBodySizes[route], err = parseSize(value); err != nil {
+			return fmt.Errorf("%s: invalid body limit: %v", route, err)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable of a flag: read-timeout is
+// DEV11_READ_TIMEOUT.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile returns the settings of a config file as flag values.
+// Keys may use underscores instead of dashes.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string]string, len(raw))
+	for _, name := range names {
+		switch value := raw[name].(type) {
+		case string:
+			values[strings.ReplaceAll(name, "_", "-")] = value
+		case bool, int, int64, float64:
+			values[strings.ReplaceAll(name, "_", "-")] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("%s: setting %q must be a string, number or boolean", path, name)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "dev11.yaml")
+	if err := os.WriteFile(yamlPath, []byte("addr: \":9000\"\nwrite_timeout: 1m\nlog-level: debug\nstore: file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "dev11.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"addr": ":9100", "idle-timeout": "5s"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	badPath := filepath.Join(dir, "bad.yaml")
+	if err := os.WriteFile(badPath, []byte("listen: \":9000\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(cfg *Config) bool
+		fails bool
+	}{
+		{"defaults", nil, nil,
+			func(cfg *Config) bool {
+				return cfg.Addr == ":8080" && cfg.Store == "memory" && cfg.LogLevel == slog.LevelInfo
+			}, false},
+		{"file", []string{"-config", yamlPath}, nil,
+			func(cfg *Config) bool {
+				return cfg.Addr == ":9000" && cfg.WriteTimeout == time.Minute && cfg.LogLevel == slog.LevelDebug && cfg.Store == "file"
+			}, false},
+		{"json file from env", nil, map[string]string{"DEV11_CONFIG": jsonPath},
+			func(cfg *Config) bool { return cfg.Addr == ":9100" && cfg.IdleTimeout == 5*time.Second }, false},
+		{"env overrides file", []string{"-config", yamlPath}, map[string]string{"DEV11_ADDR": ":9200", "DEV11_WRITE_TIMEOUT": "2s"},
+			func(cfg *Config) bool {
+				return cfg.Addr == ":9200" && cfg.WriteTimeout == 2*time.Second && cfg.Store == "file"
+			}, false},
+		{"flag overrides env", []string{"-config", yamlPath, "-addr", ":9300"}, map[string]string{"DEV11_ADDR": ":9200"},
+			func(cfg *Config) bool { return cfg.Addr == ":9300" }, false},
+		{"limits", nil, map[string]string{"DEV11_ROUTE_RATE_LIMITS": "/import=6/m", "DEV11_BODY_LIMIT": "2MB"},
+			func(cfg *Config) bool {
+				return cfg.Limits.Rate == rateLimit{Rate: 20, Burst: 40} && cfg.Limits.BodySize == 2<<20 &&
+					len(cfg.Limits.RouteRates) == 1 && cfg.Limits.RouteRates["/import"] == rateLimit{Rate: 0.1, Burst: 6} &&
+					cfg.Limits.AuthFailureRate == rateLimit{Rate: 10.0 / 60, Burst: 20}
+			}, false},
+		{"auth failures unlimited", []string{"-auth-failure-limit", "off"}, nil,
+			func(cfg *Config) bool { return cfg.Limits.AuthFailureRate == rateLimit{} }, false},
+		{"invalid rate limit", []string{"-rate-limit", "fast"}, nil, nil, true},
+		{"invalid auth failure limit", []string{"-auth-failure-limit", "many"}, nil, nil, true},
+		{"invalid route body limit", []string{"-route-body-limits", "/import"}, nil, nil, true},
+		{"unknown setting", []string{"-config", badPath}, nil, nil, true},
+		{"invalid env value", nil, map[string]string{"DEV11_READ_TIMEOUT": "soon"}, nil, true},
+		{"invalid log level", []string{"-log-level", "loud"}, nil, nil, true},
+		{"negative timeout", []string{"-idle-timeout", "-1s"}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadConfig(tt.args, func(key string) string { return tt.env[key] })
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("%s: unexpected config %+v", tt.name, *cfg)
+		}
+	}
+}
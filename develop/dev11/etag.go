@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the entity tag of an event, which is its quoted version.
+func etag(event Event) string {
+	return `"` + strconv.Itoa(event.Version) + `"`
+}
+
+func setETag(w http.ResponseWriter, event Event) {
+	w.Header().Set("ETag", etag(event))
+}
+
+// ifMatch returns the version the change of event id is conditional on,
+// taken from the If-Match header or, for clients that cannot send headers,
+// the version parameter; an event sent back as it was read carries its
+// version as well. Zero means the change is unconditional, and so
+// does "*", as the event has to exist anyway. When If-Match lists several
+// ETags the one of the stored event is returned if it is among them; weak
+// ETags never match.
+func ifMatch(r *http.Request, id int) (int, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		versionStr := r.FormValue("version")
+		if versionStr == "" {
+			return 0, nil
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return 0, invalidField("version", "invalid version")
+		}
+		return version, nil
+	}
+
+	var versions []int
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return 0, nil
+		}
+		unquoted, err := strconv.Unquote(tag)
+		if err != nil || !strings.HasPrefix(tag, `"`) {
+			continue
+		}
+		if version, err := strconv.Atoi(unquoted); err == nil && version > 0 {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 1 {
+		return versions[0], nil
+	}
+	current, err := calendar.GetEvent(id)
+	if err != nil {
+		return 0, err
+	}
+	for _, version := range versions {
+		if version == current.Version {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("event with id %d at version %d: %w", id, current.Version, errStaleVersion)
+}
+
+// notModified reports whether the If-None-Match header of a request
+// matches the event, using the weak comparison.
+func notModified(r *http.Request, event Event) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag(event) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	created := do(http.MethodPost, "/api/v1/events", `{"title":"a","user_id":1,"date":"2024-05-06T10:00:00Z"}`)
+	if created.Code != http.StatusCreated || created.Header().Get("ETag") != `"1"` {
+		t.Fatalf("create: status %d, ETag %q", created.Code, created.Header().Get("ETag"))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header []string
+		status int
+		etag   string
+	}{
+		{"get", http.MethodGet, "/api/v1/events/1", "", nil, http.StatusOK, `"1"`},
+		{"get unchanged", http.MethodGet, "/api/v1/events/1", "", []string{"If-None-Match", `W/"1"`}, http.StatusNotModified, `"1"`},
+		{"get changed", http.MethodGet, "/api/v1/events/1", "", []string{"If-None-Match", `"7"`}, http.StatusOK, `"1"`},
+		{"matching update", http.MethodPatch, "/api/v1/events/1", `{"title":"b"}`, []string{"If-Match", `"1"`}, http.StatusOK, `"2"`},
+		{"lost update", http.MethodPatch, "/api/v1/events/1", `{"title":"c"}`, []string{"If-Match", `"1"`}, http.StatusPreconditionFailed, ""},
+		{"weak If-Match", http.MethodPatch, "/api/v1/events/1", `{"title":"c"}`, []string{"If-Match", `W/"2"`}, http.StatusPreconditionFailed, ""},
+		{"one of several", http.MethodPatch, "/api/v1/events/1", `{"title":"c"}`, []string{"If-Match", `"1", "2"`}, http.StatusOK, `"3"`},
+		{"any version", http.MethodPatch, "/api/v1/events/1", `{"title":"d"}`, []string{"If-Match", "*"}, http.StatusOK, `"4"`},
+		{"stale version in the body", http.MethodPut, "/api/v1/events/1",
+			`{"title":"e","user_id":1,"date":"2024-05-06T10:00:00Z","version":3}`, nil, http.StatusPreconditionFailed, ""},
+		{"legacy stale update", http.MethodPost, "/update_event",
+			`{"id":1,"title":"e","user_id":1,"date":"2024-05-06T10:00:00Z","version":2}`, nil, http.StatusPreconditionFailed, ""},
+		{"legacy update", http.MethodPost, "/update_event",
+			`{"id":1,"title":"e","user_id":1,"date":"2024-05-06T10:00:00Z","version":4}`, nil, http.StatusOK, `"5"`},
+		{"stale delete", http.MethodDelete, "/api/v1/events/1", "", []string{"If-Match", `"4"`}, http.StatusPreconditionFailed, ""},
+		{"delete", http.MethodDelete, "/api/v1/events/1", "", []string{"If-Match", `"5"`}, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target, tt.body, tt.header...)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		if etag := rec.Header().Get("ETag"); etag != tt.etag {
+			t.Errorf("%s: ETag %q, expected %q", tt.name, etag, tt.etag)
+		}
+		if tt.status == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("%s: 304 with a body", tt.name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"time"
+)
+
+type Event struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UserID      int       `json:"user_id"`
+	Date        time.Time `json:"date"`
+
+	// End is exclusive. TimeZone is the IANA zone the event was scheduled
+	// in; Date and End are always stored in UTC. All-day events are
+	// floating: they cover their calendar dates in whatever zone they are
+	// looked at from.
+	End      time.Time `json:"end"`
+	TimeZone string    `json:"timezone,omitempty"`
+	AllDay   bool      `json:"all_day,omitempty"`
+
+	Reminders []Reminder `json:"reminders,omitempty"`
+
+	// UserID is the organizer of the event; Attendees are the users it
+	// invited.
+	Attendees []Attendee `json:"attendees,omitempty"`
+
+	// Tags categorise the event; they are lower-case and unique.
+	Tags []string `json:"tags,omitempty"`
+
+	// UID is the iCalendar UID a calendar client gave the event over
+	// CalDAV, or the file it was imported from; other events are exported
+	// under one derived from their ID.
+	// Detached occurrences share the UID of their series.
+	UID string `json:"uid,omitempty"`
+
+	// RRule and ExDates make the event the master of a recurring series.
+	RRule   string      `json:"rrule,omitempty"`
+	ExDates []time.Time `json:"exdates,omitempty"`
+
+	// A detached occurrence of a series, and every occurrence returned by
+	// the queries, refers back to the series and its original start.
+	SeriesID     int        `json:"series_id,omitempty"`
+	RecurrenceID *time.Time `json:"recurrence_id,omitempty"`
+
+	// Version is the version of the last change in the history of the
+	// event. It is set by the calendar and sent as the ETag of the event.
+	Version int `json:"version"`
+}
+
+// location returns the zone the event was scheduled in.
+func (e Event) location() *time.Location {
+	if e.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (e Event) duration() time.Duration {
+	if e.End.Before(e.Date) {
+		return 0
+	}
+	return e.End.Sub(e.Date)
+}
+
+// bounds returns the instants the event starts and ends at when looked at
+// from loc.
+func (e Event) bounds(loc *time.Location) (time.Time, time.Time) {
+	end := e.Date.Add(e.duration())
+	if e.AllDay {
+		return floatDate(e.Date, loc), floatDate(end, loc)
+	}
+	return e.Date, end
+}
+
+func floatDate(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// overlaps reports whether the event intersects the half-open range
+// [start, end). An event without duration belongs to the range its start
+// falls into.
+func (e Event) overlaps(start, end time.Time) bool {
+	from, to := e.bounds(start.Location())
+	if !to.After(from) {
+		return !from.Before(start) && from.Before(end)
+	}
+	return from.Before(end) && to.After(start)
+}
+
+// occurrences calls fn for the event, or for every occurrence of the
+// series, that overlaps [start, end). fn may return false to stop.
+func (e Event) occurrences(start, end time.Time, fn func(Event) bool) {
+	if e.RRule == "" {
+		if e.overlaps(start, end) {
+			fn(e)
+		}
+		return
+	}
+	rule, err := parseRRule(e.RRule)
+	if err != nil {
+		return
+	}
+
+	// Widen the window so that occurrences starting before it but still
+	// running into it are generated, as well as all-day occurrences whose
+	// UTC dates are shifted by the zone of the window.
+	from, to := start.Add(-e.duration()), end
+	dtstart := e.Date.In(e.location())
+	if e.AllDay {
+		from, to = from.Add(-14*time.Hour), to.Add(14*time.Hour)
+		dtstart = e.Date.UTC()
+	}
+	rule.expand(dtstart, e.ExDates, from, to, func(t time.Time) bool {
+		occurrence := e.occurrence(t.UTC())
+		if !occurrence.overlaps(start, end) {
+			return true
+		}
+		return fn(occurrence)
+	})
+}
+
+// occurrence returns a copy of the series master placed at the given start.
+func (e Event) occurrence(start time.Time) Event {
+	e.End = start.Add(e.duration())
+	e.Date = start
+	e.SeriesID = e.ID
+	e.RecurrenceID = &start
+	e.RRule = ""
+	e.ExDates = nil
+	return e
+}
+
+// hasOccurrence reports whether the series produces an occurrence at t.
+func (e Event) hasOccurrence(t time.Time) bool {
+	rule, err := parseRRule(e.RRule)
+	if err != nil {
+		return false
+	}
+	dtstart := e.Date.In(e.location())
+	if e.AllDay {
+		dtstart = e.Date.UTC()
+	}
+	found := false
+	rule.expand(dtstart, e.ExDates, t, t.Add(time.Nanosecond), func(time.Time) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// occursBetween reports whether the event, or any occurrence of the series,
+// overlaps the range.
+func (e Event) occursBetween(start, end time.Time) bool {
+	found := false
+	e.occurrences(start, end, func(Event) bool {
+		found = true
+		return false
+	})
+	return found
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// feedHistory is how many recent changes are kept for clients that
+	// resume after a reconnect.
+	feedHistory = 10000
+	// subscriberBuffer is how far a client may fall behind before it is
+	// disconnected; it then resumes from the history.
+	subscriberBuffer = 256
+
+	streamHeartbeat = 15 * time.Second
+)
+
+// Change is an entry of the change feed. Deleted events are sent as they
+// were before the deletion.
+type Change struct {
+	Seq   uint64    `json:"seq"`
+	Op    string    `json:"op"`
+	Event Event     `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// previous is the event before an update, so that users the update
+	// took it away from, such as an uninvited attendee, learn that it is
+	// gone.
+	previous *Event
+}
+
+func (ch Change) concerns(userID int) bool {
+	return userID == 0 || ch.Event.involves(userID) || (ch.previous != nil && ch.previous.involves(userID))
+}
+
+type subscription struct {
+	userID  int
+	changes chan Change
+}
+
+// changeFeed numbers the changes of a calendar and fans them out to the
+// subscribers. The sequence starts over when the server restarts.
+type changeFeed struct {
+	mu          sync.Mutex
+	seq         uint64
+	history     []Change
+	subscribers map[*subscription]bool
+	closed      bool
+	// held queues the changes published between hold and release.
+	held *[]Change
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subscribers: make(map[*subscription]bool)}
+}
+
+// publish records a change. A subscriber that cannot keep up is
+// disconnected instead of holding up the calendar.
+func (f *changeFeed) publish(op string, event Event, previous *Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	change := Change{Op: op, Event: event, Time: time.Now().UTC(), previous: previous}
+	if f.held != nil {
+		*f.held = append(*f.held, change)
+		return
+	}
+	f.send(change)
+}
+
+// hold queues the changes published from now on until release, which
+// sends them when keep is set and forgets them when the changes they
+// describe were undone.
+func (f *changeFeed) hold() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.held = &[]Change{}
+}
+
+func (f *changeFeed) release(keep bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	held := *f.held
+	f.held = nil
+	if keep {
+		for _, change := range held {
+			f.send(change)
+		}
+	}
+}
+
+// send numbers the change and fans it out. Must be called with f.mu held.
+func (f *changeFeed) send(change Change) {
+	f.seq++
+	change.Seq = f.seq
+	f.history = append(f.history, change)
+	if len(f.history) >= 2*feedHistory {
+		f.history = append([]Change(nil), f.history[len(f.history)-feedHistory:]...)
+	}
+
+	for sub := range f.subscribers {
+		if !change.concerns(sub.userID) {
+			continue
+		}
+		select {
+		case sub.changes <- change:
+		default:
+			delete(f.subscribers, sub)
+			close(sub.changes)
+		}
+	}
+}
+
+// subscribe returns the changes after the given sequence number that are
+// still in the history, and a subscription for the ones to come. It fails
+// when the history no longer reaches back to after, or when after is from
+// before a restart.
+func (f *changeFeed) subscribe(userID int, after uint64) ([]Change, *subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, nil, fmt.Errorf("change feed is closed")
+	}
+	if after > f.seq {
+		return nil, nil, fmt.Errorf("sequence number %d is unknown", after)
+	}
+	var backlog []Change
+	if after < f.seq {
+		first := f.seq - uint64(len(f.history)) + 1
+		if after+1 < first {
+			return nil, nil, fmt.Errorf("changes after %d are no longer available", after)
+		}
+		for _, change := range f.history[after+1-first:] {
+			if change.concerns(userID) {
+				backlog = append(backlog, change)
+			}
+		}
+	}
+
+	sub := &subscription{userID: userID, changes: make(chan Change, subscriberBuffer)}
+	f.subscribers[sub] = true
+	return backlog, sub, nil
+}
+
+func (f *changeFeed) unsubscribe(sub *subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subscribers[sub] {
+		delete(f.subscribers, sub)
+		close(sub.changes)
+	}
+}
+
+func (f *changeFeed) last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// close ends every subscription, so that streaming requests finish when
+// the server shuts down.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.changes)
+	}
+}
+
+// handleEventStream streams the changes of the calendar as server-sent
+// events:
+//
+//	id: 42
+//	event: update
+//	data: {"seq":42,"op":"update","event":{...},"time":"..."}
+//
+// A client that reconnects with Last-Event-ID (or the last_event_id
+// parameter) first gets the changes it missed. When those are no longer
+// known a reset event is sent instead, carrying the current sequence
+// number in its id, and the client should reload what it shows.
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	var userID int
+	if userIDStr := r.FormValue("user_id"); userIDStr != "" {
+		id, err := strconv.Atoi(userIDStr)
+		if err != nil || id <= 0 {
+			writeError(w, invalidField("user_id", "invalid user_id"))
+			return
+		}
+		userID = id
+	}
+	if caller, ok := callerFrom(r); ok && caller.Role != roleAdmin {
+		if userID != 0 && userID != caller.ID {
+			writeError(w, errForbidden)
+			return
+		}
+		userID = caller.ID
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.FormValue("last_event_id")
+	}
+	feed := calendar.feed
+	after := feed.last()
+	resume := lastID != ""
+	if resume {
+		seq, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			writeError(w, badRequest("invalid Last-Event-ID"))
+			return
+		}
+		after = seq
+	}
+	backlog, sub, err := feed.subscribe(userID, after)
+	reset := false
+	if err != nil && resume {
+		after = feed.last()
+		backlog, sub, err = feed.subscribe(userID, after)
+		reset = true
+	}
+	if err != nil {
+		writeError(w, &httpError{status: http.StatusServiceUnavailable, message: err.Error()})
+		return
+	}
+	defer feed.unsubscribe(sub)
+
+	// The stream outlives the server write timeout on purpose.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if reset {
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"seq\":%d}\n\n", after, after)
+	}
+	for _, change := range backlog {
+		if err := writeChange(w, change); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-sub.changes:
+			if !ok {
+				return
+			}
+			if err := writeChange(w, change); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeChange(w http.ResponseWriter, change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, data)
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE returns the id and event fields of the next n events of the
+// stream, skipping comments and the retry field.
+func readSSE(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var events []string
+	var id, event string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case line == "" && event != "":
+			events = append(events, id+" "+event)
+			id, event = "", ""
+		}
+	}
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	server := httptest.NewServer(newHandler(nil, newMetrics(), requestLimits{}))
+	defer server.Close()
+
+	open := func(query, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events/stream"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content type %q, expected text/event-stream", ct)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	all, allEvents := open("", "")
+	defer all.Body.Close()
+	mine, myEvents := open("?user_id=2", "")
+	defer mine.Body.Close()
+
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	first, err := calendar.CreateEvent(0, Event{Title: "a", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := calendar.CreateEvent(0, Event{Title: "b", UserID: 2, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.UserID = 2
+	if _, err := calendar.UpdateEvent(0, first.ID, first, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	if err := calendar.DeleteEvent(0, second.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, resumedEvents := open("", "2")
+	defer resumed.Body.Close()
+	reset, resetEvents := open("", "99")
+	defer reset.Body.Close()
+
+	tests := []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"all users", readSSE(t, allEvents, 4), []string{"1 create", "2 create", "3 update", "4 delete"}},
+		{"user 2", readSSE(t, myEvents, 3), []string{"2 create", "3 update", "4 delete"}},
+		{"resumed", readSSE(t, resumedEvents, 2), []string{"3 update", "4 delete"}},
+		{"unknown id", readSSE(t, resetEvents, 1), []string{"4 reset"}},
+	}
+	for _, tt := range tests {
+		if strings.Join(tt.got, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("%s: got %q, expected %q", tt.name, tt.got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// shuttingDown is set once the server has started to drain, so that load
+// balancers stop sending new requests before the listener goes away.
+var shuttingDown atomic.Bool
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleHealthz is the liveness probe: it only fails when the store is
+// broken for good, which a restart may fix.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := calendar.Ping(); err != nil && !shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReadyz is the readiness probe: it fails while the store is
+// unavailable and during shutdown.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "shutting down"})
+		return
+	}
+	if err := calendar.Ping(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	errNoVersion      = errors.New("no such version")
+	errDeletedVersion = errors.New("version is a deletion")
+)
+
+// Revision is an entry of the history of an event: the change made by the
+// user ActorID, with the event as it was before and after the change.
+// Before is missing for a creation and After for a deletion. Versions are
+// numbered from 1 for every event.
+type Revision struct {
+	EventID int       `json:"event_id"`
+	Version int       `json:"version"`
+	Op      string    `json:"op"`
+	ActorID int       `json:"actor_id,omitempty"`
+	Time    time.Time `json:"time"`
+	Before  *Event    `json:"before,omitempty"`
+	After   *Event    `json:"after,omitempty"`
+}
+
+// latest returns the last known state of the event, which for a deleted
+// event is the state it was deleted in.
+func (r Revision) latest() Event {
+	if r.After != nil {
+		return *r.After
+	}
+	return *r.Before
+}
+
+// record appends a revision to the history of the event. Must be called
+// with c.mu held.
+func (c *Calendar) record(actor int, op string, before, after *Event, at time.Time) error {
+	id := after
+	if id == nil {
+		id = before
+	}
+	revision := Revision{
+		EventID: id.ID,
+		Version: c.versions[id.ID] + 1,
+		Op:      op,
+		ActorID: actor,
+		Time:    at,
+		Before:  before,
+		After:   after,
+	}
+	c.saveUndo(id.ID)
+	if err := c.store.AddRevision(revision); err != nil {
+		return err
+	}
+	c.versions[id.ID] = revision.Version
+	if op == "delete" {
+		c.deleted[id.ID] = revision
+	} else {
+		delete(c.deleted, id.ID)
+	}
+	return nil
+}
+
+// History returns the revisions of a live or deleted event, oldest first.
+func (c *Calendar) History(id int) ([]Revision, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	history := c.store.History(id)
+	if len(history) == 0 {
+		if _, exists := c.store.Get(id); !exists {
+			return nil, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+		}
+	}
+	return history, nil
+}
+
+// DeletedEvents returns the deleted events that are still kept, ordered by
+// ID, as they were when they were deleted.
+func (c *Calendar) DeletedEvents() []Event {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	events := make([]Event, 0, len(c.deleted))
+	for _, revision := range c.deleted {
+		events = append(events, *revision.Before)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events
+}
+
+// RestoreEvent brings the event back to the state it had after the given
+// version, undeleting it if necessary. Restoring a deleted series also
+// restores the detached occurrences deleted together with it, and a series
+// restored to an earlier version keeps excluding the occurrences that are
+// detached now.
+func (c *Calendar) RestoreEvent(actor, id, version int) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := c.store.History(id)
+	if len(history) == 0 {
+		if _, exists := c.store.Get(id); !exists {
+			return Event{}, fmt.Errorf("event with id %d: %w", id, errEventNotFound)
+		}
+		return Event{}, fmt.Errorf("version %d of event %d: %w", version, id, errNoVersion)
+	}
+	if version < history[0].Version || version > history[len(history)-1].Version {
+		return Event{}, fmt.Errorf("version %d of event %d: %w", version, id, errNoVersion)
+	}
+	revision := history[version-history[0].Version]
+	if revision.After == nil {
+		return Event{}, fmt.Errorf("version %d of event %d: %w", version, id, errDeletedVersion)
+	}
+
+	event := *revision.After
+	if other, taken := c.index.byUID[event.UID]; taken && other != id {
+		return Event{}, fmt.Errorf("event with uid %q: %w", event.UID, errEventExists)
+	}
+	now := time.Now().UTC()
+	deletion, wasDeleted := c.deleted[id]
+	if event.RRule != "" && !wasDeleted {
+		for detached := range c.index.detached[id] {
+			if occurrence := c.index.indexed[detached]; occurrence.RecurrenceID != nil && !event.hasExDate(*occurrence.RecurrenceID) {
+				event.ExDates = append(append([]time.Time(nil), event.ExDates...), *occurrence.RecurrenceID)
+			}
+		}
+	}
+	event, err := c.put(actor, "restore", event, now)
+	if err != nil {
+		return Event{}, err
+	}
+
+	if event.RRule != "" && wasDeleted {
+		for _, revision := range c.deleted {
+			if revision.Before.SeriesID == id && revision.Time.Equal(deletion.Time) {
+				if _, err := c.put(actor, "restore", *revision.Before, now); err != nil {
+					return Event{}, err
+				}
+			}
+		}
+	}
+	return event, nil
+}
+
+// PurgeDeleted forgets for good the events deleted before the given time,
+// together with their history, and returns how many there were.
+func (c *Calendar) PurgeDeleted(before time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for id, revision := range c.deleted {
+		if !revision.Time.Before(before) {
+			continue
+		}
+		if err := c.store.DropHistory(id); err != nil {
+			return purged, err
+		}
+		delete(c.deleted, id)
+		delete(c.versions, id)
+		purged++
+	}
+	return purged, nil
+}
+
+// hasExDate reports whether the occurrence at t is excluded from the series.
+func (e Event) hasExDate(t time.Time) bool {
+	for _, exdate := range e.ExDates {
+		if exdate.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// latestState returns the current state of a live event, or the state a
+// deleted event was deleted in.
+func (c *Calendar) latestState(id int) (Event, error) {
+	history, err := c.History(id)
+	if err != nil {
+		return Event{}, err
+	}
+	if event, err := c.GetEvent(id); err == nil {
+		return event, nil
+	}
+	return history[len(history)-1].latest(), nil
+}
+
+// handleEventHistory lists the revisions of an event, which may have been
+// deleted:
+//
+//	GET /api/v1/events/{id}/history
+func handleEventHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, &httpError{status: http.StatusNotFound, message: "event not found"})
+		return
+	}
+	event, err := calendar.latestState(id)
+	if err == nil && !canView(r, event) {
+		err = errForbidden
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	history, err := calendar.History(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// handleRestoreEvent rolls an event back to the state it had after a
+// version of its history, undeleting it if necessary:
+//
+//	POST /api/v1/events/{id}/restore
+//	{"version": 3}
+//
+// The restore is itself recorded as a new version.
+func handleRestoreEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeError(w, &httpError{status: http.StatusNotFound, message: "event not found"})
+		return
+	}
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := strconv.Atoi(r.Form.Get("version"))
+	if err != nil || version <= 0 {
+		writeError(w, invalidField("version", "invalid version"))
+		return
+	}
+
+	// The caller must have access to the event both as it is and as it
+	// is restored to.
+	current, err := calendar.latestState(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	history, err := calendar.History(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	owner := 0
+	for _, revision := range history {
+		if revision.Version == version && revision.After != nil {
+			owner = revision.After.UserID
+		}
+	}
+	if !canAccess(r, current.UserID) || (owner != 0 && !canAccess(r, owner)) {
+		writeError(w, fmt.Errorf("event with id %d: %w", id, errForbidden))
+		return
+	}
+
+	restored, err := calendar.RestoreEvent(actorOf(r), id, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	warnConflicts(w, restored)
+	setETag(w, restored)
+	writeJSON(w, http.StatusOK, restored)
+}
+
+// handleDeletedEvents lists the deleted events that can still be restored.
+func handleDeletedEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, visibleEvents(r, calendar.DeletedEvents()))
+}
+
+// purgeDeletedLoop forgets the events deleted longer than retention ago,
+// once at start and then every interval, until ctx is done.
+func purgeDeletedLoop(ctx context.Context, c *Calendar, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := c.PurgeDeleted(time.Now().Add(-retention))
+		if err != nil {
+			slog.Error("Не удалось удалить устаревшую историю", "error", err)
+		} else if purged > 0 {
+			slog.Info("Удалены события с истёкшим сроком хранения", "count", purged)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
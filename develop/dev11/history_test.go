@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ops returns the operations of a history, e.g. "1 create, 2 update".
+func ops(history []Revision) string {
+	var s []string
+	for _, revision := range history {
+		s = append(s, strconv.Itoa(revision.Version)+" "+revision.Op)
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestEventHistory(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	event, err := c.CreateEvent(7, Event{Title: "draft", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Title = "final"
+	if _, err := c.UpdateEvent(8, event.ID, event, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteEvent(7, event.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := c.History(event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(history); got != "1 create, 2 update, 3 delete" {
+		t.Fatalf("history = %s", got)
+	}
+	update := history[1]
+	if update.ActorID != 8 || update.Before.Title != "draft" || update.After.Title != "final" {
+		t.Errorf("update revision = %+v", update)
+	}
+	if history[0].Before != nil || history[2].After != nil || history[2].Before.Title != "final" {
+		t.Errorf("create or delete revision has the wrong states")
+	}
+	if deleted := c.DeletedEvents(); len(deleted) != 1 || deleted[0].ID != event.ID {
+		t.Errorf("deleted events = %v", deleted)
+	}
+	if _, err := c.CreateEvent(0, Event{ID: event.ID, Title: "reuse", Date: date}, AllowConflicts); !errors.Is(err, errEventExists) {
+		t.Errorf("reusing the ID of a deleted event: error = %v", err)
+	}
+	if _, err := c.History(99); !errors.Is(err, errEventNotFound) {
+		t.Errorf("history of an unknown event: error = %v", err)
+	}
+}
+
+func TestRestoreEvent(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	event, err := c.CreateEvent(0, Event{Title: "v1", UserID: 1, Date: date}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Title = "v2"
+	if _, err := c.UpdateEvent(0, event.ID, event, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		version  int
+		expected string
+		err      error
+	}{
+		{"roll back", 1, "v1", nil},
+		{"undo the rollback", 2, "v2", nil},
+		{"unknown version", 9, "", errNoVersion},
+	}
+	for _, tt := range tests {
+		restored, err := c.RestoreEvent(0, event.ID, tt.version)
+		if !errors.Is(err, tt.err) || (err == nil && restored.Title != tt.expected) {
+			t.Errorf("%s: got %q, %v, expected %q, %v", tt.name, restored.Title, err, tt.expected, tt.err)
+		}
+	}
+
+	if err := c.DeleteEvent(0, event.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RestoreEvent(0, event.ID, 5); !errors.Is(err, errDeletedVersion) {
+		t.Errorf("restoring a deletion: error = %v", err)
+	}
+	if _, err := c.RestoreEvent(0, event.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetEvent(event.ID); err != nil || got.Title != "v1" {
+		t.Errorf("after undelete: got %q, %v", got.Title, err)
+	}
+	if len(c.DeletedEvents()) != 0 {
+		t.Errorf("restored event is still listed as deleted")
+	}
+}
+
+func TestRestoreSeries(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	series, err := c.CreateEvent(0, Event{Title: "standup", UserID: 1, Date: date, End: date.Add(15 * time.Minute), RRule: "FREQ=DAILY"}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := c.UpdateOccurrence(0, series.ID, date.AddDate(0, 0, 1), Event{Title: "moved", UserID: 1, Date: date.AddDate(0, 0, 1).Add(time.Hour)}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 of the series predates the detached occurrence, which must
+	// not show up twice.
+	restored, err := c.RestoreEvent(0, series.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.hasExDate(date.AddDate(0, 0, 1)) {
+		t.Errorf("restored series lost the exception of the detached occurrence")
+	}
+
+	if err := c.DeleteEvent(0, series.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetEvent(moved.ID); !errors.Is(err, errEventNotFound) {
+		t.Fatalf("detached occurrence survived the series: %v", err)
+	}
+	history, _ := c.History(series.ID)
+	if _, err := c.RestoreEvent(0, series.ID, history[len(history)-2].Version); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetEvent(moved.ID); err != nil || got.Title != "moved" {
+		t.Errorf("detached occurrence not restored with the series: %q, %v", got.Title, err)
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	kept, _ := c.CreateEvent(0, Event{Title: "kept", Date: date}, AllowConflicts)
+	gone, _ := c.CreateEvent(0, Event{Title: "gone", Date: date}, AllowConflicts)
+	if err := c.DeleteEvent(0, gone.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := c.PurgeDeleted(time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Errorf("purging before the deletion: %d, %v", purged, err)
+	}
+	if purged, err := c.PurgeDeleted(time.Now().Add(time.Hour)); err != nil || purged != 1 {
+		t.Errorf("purging after the deletion: %d, %v", purged, err)
+	}
+	if _, err := c.History(gone.ID); !errors.Is(err, errEventNotFound) {
+		t.Errorf("history of a purged event: error = %v", err)
+	}
+	if history, err := c.History(kept.ID); err != nil || len(history) != 1 {
+		t.Errorf("history of a live event: %v, %v", history, err)
+	}
+}
+
+func TestFileStoreHistory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	c := NewCalendar(store)
+	event, _ := c.CreateEvent(3, Event{Title: "persisted", Date: time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)}, AllowConflicts)
+	if err := c.DeleteEvent(3, event.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Half of the history goes into the snapshot, half stays in the
+	// journal, which is read back without closing the store.
+	store.mu.Lock()
+	err = store.snapshot()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RestoreEvent(3, event.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteEvent(3, event.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	c = NewCalendar(reopened)
+	history, err := c.History(event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(history); got != "1 create, 2 delete, 3 restore, 4 delete" {
+		t.Errorf("history after reopening = %s", got)
+	}
+	if deleted := c.DeletedEvents(); len(deleted) != 1 {
+		t.Errorf("deleted events after reopening = %v", deleted)
+	}
+	if created, _ := c.CreateEvent(0, Event{Title: "next", Date: time.Now()}, AllowConflicts); created.ID == event.ID {
+		t.Errorf("ID of a deleted event was reused")
+	}
+}
+
+func TestPurgedIDsNotReused(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCalendar(store)
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	c.CreateEvent(0, Event{Title: "kept", Date: date}, AllowConflicts)
+	gone, _ := c.CreateEvent(0, Event{Title: "gone", Date: date}, AllowConflicts)
+	if err := c.DeleteEvent(0, gone.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := c.PurgeDeleted(time.Now().Add(time.Hour)); err != nil || purged != 1 {
+		t.Fatalf("purge: %d, %v", purged, err)
+	}
+
+	// The highest ID is known from the journal first, then from the
+	// snapshot, which holds no trace of the purged event otherwise.
+	for _, snapshot := range []bool{false, true} {
+		if snapshot {
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			store.journal.Close()
+		}
+		if store, err = openFileStore(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+		c = NewCalendar(store)
+		created, err := c.CreateEvent(0, Event{Title: "new", Date: date}, AllowConflicts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.ID <= gone.ID {
+			t.Errorf("new event got ID %d after event %d was purged", created.ID, gone.ID)
+		}
+		if err := c.DeleteEvent(0, created.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+		c.PurgeDeleted(time.Now().Add(time.Hour))
+		gone = created
+	}
+	store.Close()
+}
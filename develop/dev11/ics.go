@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icsProdID     = "-//dev11//calendar//EN"
+	icsUIDDomain  = "@dev11"
+	icsTimeLayout = "20060102T150405Z"
+	// icsUserPrefix starts the calendar user address of a user in
+	// ORGANIZER and ATTENDEE, followed by the ID of the user.
+	icsUserPrefix = "urn:x-dev11:user:"
+)
+
+// writeICS serialises events into an RFC 5545 VCALENDAR. Recurring series
+// are written as masters with RRULE/EXDATE; detached occurrences share the
+// UID of their series and carry a RECURRENCE-ID. Attendees are written
+// with their replies in PARTSTAT, and together with the organizer under the
+// calendar user address of icsUserAddress. The X-DEV11-* properties
+// keep the fields that have no standard counterpart so an export can be
+// imported back unchanged.
+func writeICS(w io.Writer, events []Event) error {
+	bw := bufio.NewWriter(w)
+	stamp := time.Now().UTC().Format(icsTimeLayout)
+
+	writeICSLine(bw, "BEGIN:VCALENDAR")
+	writeICSLine(bw, "VERSION:2.0")
+	writeICSLine(bw, "PRODID:"+icsProdID)
+	writeICSLine(bw, "CALSCALE:GREGORIAN")
+	for _, event := range events {
+		writeICSLine(bw, "BEGIN:VEVENT")
+		writeICSLine(bw, "UID:"+event.uid())
+		if event.SeriesID != 0 && event.RecurrenceID != nil {
+			writeICSLine(bw, "RECURRENCE-ID"+formatICSTime(*event.RecurrenceID, event.AllDay))
+			writeICSLine(bw, "X-DEV11-EVENT-ID:"+strconv.Itoa(event.ID))
+		}
+		writeICSLine(bw, "DTSTAMP:"+stamp)
+		writeICSLine(bw, "DTSTART"+formatICSTime(event.Date, event.AllDay))
+		if event.End.After(event.Date) {
+			writeICSLine(bw, "DTEND"+formatICSTime(event.End, event.AllDay))
+		}
+		if event.TimeZone != "" {
+			writeICSLine(bw, "X-DEV11-TIMEZONE:"+event.TimeZone)
+		}
+		writeICSLine(bw, "SUMMARY:"+escapeICSText(event.Title))
+		if event.Description != "" {
+			writeICSLine(bw, "DESCRIPTION:"+escapeICSText(event.Description))
+		}
+		if len(event.Tags) > 0 {
+			tags := make([]string, len(event.Tags))
+			for i, tag := range event.Tags {
+				tags[i] = escapeICSText(tag)
+			}
+			writeICSLine(bw, "CATEGORIES:"+strings.Join(tags, ","))
+		}
+		if len(event.Attendees) > 0 {
+			writeICSLine(bw, "ORGANIZER:"+icsUserAddress(event.UserID))
+			for _, attendee := range event.Attendees {
+				writeICSLine(bw, "ATTENDEE;PARTSTAT="+strings.ToUpper(attendee.Status)+":"+icsUserAddress(attendee.UserID))
+			}
+		}
+		if event.RRule != "" {
+			writeICSLine(bw, "RRULE:"+strings.TrimPrefix(event.RRule, "RRULE:"))
+		}
+		if len(event.ExDates) > 0 {
+			exdates := make([]string, len(event.ExDates))
+			for i, exdate := range event.ExDates {
+				exdates[i] = formatICSValue(exdate, event.AllDay)
+			}
+			writeICSLine(bw, "EXDATE"+formatICSValueType(event.AllDay)+strings.Join(exdates, ","))
+		}
+		writeICSLine(bw, "X-DEV11-USER-ID:"+strconv.Itoa(event.UserID))
+		for _, reminder := range event.Reminders {
+			writeICSLine(bw, "BEGIN:VALARM")
+			writeICSLine(bw, "ACTION:DISPLAY")
+			writeICSLine(bw, "DESCRIPTION:"+escapeICSText(event.Title))
+			writeICSLine(bw, "TRIGGER:-"+formatICSDuration(time.Duration(reminder.Before)))
+			if reminder.Channel != "" {
+				writeICSLine(bw, "X-DEV11-CHANNEL:"+reminder.Channel)
+			}
+			if reminder.Target != "" {
+				writeICSLine(bw, "X-DEV11-TARGET:"+reminder.Target)
+			}
+			writeICSLine(bw, "END:VALARM")
+		}
+		writeICSLine(bw, "END:VEVENT")
+	}
+	writeICSLine(bw, "END:VCALENDAR")
+	return bw.Flush()
+}
+
+func icsUID(id int) string {
+	return strconv.Itoa(id) + icsUIDDomain
+}
+
+func icsUserAddress(userID int) string {
+	return icsUserPrefix + strconv.Itoa(userID)
+}
+
+// icsUserID maps a calendar user address written by writeICS back to the
+// user; other addresses map to zero.
+func icsUserID(address string) int {
+	if len(address) < len(icsUserPrefix) || !strings.EqualFold(address[:len(icsUserPrefix)], icsUserPrefix) {
+		return 0
+	}
+	id, err := strconv.Atoi(address[len(icsUserPrefix):])
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+// uid returns the UID the event is exported under: its own, or else one
+// derived from the ID of the event or, for a detached occurrence, of its
+// series.
+func (e Event) uid() string {
+	switch {
+	case e.UID != "":
+		return e.UID
+	case e.SeriesID != 0 && e.RecurrenceID != nil:
+		return icsUID(e.SeriesID)
+	}
+	return icsUID(e.ID)
+}
+
+const icsDateParam = ";VALUE=DATE:"
+
+// formatICSTime returns the parameters and value of a date property, i.e.
+// everything after the property name. Timed values are always written in
+// UTC; the zone of the event travels in X-DEV11-TIMEZONE.
+func formatICSTime(t time.Time, allDay bool) string {
+	return formatICSValueType(allDay) + formatICSValue(t, allDay)
+}
+
+func formatICSValueType(allDay bool) string {
+	if allDay {
+		return icsDateParam
+	}
+	return ":"
+}
+
+func formatICSValue(t time.Time, allDay bool) string {
+	if allDay {
+		return t.UTC().Format("20060102")
+	}
+	return t.UTC().Format(icsTimeLayout)
+}
+
+// writeICSLine terminates the line with CRLF and folds it so that no line
+// is longer than 75 octets, without splitting multi-byte characters.
+func writeICSLine(w *bufio.Writer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func escapeICSText(s string) string {
+	return icsEscaper.Replace(strings.ReplaceAll(s, "\r\n", "\n"))
+}
+
+// splitICSList splits a list of text values at the commas that are not
+// escaped.
+func splitICSList(s string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ',':
+			values = append(values, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(values, s[start:])
+}
+
+func unescapeICSText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// icsProperty is a single unfolded content line.
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsItem is the result of decoding one VEVENT.
+type icsItem struct {
+	UID   string
+	Event Event
+	Err   error
+}
+
+// parseICS decodes every VEVENT of a VCALENDAR. An error is returned only
+// when the stream itself is unreadable; problems with individual events are
+// reported through icsItem.Err so the rest can still be imported.
+// defaultUserID is used for events that do not carry X-DEV11-USER-ID.
+func parseICS(r io.Reader, defaultUserID int) ([]icsItem, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []icsItem
+	var props []icsProperty
+	inEvent := false
+	for _, line := range lines {
+		prop, err := parseICSProperty(line)
+		if err != nil {
+			if inEvent {
+				props = append(props, icsProperty{Name: "X-INVALID", Value: line})
+			}
+			continue
+		}
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT"):
+			inEvent = true
+			props = nil
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT"):
+			if inEvent {
+				items = append(items, decodeVEvent(props, defaultUserID))
+			}
+			inEvent = false
+		case inEvent:
+			props = append(props, prop)
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no VEVENT found")
+	}
+	return items, nil
+}
+
+func unfoldICS(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func parseICSProperty(line string) (icsProperty, error) {
+	prop := icsProperty{Params: make(map[string]string)}
+
+	// The value starts at the first colon that is not inside a quoted
+	// parameter value.
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("malformed line %q", line)
+	}
+	prop.Value = line[colon+1:]
+
+	parts := strings.Split(line[:colon], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+func decodeVEvent(props []icsProperty, defaultUserID int) icsItem {
+	var item icsItem
+	event := Event{UserID: defaultUserID}
+	hasStart := false
+	var duration time.Duration
+
+	fail := func(err error) icsItem {
+		item.Err = err
+		return item
+	}
+
+	// Properties of a nested VALARM only describe the reminder.
+	var alarm *Reminder
+	for _, prop := range props {
+		if prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VALARM") {
+			alarm = &Reminder{Before: -1}
+			continue
+		}
+		if alarm != nil {
+			switch prop.Name {
+			case "END":
+				if alarm.Before >= 0 {
+					event.Reminders = append(event.Reminders, *alarm)
+				}
+				alarm = nil
+			case "TRIGGER":
+				// Only triggers relative to the start and before it
+				// map to a reminder.
+				if before, ok := strings.CutPrefix(prop.Value, "-"); ok && prop.Params["RELATED"] != "END" {
+					d, err := parseICSDuration(before)
+					if err != nil {
+						return fail(fmt.Errorf("TRIGGER: %v", err))
+					}
+					alarm.Before = jsonDuration(d)
+				}
+			case "X-DEV11-CHANNEL":
+				alarm.Channel = prop.Value
+			case "X-DEV11-TARGET":
+				alarm.Target = prop.Value
+			}
+			continue
+		}
+
+		switch prop.Name {
+		case "UID":
+			item.UID = prop.Value
+		case "SUMMARY":
+			event.Title = unescapeICSText(prop.Value)
+		case "DESCRIPTION":
+			event.Description = unescapeICSText(prop.Value)
+		case "CATEGORIES":
+			for _, tag := range splitICSList(prop.Value) {
+				event.Tags = append(event.Tags, unescapeICSText(tag))
+			}
+		case "DTSTART":
+			start, err := parseICSPropertyTime(prop, prop.Value)
+			if err != nil {
+				return fail(fmt.Errorf("DTSTART: %v", err))
+			}
+			event.Date = start
+			event.AllDay = prop.Params["VALUE"] == "DATE"
+			if tzid := prop.Params["TZID"]; tzid != "" && event.TimeZone == "" {
+				event.TimeZone = tzid
+			}
+			hasStart = true
+		case "DTEND":
+			end, err := parseICSPropertyTime(prop, prop.Value)
+			if err != nil {
+				return fail(fmt.Errorf("DTEND: %v", err))
+			}
+			event.End = end
+		case "DURATION":
+			d, err := parseICSDuration(prop.Value)
+			if err != nil {
+				return fail(fmt.Errorf("DURATION: %v", err))
+			}
+			duration = d
+		case "X-DEV11-TIMEZONE":
+			if _, err := parseLocation(prop.Value); err != nil {
+				return fail(fmt.Errorf("X-DEV11-TIMEZONE: unknown zone %q", prop.Value))
+			}
+			event.TimeZone = prop.Value
+		case "RRULE":
+			if _, err := parseRRule(prop.Value); err != nil {
+				return fail(fmt.Errorf("RRULE: %v", err))
+			}
+			event.RRule = prop.Value
+		case "EXDATE":
+			for _, value := range strings.Split(prop.Value, ",") {
+				exdate, err := parseICSPropertyTime(prop, value)
+				if err != nil {
+					return fail(fmt.Errorf("EXDATE: %v", err))
+				}
+				event.ExDates = append(event.ExDates, exdate)
+			}
+		case "RECURRENCE-ID":
+			recurrenceID, err := parseICSPropertyTime(prop, prop.Value)
+			if err != nil {
+				return fail(fmt.Errorf("RECURRENCE-ID: %v", err))
+			}
+			event.RecurrenceID = &recurrenceID
+		case "ORGANIZER":
+			if userID := icsUserID(prop.Value); userID != 0 {
+				event.UserID = userID
+			}
+		case "ATTENDEE":
+			// Attendees that are not users of the calendar have no place
+			// in it.
+			userID := icsUserID(prop.Value)
+			if userID == 0 {
+				continue
+			}
+			status := strings.ToLower(prop.Params["PARTSTAT"])
+			if !validStatus(status) {
+				status = statusNeedsAction
+			}
+			event.Attendees = append(event.Attendees, Attendee{UserID: userID, Status: status})
+		case "X-DEV11-USER-ID":
+			userID, err := strconv.Atoi(prop.Value)
+			if err != nil {
+				return fail(fmt.Errorf("X-DEV11-USER-ID: invalid user id %q", prop.Value))
+			}
+			event.UserID = userID
+		case "X-DEV11-EVENT-ID":
+			id, err := strconv.Atoi(prop.Value)
+			if err != nil || id <= 0 {
+				return fail(fmt.Errorf("X-DEV11-EVENT-ID: invalid event id %q", prop.Value))
+			}
+			event.ID = id
+		case "X-INVALID":
+			return fail(fmt.Errorf("malformed line %q", prop.Value))
+		}
+	}
+
+	if !hasStart {
+		return fail(fmt.Errorf("DTSTART is required"))
+	}
+	if event.End.IsZero() {
+		switch {
+		case duration > 0:
+			event.End = event.Date.Add(duration)
+		case event.AllDay:
+			event.End = event.Date.AddDate(0, 0, 1)
+		default:
+			event.End = event.Date
+		}
+	}
+	if event.End.Before(event.Date) {
+		return fail(fmt.Errorf("DTEND is before DTSTART"))
+	}
+	if event.UserID == 0 {
+		return fail(fmt.Errorf("user id is unknown, pass user_id"))
+	}
+
+	// A UID of ours gives the event its ID back; any other is kept, so
+	// that the event is exported under it again and cannot be imported
+	// twice.
+	if id := icsEventID(item.UID); id == 0 {
+		event.UID = item.UID
+	} else if event.RecurrenceID == nil {
+		event.ID = id
+	}
+	item.Event = event
+	return item
+}
+
+// icsEventID maps a UID produced by writeICS back to the calendar ID.
+// Foreign UIDs map to zero, and the event is given a fresh ID.
+func icsEventID(uid string) int {
+	if !strings.HasSuffix(uid, icsUIDDomain) {
+		return 0
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(uid, icsUIDDomain))
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+type importResult struct {
+	Index int    `json:"index"`
+	UID   string `json:"uid,omitempty"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// importICS creates the decoded events in the calendar. Series masters are
+// created first so that detached occurrences can be linked to them by UID;
+// an occurrence overridden in the file is excluded from its series even if
+// the master does not list it in EXDATE. The events are recorded as
+// created by actor, with the replies of their attendees.
+func importICS(c *Calendar, actor int, items []icsItem) []importResult {
+	results := make([]importResult, len(items))
+
+	masters := make(map[string]int)
+	for i, item := range items {
+		if item.Err == nil && item.Event.RecurrenceID == nil && item.Event.RRule != "" {
+			masters[item.UID] = i
+		}
+	}
+	for _, item := range items {
+		if item.Err != nil || item.Event.RecurrenceID == nil {
+			continue
+		}
+		if i, ok := masters[item.UID]; ok {
+			master := &items[i].Event
+			if !containsTime(master.ExDates, *item.Event.RecurrenceID) {
+				master.ExDates = append(master.ExDates, *item.Event.RecurrenceID)
+			}
+		}
+	}
+
+	createdIDs := make(map[string]int)
+	for pass := 0; pass < 2; pass++ {
+		for i, item := range items {
+			detached := item.Event.RecurrenceID != nil
+			if item.Err != nil {
+				if pass == 0 {
+					results[i] = importResult{Index: i, UID: item.UID, Error: item.Err.Error()}
+				}
+				continue
+			}
+			if detached != (pass == 1) {
+				continue
+			}
+
+			event := item.Event
+			if detached {
+				event.SeriesID = icsEventID(item.UID)
+				if id, ok := createdIDs[item.UID]; ok {
+					event.SeriesID = id
+				}
+			}
+			if errs := validateEvent(event, nil); len(errs) > 0 {
+				results[i] = importResult{Index: i, UID: item.UID, Error: errs.Error()}
+				continue
+			}
+			created, err := c.ImportEvent(actor, event)
+			results[i] = importResult{Index: i, UID: item.UID, ID: created.ID}
+			if err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+			if !detached {
+				createdIDs[item.UID] = created.ID
+			}
+		}
+	}
+	return results
+}
+
+func parseICSPropertyTime(prop icsProperty, value string) (time.Time, error) {
+	if prop.Params["VALUE"] == "DATE" {
+		return parseICalTime(value)
+	}
+	if tzid := prop.Params["TZID"]; tzid != "" && !strings.HasSuffix(value, "Z") {
+		loc, err := parseLocation(tzid)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown TZID %q", tzid)
+		}
+		t, err := time.ParseInLocation("20060102T150405", value, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", value)
+		}
+		return t.UTC(), nil
+	}
+	return parseICalTime(value)
+}
+
+// formatICSDuration formats a non-negative duration as an RFC 5545
+// DURATION value.
+func formatICSDuration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	b.WriteString("P")
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+	if d > 0 {
+		b.WriteString("T")
+		if h := d / time.Hour; h > 0 {
+			fmt.Fprintf(&b, "%dH", h)
+			d -= h * time.Hour
+		}
+		if m := d / time.Minute; m > 0 {
+			fmt.Fprintf(&b, "%dM", m)
+			d -= m * time.Minute
+		}
+		if s := d / time.Second; s > 0 {
+			fmt.Fprintf(&b, "%dS", s)
+		}
+	}
+	return b.String()
+}
+
+// parseICSDuration parses the RFC 5545 DURATION value, e.g. PT1H30M or P1D.
+func parseICSDuration(s string) (time.Duration, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(s, "+"), "P")
+	if len(rest) == len(s) || rest == "" || strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	var total time.Duration
+	inTime := false
+	units := map[bool]map[byte]time.Duration{
+		false: {'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour},
+		true:  {'H': time.Hour, 'M': time.Minute, 'S': time.Second},
+	}
+	for rest != "" {
+		if rest[0] == 'T' {
+			inTime = true
+			rest = rest[1:]
+			continue
+		}
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		unit, ok := units[inTime][rest[i]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, _ := strconv.Atoi(rest[:i])
+		total += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	return total, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// exportImport writes the events of c as iCalendar and imports them into a
+// new calendar, which it returns with the exported text.
+func exportImport(t *testing.T, c *Calendar) (*Calendar, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeICS(&buf, c.Events()); err != nil {
+		t.Fatal(err)
+	}
+	items, err := parseICS(bytes.NewReader(buf.Bytes()), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := NewCalendar(newMemoryStore())
+	for _, result := range importICS(imported, 1, items) {
+		if result.Error != "" {
+			t.Fatalf("import of %s: %s", result.UID, result.Error)
+		}
+	}
+	return imported, buf.String()
+}
+
+func TestICSAttendees(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	event, err := c.CreateEvent(1, Event{
+		Title:     "Planning",
+		UserID:    1,
+		Date:      time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC),
+		Attendees: []Attendee{{UserID: 2}, {UserID: 3}},
+	}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RespondToEvent(2, event.ID, 2, statusAccepted); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, ics := exportImport(t, c)
+	for _, line := range []string{
+		"ORGANIZER:urn:x-dev11:user:1\r\n",
+		"ATTENDEE;PARTSTAT=ACCEPTED:urn:x-dev11:user:2\r\n",
+		"ATTENDEE;PARTSTAT=NEEDS-ACTION:urn:x-dev11:user:3\r\n",
+	} {
+		if !strings.Contains(ics, line) {
+			t.Errorf("export lacks %q:\n%s", line, ics)
+		}
+	}
+	expected := []Attendee{{UserID: 2, Status: statusAccepted}, {UserID: 3, Status: statusNeedsAction}}
+	if events := imported.Events(); len(events) != 1 || !reflect.DeepEqual(events[0].Attendees, expected) {
+		t.Errorf("imported attendees = %+v", events)
+	}
+
+	// Attendees that are not users, and unknown replies, are not kept.
+	items, err := parseICS(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:x\r\nDTSTART:20240506T100000Z\r\nSUMMARY:x\r\n"+
+		"ORGANIZER:mailto:boss@example.com\r\nATTENDEE;PARTSTAT=ACCEPTED:mailto:guest@example.com\r\n"+
+		"ATTENDEE;PARTSTAT=DELEGATED;CN=\"Bob: the builder\":URN:X-DEV11:USER:2\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := items[0].Event; event.UserID != 1 || !reflect.DeepEqual(event.Attendees, []Attendee{{UserID: 2, Status: statusNeedsAction}}) {
+		t.Errorf("foreign attendees decoded as user %d, %+v", event.UserID, event.Attendees)
+	}
+}
+
+func TestWriteICSLineFolding(t *testing.T) {
+	tests := []string{
+		"SUMMARY:short",
+		"SUMMARY:" + strings.Repeat("a", 67),
+		"SUMMARY:" + strings.Repeat("a", 68),
+		"DESCRIPTION:" + strings.Repeat("long text ", 30),
+		"SUMMARY:" + strings.Repeat("Ж", 100),
+		"SUMMARY:a" + strings.Repeat("€", 60),
+	}
+	for _, line := range tests {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeICSLine(w, line)
+		w.Flush()
+
+		physical := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+		for i, p := range physical {
+			if len(p) > 75 || !utf8.ValidString(p) || (i > 0) != strings.HasPrefix(p, " ") {
+				t.Errorf("line %d of %q folded as %q", i, line, p)
+			}
+		}
+		if unfolded, err := unfoldICS(&buf); err != nil || len(unfolded) != 1 || unfolded[0] != line {
+			t.Errorf("unfolding %q gave %q, %v", line, unfolded, err)
+		}
+	}
+}
+
+func TestICSTextEscaping(t *testing.T) {
+	tests := []struct {
+		text    string
+		escaped string
+	}{
+		{"plain", "plain"},
+		{"a, b; c", `a\, b\; c`},
+		{`C:\temp`, `C:\\temp`},
+		{"two\nlines", `two\nlines`},
+		{"crlf\r\nline", `crlf\nline`},
+	}
+	for _, tt := range tests {
+		escaped := escapeICSText(tt.text)
+		if escaped != tt.escaped {
+			t.Errorf("escapeICSText(%q) = %q, expected %q", tt.text, escaped, tt.escaped)
+		}
+		if text := unescapeICSText(escaped); text != strings.ReplaceAll(tt.text, "\r\n", "\n") {
+			t.Errorf("unescapeICSText(%q) = %q", escaped, text)
+		}
+	}
+	if got := unescapeICSText(`upper\Ncase`); got != "upper\ncase" {
+		t.Errorf(`unescaping \N gave %q`, got)
+	}
+	if got := splitICSList(`a\,b,c\\,d`); !reflect.DeepEqual(got, []string{`a\,b`, `c\\`, "d"}) {
+		t.Errorf("splitICSList = %q", got)
+	}
+}
+
+func TestParseICSPropertyTime(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected time.Time
+		err      bool
+	}{
+		{"DTSTART:20240506T100000Z", time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), false},
+		{"DTSTART:20240506T100000", time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), false},
+		{"DTSTART;TZID=Europe/Berlin:20240506T100000", time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC), false},
+		{"DTSTART;TZID=\"America/New_York\":20240110T090000", time.Date(2024, 1, 10, 14, 0, 0, 0, time.UTC), false},
+		{"DTSTART;TZID=Europe/Berlin:20240506T100000Z", time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), false},
+		{"DTSTART;VALUE=DATE:20240506", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), false},
+		{"DTSTART;TZID=Nowhere/City:20240506T100000", time.Time{}, true},
+		{"DTSTART;TZID=Local:20240506T100000", time.Time{}, true},
+		{"DTSTART;VALUE=DATE:2024-05-06", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		prop, err := parseICSProperty(tt.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseICSPropertyTime(prop, prop.Value)
+		if (err != nil) != tt.err || !got.Equal(tt.expected) {
+			t.Errorf("%s: %v, %v, expected %v", tt.line, got, err, tt.expected)
+		}
+	}
+}
+
+func TestICSRoundTrip(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	create := func(event Event) Event {
+		t.Helper()
+		event.UserID = 1
+		created, err := c.CreateEvent(1, event, AllowConflicts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+	create(Event{Title: "Imported", UID: "meeting@example.com",
+		Date: time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)})
+	create(Event{
+		Title:       "Review, part 2; final",
+		Description: "Agenda:\n- numbers\n- " + strings.Repeat("long line ", 10),
+		Date:        time.Date(2024, 5, 6, 8, 0, 0, 0, time.UTC),
+		End:         time.Date(2024, 5, 6, 9, 30, 0, 0, time.UTC),
+		TimeZone:    "Europe/Berlin",
+		Tags:        []string{"work", "q2"},
+		Reminders:   []Reminder{{Before: jsonDuration(15 * time.Minute), Channel: "log"}},
+	})
+	create(Event{Title: "Holiday", AllDay: true, Date: time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 11, 0, 0, 0, 0, time.UTC)})
+	series := create(Event{
+		Title:   "Standup",
+		Date:    time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC),
+		End:     time.Date(2024, 5, 6, 7, 15, 0, 0, time.UTC),
+		RRule:   "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=6",
+		ExDates: []time.Time{time.Date(2024, 5, 13, 7, 0, 0, 0, time.UTC)},
+	})
+	occurrence := time.Date(2024, 5, 8, 7, 0, 0, 0, time.UTC)
+	if _, err := c.UpdateOccurrence(1, series.ID, occurrence, Event{Title: "Late standup", UserID: 1,
+		Date: occurrence.Add(2 * time.Hour), End: occurrence.Add(2*time.Hour + 15*time.Minute)}, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, ics := exportImport(t, c)
+	for _, line := range []string{
+		"UID:meeting@example.com\r\n",
+		"SUMMARY:Review\\, part 2\\; final\r\n",
+		"DTSTART;VALUE=DATE:20240509\r\n",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=6\r\n",
+		"EXDATE:20240513T070000Z,20240508T070000Z\r\n",
+		"RECURRENCE-ID:20240508T070000Z\r\n",
+	} {
+		if !strings.Contains(ics, line) {
+			t.Errorf("export lacks %q:\n%s", line, ics)
+		}
+	}
+
+	// Apart from the versions, which start over, the events come back as
+	// they were.
+	unversioned := func(events []Event) []Event {
+		for i := range events {
+			events[i].Version = 0
+		}
+		return events
+	}
+	if got, expected := unversioned(imported.Events()), unversioned(c.Events()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("imported events:\n%+v\nexpected:\n%+v", got, expected)
+	}
+	if _, again := exportImport(t, imported); stripStamps(again) != stripStamps(ics) {
+		t.Errorf("second export differs:\n%s\nfirst:\n%s", again, ics)
+	}
+
+	// Importing the file again creates nothing.
+	items, err := parseICS(strings.NewReader(ics), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range importICS(imported, 1, items) {
+		if result.Error == "" {
+			t.Errorf("event %s imported twice as %d", result.UID, result.ID)
+		}
+	}
+	if n := len(imported.Events()); n != 5 {
+		t.Errorf("%d events after importing twice, expected 5", n)
+	}
+}
+
+// stripStamps removes the DTSTAMP lines, which change with every export.
+func stripStamps(ics string) string {
+	var lines []string
+	for _, line := range strings.Split(ics, "\r\n") {
+		if !strings.HasPrefix(line, "DTSTAMP:") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
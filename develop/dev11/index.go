@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allDaySlack is how far the start of a floating all-day event can move
+// away from its UTC date when it is looked at from another zone.
+const allDaySlack = 14 * time.Hour
+
+const skipListMaxLevel = 24
+
+// indexKey orders the entries of a skip list by start time and ID.
+type indexKey struct {
+	sec  int64
+	nsec int32
+	id   int
+}
+
+func keyOf(start time.Time, id int) indexKey {
+	return indexKey{sec: start.Unix(), nsec: int32(start.Nanosecond()), id: id}
+}
+
+func (k indexKey) less(other indexKey) bool {
+	if k.sec != other.sec {
+		return k.sec < other.sec
+	}
+	if k.nsec != other.nsec {
+		return k.nsec < other.nsec
+	}
+	return k.id < other.id
+}
+
+type skipNode struct {
+	key   indexKey
+	event Event
+	next  []*skipNode
+}
+
+// skipList is a sorted list of events with O(log n) insertion, removal and
+// seeking. It is not safe for concurrent use; Calendar guards it with its
+// own lock.
+type skipList struct {
+	head  skipNode
+	level int
+	len   int
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: skipNode{next: make([]*skipNode, skipListMaxLevel)}, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// path returns, for every level, the last node before key.
+func (l *skipList) path(key indexKey) [skipListMaxLevel]*skipNode {
+	var update [skipListMaxLevel]*skipNode
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key.less(key) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+func (l *skipList) insert(key indexKey, event Event) {
+	update := l.path(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		next.event = event
+		return
+	}
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+	node := &skipNode{key: key, event: event, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.len++
+}
+
+func (l *skipList) remove(key indexKey) {
+	update := l.path(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+// seek returns the first node at or after key.
+func (l *skipList) seek(key indexKey) *skipNode {
+	return l.path(key)[0].next[0]
+}
+
+// durationTiers splits the events of a timeline by duration. A range query
+// has to look back from the start of the range by the longest duration of
+// a tier, so keeping the rare long events apart stops them from widening
+// the scan over the short ones.
+var durationTiers = [...]time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 1<<63 - 1}
+
+func tierOf(event Event) int {
+	d := event.duration()
+	tier := 0
+	for d > durationTiers[tier] {
+		tier++
+	}
+	return tier
+}
+
+// timeline holds the events of the whole calendar or of one user. Single
+// events are ordered by start; recurring series cannot be placed on the
+// time line, so they are kept aside and expanded at query time.
+type timeline struct {
+	tiers [len(durationTiers)]*skipList
+	// reach is the longest an event of the tier may start before a range
+	// and still overlap it. It only grows, so removing a long event leaves
+	// scans a little wider than necessary until the next restart.
+	reach  [len(durationTiers)]time.Duration
+	series map[int]indexedSeries
+	len    int
+}
+
+// indexedSeries is a recurring series together with the instant its last
+// occurrence ends by, or zero when it recurs forever.
+type indexedSeries struct {
+	event Event
+	until time.Time
+}
+
+func newTimeline() *timeline {
+	return &timeline{series: make(map[int]indexedSeries)}
+}
+
+func (t *timeline) add(event Event) {
+	t.len++
+	if event.RRule != "" {
+		t.series[event.ID] = indexedSeries{event: event, until: seriesUntil(event)}
+		return
+	}
+	tier := tierOf(event)
+	reach := event.duration()
+	if event.AllDay {
+		reach += allDaySlack
+	}
+	if reach > t.reach[tier] {
+		t.reach[tier] = reach
+	}
+	if t.tiers[tier] == nil {
+		t.tiers[tier] = newSkipList()
+	}
+	t.tiers[tier].insert(keyOf(event.Date, event.ID), event)
+}
+
+func (t *timeline) remove(event Event) {
+	t.len--
+	if event.RRule != "" {
+		delete(t.series, event.ID)
+		return
+	}
+	if list := t.tiers[tierOf(event)]; list != nil {
+		list.remove(keyOf(event.Date, event.ID))
+	}
+}
+
+// seriesUntil returns an instant no occurrence of the series overlaps
+// after, or zero if there is none.
+func seriesUntil(event Event) time.Time {
+	rule, err := parseRRule(event.RRule)
+	if err != nil {
+		return event.Date
+	}
+	var last time.Time
+	switch {
+	case !rule.Until.IsZero():
+		last = rule.Until
+	case rule.Count > 0:
+		dtstart := event.Date.In(event.location())
+		if event.AllDay {
+			dtstart = event.Date.UTC()
+		}
+		rule.expand(dtstart, nil, dtstart, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), func(t time.Time) bool {
+			last = t
+			return true
+		})
+	default:
+		return time.Time{}
+	}
+	return last.Add(event.duration() + allDaySlack)
+}
+
+// eventIndex keeps the events of a calendar ordered by start time, overall
+// and per user, so that a range query only visits the events near the
+// range. The timeline of a user holds the events the user organises or
+// attends without having declined. The words of the events are indexed in
+// text for Search, and the events with a UID other than a detached
+// occurrence in byUID.
+type eventIndex struct {
+	all       *timeline
+	byUser    map[int]*timeline
+	byUID     map[string]int
+	detached  map[int]map[int]bool
+	indexed   map[int]Event
+	organized map[int]int
+	text      *textIndex
+	allDay    int
+}
+
+func newEventIndex() *eventIndex {
+	return &eventIndex{
+		all:       newTimeline(),
+		byUser:    make(map[int]*timeline),
+		byUID:     make(map[string]int),
+		detached:  make(map[int]map[int]bool),
+		indexed:   make(map[int]Event),
+		organized: make(map[int]int),
+		text:      newTextIndex(),
+	}
+}
+
+func (x *eventIndex) add(event Event) {
+	x.remove(event.ID)
+	x.indexed[event.ID] = event
+	if event.SeriesID != 0 {
+		if x.detached[event.SeriesID] == nil {
+			x.detached[event.SeriesID] = make(map[int]bool)
+		}
+		x.detached[event.SeriesID][event.ID] = true
+	} else if event.UID != "" {
+		x.byUID[event.UID] = event.ID
+	}
+	if event.AllDay {
+		x.allDay++
+	}
+	x.all.add(event)
+	x.text.add(event)
+	x.organized[event.UserID]++
+	for _, userID := range event.participants() {
+		user := x.byUser[userID]
+		if user == nil {
+			user = newTimeline()
+			x.byUser[userID] = user
+		}
+		user.add(event)
+	}
+}
+
+func (x *eventIndex) remove(id int) {
+	event, ok := x.indexed[id]
+	if !ok {
+		return
+	}
+	delete(x.indexed, id)
+	if event.SeriesID != 0 {
+		delete(x.detached[event.SeriesID], id)
+		if len(x.detached[event.SeriesID]) == 0 {
+			delete(x.detached, event.SeriesID)
+		}
+	} else if event.UID != "" {
+		delete(x.byUID, event.UID)
+	}
+	if event.AllDay {
+		x.allDay--
+	}
+	x.all.remove(event)
+	x.text.remove(event)
+	if x.organized[event.UserID]--; x.organized[event.UserID] == 0 {
+		delete(x.organized, event.UserID)
+	}
+	for _, userID := range event.participants() {
+		if user := x.byUser[userID]; user != nil {
+			user.remove(event)
+			if user.len == 0 {
+				delete(x.byUser, userID)
+			}
+		}
+	}
+}
+
+// EventQuery selects the events overlapping [Start, End), optionally of a
+// single user. Results are ordered by start and ID; After and Limit page
+// through them.
+type EventQuery struct {
+	Start  time.Time
+	End    time.Time
+	UserID int
+	After  eventCursor
+	Limit  int
+}
+
+// eventCursor is the position of the last event of a page.
+type eventCursor struct {
+	Start time.Time
+	ID    int
+}
+
+func cursorOf(event Event, loc *time.Location) eventCursor {
+	start, _ := event.bounds(loc)
+	return eventCursor{Start: start, ID: event.ID}
+}
+
+func (c eventCursor) isZero() bool {
+	return c.Start.IsZero() && c.ID == 0
+}
+
+func (c eventCursor) before(other eventCursor) bool {
+	if !c.Start.Equal(other.Start) {
+		return c.Start.Before(other.Start)
+	}
+	return c.ID < other.ID
+}
+
+func (c eventCursor) String() string {
+	raw := c.Start.UTC().Format(time.RFC3339Nano) + "/" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (eventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return eventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	startStr, idStr, found := strings.Cut(string(raw), "/")
+	if !found {
+		return eventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	start, err := time.Parse(time.RFC3339Nano, startStr)
+	if err != nil {
+		return eventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return eventCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return eventCursor{Start: start, ID: id}, nil
+}
+
+// resultPage collects the results of a query. With a limit it only keeps
+// the first Limit+1 of them in a max-heap, whose top tells the scans when
+// nothing they can still find would make it into the page.
+type resultPage struct {
+	limit   int
+	cursors []eventCursor
+	events  []Event
+}
+
+func (p *resultPage) full() bool {
+	return p.limit > 0 && len(p.events) > p.limit
+}
+
+// accepts reports whether a result at cursor would still be kept.
+func (p *resultPage) accepts(cursor eventCursor) bool {
+	return !p.full() || cursor.before(p.cursors[0])
+}
+
+func (p *resultPage) add(cursor eventCursor, event Event) {
+	if p.limit == 0 {
+		p.cursors = append(p.cursors, cursor)
+		p.events = append(p.events, event)
+		return
+	}
+	if !p.accepts(cursor) {
+		return
+	}
+	if p.full() {
+		p.cursors[0], p.events[0] = cursor, event
+		p.down(0)
+		return
+	}
+	p.cursors = append(p.cursors, cursor)
+	p.events = append(p.events, event)
+	for i := len(p.events) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if !p.cursors[parent].before(p.cursors[i]) {
+			break
+		}
+		p.swap(i, parent)
+		i = parent
+	}
+}
+
+func (p *resultPage) down(i int) {
+	for {
+		largest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(p.cursors) && p.cursors[largest].before(p.cursors[child]) {
+				largest = child
+			}
+		}
+		if largest == i {
+			return
+		}
+		p.swap(i, largest)
+		i = largest
+	}
+}
+
+func (p *resultPage) swap(i, j int) {
+	p.cursors[i], p.cursors[j] = p.cursors[j], p.cursors[i]
+	p.events[i], p.events[j] = p.events[j], p.events[i]
+}
+
+func (p *resultPage) Len() int           { return len(p.events) }
+func (p *resultPage) Less(i, j int) bool { return p.cursors[i].before(p.cursors[j]) }
+func (p *resultPage) Swap(i, j int)      { p.swap(i, j) }
+
+// query collects the events and occurrences matching q that come after
+// q.After. Scans stop as soon as they can no longer produce a result that
+// makes it into the page, so a page costs O(log n + k) plus the expansion
+// of the recurring series.
+func (x *eventIndex) query(q EventQuery, page *resultPage) {
+	t := x.all
+	if q.UserID != 0 {
+		if t = x.byUser[q.UserID]; t == nil {
+			return
+		}
+	}
+
+	loc := q.Start.Location()
+	start := q.Start
+	if !q.After.isZero() && q.After.Start.After(start) {
+		// Anything after the cursor that overlaps the range also overlaps
+		// the part of it from the cursor on.
+		start = q.After.Start.In(loc)
+	}
+	var slack time.Duration
+	if x.allDay > 0 {
+		slack = allDaySlack
+	}
+	visit := func(event Event) bool {
+		cursor := cursorOf(event, loc)
+		if !q.After.isZero() && !q.After.before(cursor) {
+			return true
+		}
+		if !page.accepts(cursor) {
+			return false
+		}
+		page.add(cursor, event)
+		return true
+	}
+
+	for _, series := range t.series {
+		if !series.until.IsZero() && series.until.Before(start) {
+			continue
+		}
+		if !series.event.Date.Before(q.End.Add(slack)) {
+			continue
+		}
+		series.event.occurrences(start, q.End, visit)
+	}
+
+	end := q.End.Add(slack)
+	for tier, list := range t.tiers {
+		if list == nil {
+			continue
+		}
+		for node := list.seek(keyOf(start.Add(-t.reach[tier]), 0)); node != nil; node = node.next[0] {
+			event := node.event
+			if !event.Date.Before(end) {
+				break
+			}
+			if page.full() && event.Date.Add(-slack).After(page.cursors[0].Start) {
+				break
+			}
+			if event.overlaps(start, q.End) {
+				visit(event)
+			}
+		}
+	}
+}
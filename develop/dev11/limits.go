@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Rate requests per second on average, in bursts of up to
+// Burst requests. A zero Rate means no limit.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var rateUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// parseRateLimit parses a limit such as 10/s, 100/m:20 or off. The burst
+// after the colon defaults to the number of requests per unit.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "off" || s == "0" {
+		return rateLimit{}, nil
+	}
+	spec, burstStr, hasBurst := strings.Cut(s, ":")
+	countStr, unit, _ := strings.Cut(spec, "/")
+	count, err := strconv.Atoi(countStr)
+	per, ok := rateUnits[unit]
+	if err != nil || count <= 0 || !ok {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	limit := rateLimit{Rate: float64(count) / per.Seconds(), Burst: count}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burstStr); err != nil || limit.Burst <= 0 {
+			return rateLimit{}, fmt.Errorf("invalid burst in rate limit %q", s)
+		}
+	}
+	return limit, nil
+}
+
+var sizeUnits = map[string]int64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+
+// parseSize parses a size such as 512KB or 10MB; 0 and off mean no limit.
+func parseSize(s string) (int64, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	digits := strings.TrimRightFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	n, err := strconv.ParseInt(digits, 10, 64)
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[len(digits):]))]
+	if err != nil || n < 0 || !ok || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// parseRouteSettings splits a list of per-route settings such as
+// "/import=10MB,POST /api/v1/events=20MB" into the value of every route.
+func parseRouteSettings(s string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		route, value, found := strings.Cut(item, "=")
+		route = strings.TrimSpace(route)
+		if !found || route == "" {
+			return nil, fmt.Errorf("invalid route setting %q", item)
+		}
+		settings[route] = strings.TrimSpace(value)
+	}
+	return settings, nil
+}
+
+// requestLimits are the limits put on the API requests. Routes are the
+// patterns of the API mux, optionally preceded by a method, as in
+// "POST /create_event"; a route without a limit of its own gets the
+// default one. The zero value limits nothing.
+type requestLimits struct {
+	Rate       rateLimit
+	RouteRates map[string]rateLimit
+	// AuthFailureRate limits the requests of a client address that fail
+	// authentication, which never get to the limits above.
+	AuthFailureRate rateLimit
+	// TrustForwardedFor identifies anonymous clients by the first address
+	// of X-Forwarded-For, which is only safe behind a proxy that sets it.
+	TrustForwardedFor bool
+
+	BodySize       int64
+	RouteBodySizes map[string]int64
+}
+
+// routeSetting looks up the setting of the route of r, preferring the one
+// given for its method.
+func routeSetting[T any](settings map[string]T, r *http.Request, route string) (string, T, bool) {
+	if value, ok := settings[r.Method+" "+route]; ok {
+		return r.Method + " " + route, value, true
+	}
+	value, ok := settings[route]
+	return route, value, ok
+}
+
+// tokenBucket holds the requests a client may still make under a limit.
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	route  string
+	client string
+}
+
+// bucketSweepInterval is how often the buckets that have refilled, and so
+// make no difference any more, are dropped.
+const bucketSweepInterval = time.Minute
+
+// rateLimiter keeps a token bucket for every client and route.
+type rateLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[bucketKey]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(now func() time.Time) *rateLimiter {
+	return &rateLimiter{now: now, buckets: make(map[bucketKey]*tokenBucket), swept: now()}
+}
+
+// take takes a token from the bucket of key and returns zero, or, when the
+// bucket is empty, how long it takes until the next token is available.
+func (l *rateLimiter) take(key bucketKey, limit rateLimit) time.Duration {
+	return l.use(key, limit, 1)
+}
+
+// wait returns how long it takes until the bucket of key has a token,
+// without taking it.
+func (l *rateLimiter) wait(key bucketKey, limit rateLimit) time.Duration {
+	return l.use(key, limit, 0)
+}
+
+// use takes n tokens from the bucket of key when it has one at least.
+func (l *rateLimiter) use(key bucketKey, limit rateLimit, n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= bucketSweepInterval {
+		for k, b := range l.buckets {
+			if b.refill(now) >= float64(b.limit.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b := l.buckets[key]
+	if b == nil || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	tokens := b.refill(now)
+	b.last = now
+	if tokens < 1 {
+		b.tokens = tokens
+		return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens = tokens - n
+	return 0
+}
+
+// refill returns the tokens in the bucket at now.
+func (b *tokenBucket) refill(now time.Time) float64 {
+	return math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+}
+
+// rateLimitMiddleware answers the requests of a client over its limit with
+// 429 and a Retry-After header. Clients are told apart by the
+// authenticated user or else by address, and routes with a limit of their
+// own have their own buckets, while all others share one.
+func (limits requestLimits) rateLimitMiddleware(limiter *rateLimiter, routeOf func(*http.Request) string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, limit, ok := routeSetting(limits.RouteRates, r, routeOf(r))
+			if !ok {
+				route, limit = "", limits.Rate
+			}
+			if limit.Rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if wait := limiter.take(bucketKey{route: route, client: limits.clientOf(r)}, limit); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authFailureMiddleware goes outside authentication and charges every
+// request answered with 401 to the address of the client. A client out of
+// tokens gets 429 before its credentials are even looked at, so that they
+// cannot be guessed at the rate of the API; requests that authenticate
+// cost nothing.
+func (limits requestLimits) authFailureMiddleware(limiter *rateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		if limits.AuthFailureRate.Rate <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := bucketKey{route: "auth failures", client: limits.clientOf(r)}
+			if wait := limiter.wait(key, limits.AuthFailureRate); wait > 0 {
+				tooManyRequests(w, wait)
+				return
+			}
+			rec := recordResponse(w)
+			next.ServeHTTP(rec, r)
+			if rec.Status() == http.StatusUnauthorized {
+				limiter.take(key, limits.AuthFailureRate)
+			}
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, &httpError{status: http.StatusTooManyRequests, message: "too many requests"})
+}
+
+func (limits requestLimits) clientOf(r *http.Request) string {
+	if caller, ok := callerFrom(r); ok {
+		return "user " + strconv.Itoa(caller.ID)
+	}
+	if limits.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return "addr " + strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr " + host
+}
+
+// bodyLimitMiddleware caps the size of request bodies. Bodies declared to
+// be too large are refused right away; the others fail with 413 once the
+// handler reads past the limit.
+func (limits requestLimits) bodyLimitMiddleware(routeOf func(*http.Request) string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, limit, ok := routeSetting(limits.RouteBodySizes, r, routeOf(r))
+			if !ok {
+				limit = limits.BodySize
+			}
+			if limit > 0 {
+				if r.ContentLength > limit {
+					writeError(w, bodyError(&http.MaxBytesError{Limit: limit}, ""))
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyError reports a request body that could not be read or parsed: with
+// 413 when it exceeds the body limit, and with 400 and message otherwise.
+func bodyError(err error, message string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &httpError{status: http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit)}
+	}
+	return badRequest(message)
+}
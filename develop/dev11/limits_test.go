@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	rates := []struct {
+		input    string
+		expected rateLimit
+		fails    bool
+	}{
+		{"10/s", rateLimit{Rate: 10, Burst: 10}, false},
+		{"120/m:5", rateLimit{Rate: 2, Burst: 5}, false},
+		{"off", rateLimit{}, false},
+		{"10", rateLimit{}, true},
+		{"10/d", rateLimit{}, true},
+		{"10/s:0", rateLimit{}, true},
+	}
+	for _, tt := range rates {
+		limit, err := parseRateLimit(tt.input)
+		if (err != nil) != tt.fails || limit != tt.expected {
+			t.Errorf("parseRateLimit(%q) = %+v, %v", tt.input, limit, err)
+		}
+	}
+
+	sizes := []struct {
+		input    string
+		expected int64
+		fails    bool
+	}{
+		{"512", 512, false},
+		{"64KB", 64 << 10, false},
+		{"10mb", 10 << 20, false},
+		{"off", 0, false},
+		{"1.5MB", 0, true},
+		{"10TB", 0, true},
+	}
+	for _, tt := range sizes {
+		size, err := parseSize(tt.input)
+		if (err != nil) != tt.fails || size != tt.expected {
+			t.Errorf("parseSize(%q) = %d, %v", tt.input, size, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(func() time.Time { return now })
+	limit := rateLimit{Rate: 2, Burst: 3}
+	key := bucketKey{client: "addr 10.0.0.1"}
+
+	for i := 0; i < 3; i++ {
+		if wait := limiter.take(key, limit); wait != 0 {
+			t.Fatalf("request %d of the burst: wait %v", i+1, wait)
+		}
+	}
+	if wait := limiter.take(key, limit); wait != 500*time.Millisecond {
+		t.Errorf("over the burst: wait %v, expected 500ms", wait)
+	}
+	if wait := limiter.take(bucketKey{client: "addr 10.0.0.2"}, limit); wait != 0 {
+		t.Errorf("other client: wait %v", wait)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if wait := limiter.take(key, limit); wait != 250*time.Millisecond {
+		t.Errorf("half a token later: wait %v, expected 250ms", wait)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if wait := limiter.take(key, limit); wait != 0 {
+		t.Errorf("a token later: wait %v", wait)
+	}
+
+	now = now.Add(time.Hour)
+	limiter.take(key, limit)
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets after the sweep, expected 1", len(limiter.buckets))
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{
+		Rate:           rateLimit{Rate: 1, Burst: 2},
+		RouteRates:     map[string]rateLimit{"POST /create_event": {Rate: 1.0 / 60, Burst: 1}},
+		BodySize:       64,
+		RouteBodySizes: map[string]int64{"/import": 1 << 20},
+	})
+	do := func(method, target, addr string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.RemoteAddr = addr + ":40000"
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	event := func() io.Reader {
+		return strings.NewReader("title=a&user_id=1&date=2024-05-06T10:00:00Z")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		addr       string
+		body       io.Reader
+		status     int
+		retryAfter string
+	}{
+		{"create", http.MethodPost, "/create_event", "10.0.0.1", event(), http.StatusOK, ""},
+		{"second create", http.MethodPost, "/create_event", "10.0.0.1", event(), http.StatusTooManyRequests, "60"},
+		{"create from elsewhere", http.MethodPost, "/create_event", "10.0.0.2", event(), http.StatusOK, ""},
+		{"shared bucket", http.MethodGet, "/api/v1/events/1", "10.0.0.1", nil, http.StatusOK, ""},
+		{"shared bucket", http.MethodGet, "/api/v1/events", "10.0.0.1", nil, http.StatusOK, ""},
+		{"shared bucket exhausted", http.MethodGet, "/api/v1/events", "10.0.0.1", nil, http.StatusTooManyRequests, "1"},
+		{"probes are not limited", http.MethodGet, "/healthz", "10.0.0.1", nil, http.StatusOK, ""},
+		{"declared body too large", http.MethodPost, "/update_event", "10.0.0.3",
+			strings.NewReader("title=" + strings.Repeat("a", 100)), http.StatusRequestEntityTooLarge, ""},
+		{"streamed body too large", http.MethodPost, "/update_event", "10.0.0.4",
+			io.MultiReader(strings.NewReader("title="), strings.NewReader(strings.Repeat("a", 100))), http.StatusRequestEntityTooLarge, ""},
+		{"larger limit of the route", http.MethodPost, "/import", "10.0.0.5",
+			strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nDTSTART:20240506T100000Z\r\n" +
+				"SUMMARY:" + strings.Repeat("a", 100) + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target, tt.addr, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After %q, expected %q", tt.name, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	users, err := loadUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.add("alice", roleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := users.issueToken(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newHandler(users, newMetrics(), requestLimits{AuthFailureRate: rateLimit{Rate: 1.0 / 60, Burst: 2}})
+	do := func(addr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events", nil)
+		req.RemoteAddr = addr + ":40000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name       string
+		addr       string
+		token      string
+		status     int
+		retryAfter string
+	}{
+		{"valid token", "10.0.0.1", token, http.StatusOK, ""},
+		{"first guess", "10.0.0.1", "dev11_guess1", http.StatusUnauthorized, ""},
+		{"no token", "10.0.0.1", "", http.StatusUnauthorized, ""},
+		{"third guess", "10.0.0.1", "dev11_guess3", http.StatusTooManyRequests, "60"},
+		{"even the right token", "10.0.0.1", token, http.StatusTooManyRequests, "60"},
+		{"other address", "10.0.0.2", "dev11_guess1", http.StatusUnauthorized, ""},
+		{"valid token elsewhere", "10.0.0.3", token, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		rec := do(tt.addr, tt.token)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After %q, expected %q", tt.name, got, tt.retryAfter)
+		}
+	}
+
+	// Requests that authenticate do not use up the allowance.
+	for i := 0; i < 5; i++ {
+		if rec := do("10.0.0.3", token); rec.Code != http.StatusOK {
+			t.Fatalf("request %d with a valid token: status %d", i+1, rec.Code)
+		}
+	}
+	if rec := do("10.0.0.3", "dev11_guess"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("first guess after valid requests: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestLabels struct {
+	route  string
+	method string
+	code   int
+}
+
+type routeLabels struct {
+	route  string
+	method string
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metrics collects request statistics and serves them, together with the
+// number of events of every user, in the Prometheus text format.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]uint64
+	latency  map[routeLabels]*histogram
+	inFlight int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestLabels]uint64),
+		latency:  make(map[routeLabels]*histogram),
+	}
+}
+
+// middleware records every request under the route it was matched to, as
+// returned by routeOf, so that path parameters do not blow up the number
+// of series.
+func (m *metrics) middleware(routeOf func(*http.Request) string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.mu.Lock()
+			m.inFlight++
+			m.mu.Unlock()
+
+			start := time.Now()
+			rec := recordResponse(w)
+			defer func() {
+				m.observe(routeOf(r), r.Method, rec.Status(), time.Since(start))
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+func (m *metrics) observe(route, method string, code int, d time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.requests[requestLabels{route: route, method: method, code: code}]++
+	h := m.latency[routeLabels{route: route, method: method}]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latency[routeLabels{route: route, method: method}] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w, calendar.EventCountsByUser())
+}
+
+func (m *metrics) write(w io.Writer, eventCounts map[int]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP dev11_http_requests_total Number of HTTP requests by route, method and status code.")
+	fmt.Fprintln(w, "# TYPE dev11_http_requests_total counter")
+	requests := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		requests = append(requests, labels)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, labels := range requests {
+		fmt.Fprintf(w, "dev11_http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n",
+			quoteLabel(labels.route), quoteLabel(labels.method), labels.code, m.requests[labels])
+	}
+
+	fmt.Fprintln(w, "# HELP dev11_http_request_duration_seconds Latency of HTTP requests by route and method.")
+	fmt.Fprintln(w, "# TYPE dev11_http_request_duration_seconds histogram")
+	routes := make([]routeLabels, 0, len(m.latency))
+	for labels := range m.latency {
+		routes = append(routes, labels)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, labels := range routes {
+		h := m.latency[labels]
+		prefix := fmt.Sprintf("route=%s,method=%s", quoteLabel(labels.route), quoteLabel(labels.method))
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "dev11_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "dev11_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", prefix, h.count)
+		fmt.Fprintf(w, "dev11_http_request_duration_seconds_sum{%s} %s\n", prefix, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "dev11_http_request_duration_seconds_count{%s} %d\n", prefix, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP dev11_http_requests_in_flight Number of HTTP requests being served.")
+	fmt.Fprintln(w, "# TYPE dev11_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "dev11_http_requests_in_flight %d\n", m.inFlight)
+
+	fmt.Fprintln(w, "# HELP dev11_events Number of stored events by user; a recurring series counts once.")
+	fmt.Fprintln(w, "# TYPE dev11_events gauge")
+	users := make([]int, 0, len(eventCounts))
+	for userID := range eventCounts {
+		users = append(users, userID)
+	}
+	sort.Ints(users)
+	for _, userID := range users {
+		fmt.Fprintf(w, "dev11_events{user_id=\"%d\"} %d\n", userID, eventCounts[userID])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	if _, err := calendar.CreateEvent(0, Event{Title: "a", UserID: 7}, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics()
+	handler := newHandler(nil, m, requestLimits{})
+
+	tests := []struct {
+		method    string
+		target    string
+		requestID string
+		status    int
+	}{
+		{http.MethodGet, "/api/v1/events/1", "abc-123", http.StatusOK},
+		{http.MethodGet, "/api/v1/events/2", "", http.StatusNotFound},
+		{http.MethodDelete, "/events", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/nowhere", "bad id with spaces", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.requestID != "" {
+			req.Header.Set("X-Request-ID", tt.requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, expected %d", tt.method, tt.target, rec.Code, tt.status)
+		}
+		id := rec.Header().Get("X-Request-ID")
+		if validRequestID(tt.requestID) && id != tt.requestID {
+			t.Errorf("%s %s: request id %q, expected %q", tt.method, tt.target, id, tt.requestID)
+		}
+		if !validRequestID(id) {
+			t.Errorf("%s %s: invalid request id %q", tt.method, tt.target, id)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`dev11_http_requests_total{route="/api/v1/events/{id}",method="GET",code="200"} 1`,
+		`dev11_http_requests_total{route="/api/v1/events/{id}",method="GET",code="404"} 1`,
+		`dev11_http_requests_total{route="/events",method="DELETE",code="405"} 1`,
+		`dev11_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`dev11_http_request_duration_seconds_count{route="/api/v1/events/{id}",method="GET"} 2`,
+		`dev11_http_request_duration_seconds_bucket{route="/events",method="DELETE",le="+Inf"} 1`,
+		`dev11_events{user_id="7"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiSpec is a decoded OpenAPI document. Its nodes are resolved with
+// resolve, which follows $ref.
+type apiSpec map[string]interface{}
+
+func loadSpec(t *testing.T, handler http.Handler) apiSpec {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: status %d", rec.Code)
+	}
+	var spec apiSpec
+	decoder := json.NewDecoder(rec.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&spec); err != nil {
+		t.Fatalf("GET /openapi.json: %v", err)
+	}
+	if spec["openapi"] != "3.0.3" {
+		t.Fatalf("openapi version %v", spec["openapi"])
+	}
+	return spec
+}
+
+func (s apiSpec) resolve(node interface{}) map[string]interface{} {
+	object, _ := node.(map[string]interface{})
+	for object != nil {
+		ref, ok := object["$ref"].(string)
+		if !ok {
+			break
+		}
+		var target interface{} = map[string]interface{}(s)
+		for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			target = target.(map[string]interface{})[key]
+		}
+		object, _ = target.(map[string]interface{})
+	}
+	return object
+}
+
+func (s apiSpec) paths() map[string]interface{} {
+	return s["paths"].(map[string]interface{})
+}
+
+// operation finds the path template matching the request path and its
+// operation for the method.
+func (s apiSpec) operation(method, path string) (string, map[string]interface{}) {
+	segments := strings.Split(path, "/")
+	for template, item := range s.paths() {
+		parts := strings.Split(template, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		match := true
+		for i, part := range parts {
+			if part != segments[i] && (!strings.HasPrefix(part, "{") || segments[i] == "") {
+				match = false
+			}
+		}
+		if match {
+			return template, s.operations(item)[strings.ToLower(method)]
+		}
+	}
+	return "", nil
+}
+
+// validate checks a decoded JSON value against the subset of JSON Schema
+// the document uses.
+func (s apiSpec) validate(node interface{}, value interface{}, at string) error {
+	schema := s.resolve(node)
+	if alternatives, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, alternative := range alternatives {
+			if s.validate(alternative, value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: %d alternatives of oneOf match %v", at, matches, value)
+		}
+		return nil
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || allowed == value
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", at, str)
+			}
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, value)
+		}
+	case "integer":
+		if number, ok := value.(json.Number); !ok || strings.ContainsAny(number.String(), ".eE") {
+			return fmt.Errorf("%s: %v is not an integer", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		for i, item := range items {
+			if err := s.validate(schema["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		for name, property := range object {
+			if _, ok := properties[name]; !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: undocumented property %s", at, name)
+				}
+				continue
+			}
+			if err := s.validate(properties[name], property, at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// operations returns the operations of a path item by method.
+func (s apiSpec) operations(item interface{}) map[string]map[string]interface{} {
+	operations := make(map[string]map[string]interface{})
+	for key, operation := range item.(map[string]interface{}) {
+		switch key {
+		case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+			operations[key] = s.resolve(operation)
+		}
+	}
+	return operations
+}
+
+// documentedMethods lists the methods of a path in the document, including
+// the WebDAV methods OpenAPI cannot describe, which x-methods lists.
+func (s apiSpec) documentedMethods(template string) []string {
+	var methods []string
+	for method := range s.operations(s.paths()[template]) {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	extra, _ := s.paths()[template].(map[string]interface{})["x-methods"].([]interface{})
+	for _, method := range extra {
+		methods = append(methods, method.(string))
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+var pathParam = regexp.MustCompile(`\{[a-z_]+\}`)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	spec := loadSpec(t, handler)
+
+	served := map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, "/openapi.json": true}
+	for _, route := range apiRoutes {
+		served[route.pattern] = true
+	}
+	for pattern := range served {
+		if _, ok := spec.paths()[pattern]; !ok {
+			t.Errorf("route %s is not documented", pattern)
+		}
+	}
+	for template := range spec.paths() {
+		if !served[template] {
+			t.Errorf("path %s is documented but not served", template)
+			continue
+		}
+
+		// An unsupported method is answered with the methods the route
+		// supports, which must be the documented ones.
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodTrace, pathParam.ReplaceAllString(template, "1"), nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("TRACE %s: status %d", template, rec.Code)
+			continue
+		}
+		allowed := strings.Split(rec.Header().Get("Allow"), ", ")
+		sort.Strings(allowed)
+		if documented := spec.documentedMethods(template); strings.Join(allowed, ",") != strings.Join(documented, ",") {
+			t.Errorf("%s: allows %v, documented %v", template, allowed, documented)
+		}
+	}
+}
+
+func TestOpenAPIConformance(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	spec := loadSpec(t, handler)
+
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a@example.com\r\nDTSTART:20240510T100000Z\r\nSUMMARY:imported\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	davICS := strings.ReplaceAll(ics, "a@example.com", "dav@example.com")
+	object := "/dav/calendars/1/events/dav@example.com.ics"
+	tests := []struct {
+		method string
+		target string
+		body   string
+		header []string
+		status int
+	}{
+		{"POST", "/create_event", `{"title":"a","user_id":1,"date":"2024-05-06T10:00:00Z","duration":"1h","timezone":"Europe/Berlin","reminders":["15m","1h/email/a@example.com"]}`, nil, 200},
+		{"POST", "/api/v1/events", `{"title":"standup","user_id":1,"date":"2024-05-06T08:00:00Z","end":"2024-05-06T08:15:00Z","rrule":"FREQ=DAILY;COUNT=5","attendees":[2],"tags":["Daily","team"]}`, nil, 201},
+		{"POST", "/api/v1/events?conflicts=reject", `{"title":"clash","user_id":1,"date":"2024-05-06T10:30:00Z"}`, nil, 409},
+		{"POST", "/api/v1/events", `{"title":"bad","user_id":1,"date":"tomorrow","attendees":"x"}`, nil, 422},
+		{"GET", "/api/v1/events/1", "", nil, 200},
+		{"GET", "/api/v1/events/1", "", []string{"If-None-Match", `"1"`}, 304},
+		{"HEAD", "/api/v1/events/1", "", nil, 200},
+		{"GET", "/api/v1/events/99", "", nil, 404},
+		{"PATCH", "/api/v1/events/1", `{"title":"b"}`, []string{"If-Match", `"1"`}, 200},
+		{"PATCH", "/api/v1/events/1", `{"title":"c"}`, []string{"If-Match", `"1"`}, 412},
+		{"PUT", "/api/v1/events/2?occurrence=2024-05-07T08:00:00Z", `{"title":"late standup","user_id":1,"date":"2024-05-07T10:30:00Z","duration":"15m"}`, nil, 200},
+		{"GET", "/api/v1/events", "", nil, 200},
+		{"GET", "/search?q=standup&tag=daily&from=2024-05-06&to=2024-05-13", "", nil, 200},
+		{"GET", "/search", "", nil, 422},
+		{"HEAD", "/api/v1/events", "", nil, 200},
+		{"GET", "/api/v1/events?from=2024-05-06&to=2024-05-13&limit=2", "", nil, 200},
+		{"GET", "/api/v1/events?from=x&to=y", "", nil, 400},
+		{"POST", "/api/v1/events/2/invite", `{"user_ids":[3]}`, nil, 200},
+		{"POST", "/api/v1/events/2/rsvp", `{"user_id":2,"status":"accepted"}`, nil, 200},
+		{"POST", "/api/v1/events/2/rsvp", `{"user_id":9,"status":"accepted"}`, nil, 403},
+		{"POST", "/update_event", `{"id":1,"title":"d","user_id":1,"date":"2024-05-06T10:00:00Z","duration":"1h"}`, nil, 200},
+		{"POST", "/update_event", `{"id":2,"occurrence":"2024-05-08T08:00:00Z","title":"e","user_id":1,"date":"2024-05-08T08:00:00Z"}`, nil, 200},
+		{"GET", "/events_for_day?date=2024-05-06", "", nil, 200},
+		{"GET", "/events_for_week?week=2024-W19&tz=Europe/Berlin", "", nil, 200},
+		{"GET", "/events_for_month?date=2024-05-01", "", nil, 200},
+		{"GET", "/events?from=2024-05-06&to=2024-05-08", "", nil, 200},
+		{"GET", "/free_slots?user_ids=1,2&from=2024-05-06&to=2024-05-08&duration=30m", "", nil, 200},
+		{"GET", "/free_slots?user_ids=1", "", nil, 422},
+		{"GET", "/export.ics?user_id=1", "", nil, 200},
+		{"POST", "/import?user_id=1", ics, []string{"Content-Type", "text/calendar"}, 200},
+		{"POST", "/batch?mode=best_effort", `[{"op":"create","title":"batched","user_id":1,"date":"2024-05-09T10:00:00Z"},{"op":"update","id":99,"title":"x","user_id":1,"date":"2024-05-09T10:00:00Z"},{"op":"delete"}]`, nil, 200},
+		{"POST", "/batch?mode=all", `[]`, nil, 422},
+		{"GET", "/events/stream", "", []string{"Last-Event-ID", "x"}, 400},
+		{"GET", "/.well-known/caldav", "", nil, 301},
+		{"OPTIONS", "/dav/", "", nil, 200},
+		{"OPTIONS", "/dav/principals/1/", "", nil, 200},
+		{"OPTIONS", "/dav/calendars/1/", "", nil, 200},
+		{"OPTIONS", "/dav/calendars/1/events/", "", nil, 200},
+		{"OPTIONS", object, "", nil, 200},
+		{"PUT", object, davICS, []string{"Content-Type", "text/calendar", "If-None-Match", "*"}, 201},
+		{"PUT", object, davICS, []string{"Content-Type", "text/calendar", "If-None-Match", "*"}, 412},
+		{"PUT", object, davICS, []string{"Content-Type", "text/plain"}, 403},
+		{"PUT", object, davICS, []string{"Content-Type", "text/calendar", "If-Match", `"1"`}, 204},
+		{"GET", object, "", nil, 200},
+		{"GET", object, "", []string{"If-None-Match", `"2"`}, 304},
+		{"HEAD", object, "", nil, 200},
+		{"GET", "/dav/calendars/1/events/missing.ics", "", nil, 404},
+		{"DELETE", object, "", []string{"If-Match", `"1"`}, 412},
+		{"DELETE", object, "", nil, 204},
+		{"DELETE", "/api/v1/events/1", "", []string{"If-Match", `"1"`}, 412},
+		{"DELETE", "/api/v1/events/1", "", nil, 204},
+		{"GET", "/api/v1/events/1/history", "", nil, 200},
+		{"GET", "/api/v1/deleted_events", "", nil, 200},
+		{"POST", "/api/v1/events/1/restore", `{}`, nil, 422},
+		{"POST", "/api/v1/events/1/restore", `{"version":1}`, nil, 200},
+		{"POST", "/delete_event", `{"id":2}`, nil, 200},
+		{"GET", "/healthz", "", nil, 200},
+		{"GET", "/readyz", "", nil, 200},
+		{"GET", "/metrics", "", nil, 200},
+	}
+
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		name := tt.method + " " + tt.target
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(tt.header); i += 2 {
+			req.Header.Set(tt.header[i], tt.header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d: %s", name, rec.Code, tt.status, rec.Body)
+			continue
+		}
+
+		template, operation := spec.operation(tt.method, req.URL.Path)
+		if operation == nil {
+			t.Errorf("%s: not documented", name)
+			continue
+		}
+		covered[operation["operationId"].(string)] = true
+
+		// Requests the server accepts must be valid for the document too.
+		if body := spec.resolve(operation["requestBody"]); body != nil && rec.Code < 300 && req.Header.Get("Content-Type") == "application/json" {
+			media := spec.resolve(body["content"].(map[string]interface{})["application/json"])
+			if err := spec.validate(media["schema"], decodeJSON(t, tt.body), "request"); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+
+		responses := operation["responses"].(map[string]interface{})
+		response := spec.resolve(responses[fmt.Sprint(rec.Code)])
+		if response == nil {
+			t.Errorf("%s: status %d is not documented for %s", name, rec.Code, template)
+			continue
+		}
+		headers, _ := response["headers"].(map[string]interface{})
+		for _, header := range []string{"ETag", "Location", "X-Conflicts", "X-Next-Cursor", "Link", "Retry-After"} {
+			if _, documented := headers[header]; rec.Header().Get(header) != "" && !documented {
+				t.Errorf("%s: header %s is not documented", name, header)
+			}
+		}
+
+		content, _ := response["content"].(map[string]interface{})
+		if content == nil {
+			// The recorder keeps the body of a HEAD response, which the
+			// server drops.
+			if rec.Body.Len() != 0 && tt.method != http.MethodHead {
+				t.Errorf("%s: body for a response without content", name)
+			}
+			continue
+		}
+		mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		media := spec.resolve(content[mediaType])
+		if media == nil {
+			t.Errorf("%s: content type %s is not documented", name, mediaType)
+			continue
+		}
+		if mediaType == "application/json" {
+			if err := spec.validate(media["schema"], decodeJSON(t, rec.Body.String()), "response"); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	for _, item := range spec.paths() {
+		for _, operation := range spec.operations(item) {
+			if id := operation["operationId"].(string); !covered[id] && id != "openapi" {
+				t.Errorf("operation %s is not exercised", id)
+			}
+		}
+	}
+}
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return value
+}
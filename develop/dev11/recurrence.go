@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrenceRule is the subset of an RFC 5545 RRULE supported by the
+// calendar: FREQ, INTERVAL, COUNT, UNTIL, BYDAY and, for monthly rules,
+// BYMONTHDAY.
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []weekdayNum
+	ByMonthDay []int
+}
+
+// weekdayNum is a BYDAY entry such as MO, 1MO or -1FR. The ordinal is only
+// meaningful for monthly rules.
+type weekdayNum struct {
+	Ordinal int
+	Weekday time.Weekday
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func parseRRule(s string) (recurrenceRule, error) {
+	rule := recurrenceRule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			return rule, fmt.Errorf("invalid rrule part %q", part)
+		}
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid rrule interval %q", value)
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, fmt.Errorf("invalid rrule count %q", value)
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := parseICalTime(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid rrule until %q", value)
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				wd, err := parseWeekdayNum(day)
+				if err != nil {
+					return rule, err
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(strings.TrimSpace(day))
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return rule, fmt.Errorf("invalid rrule bymonthday %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		default:
+			return rule, fmt.Errorf("unsupported rrule part %q", name)
+		}
+	}
+
+	switch rule.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY":
+	case "YEARLY":
+		if len(rule.ByDay) > 0 {
+			return rule, fmt.Errorf("BYDAY is not supported for yearly rules")
+		}
+	case "":
+		return rule, fmt.Errorf("rrule FREQ is required")
+	default:
+		return rule, fmt.Errorf("unsupported rrule frequency %q", rule.Freq)
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, fmt.Errorf("rrule COUNT and UNTIL are mutually exclusive")
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq != "MONTHLY" {
+		return rule, fmt.Errorf("BYMONTHDAY is only supported for monthly rules")
+	}
+	for _, wd := range rule.ByDay {
+		if wd.Ordinal != 0 && rule.Freq != "MONTHLY" {
+			return rule, fmt.Errorf("BYDAY ordinals are only supported for monthly rules")
+		}
+	}
+	return rule, nil
+}
+
+func parseWeekdayNum(s string) (weekdayNum, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return weekdayNum{}, fmt.Errorf("invalid rrule byday %q", s)
+	}
+	wd, ok := weekdayCodes[s[len(s)-2:]]
+	if !ok {
+		return weekdayNum{}, fmt.Errorf("invalid rrule byday %q", s)
+	}
+	var ordinal int
+	if prefix := s[:len(s)-2]; prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return weekdayNum{}, fmt.Errorf("invalid rrule byday %q", s)
+		}
+		ordinal = n
+	}
+	return weekdayNum{Ordinal: ordinal, Weekday: wd}, nil
+}
+
+// parseICalTime accepts the DATE and DATE-TIME forms used by RFC 5545.
+func parseICalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// expand calls fn for every occurrence of the rule starting at dtstart, in
+// chronological order, that is not excluded and starts before to. Periods
+// that lie entirely before from are skipped without being generated when
+// the rule has no COUNT, so expanding a window far from dtstart stays cheap.
+// fn may return false to stop the expansion.
+func (r recurrenceRule) expand(dtstart time.Time, exdates []time.Time, from, to time.Time, fn func(time.Time) bool) {
+	excluded := make(map[int64]bool, len(exdates))
+	for _, exdate := range exdates {
+		excluded[exdate.UnixNano()] = true
+	}
+
+	period := 0
+	if r.Count == 0 && from.After(dtstart) {
+		period = r.periodsBefore(dtstart, from)
+	}
+
+	emitted := 0
+	for ; ; period++ {
+		periodStart, candidates := r.period(dtstart, period)
+		if !periodStart.Before(to) {
+			return
+		}
+		for _, candidate := range candidates {
+			if candidate.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && candidate.After(r.Until) {
+				return
+			}
+			if r.Count > 0 && emitted >= r.Count {
+				return
+			}
+			if !candidate.Before(to) {
+				return
+			}
+			emitted++
+			if excluded[candidate.UnixNano()] || candidate.Before(from) {
+				continue
+			}
+			if !fn(candidate) {
+				return
+			}
+		}
+	}
+}
+
+// periodsBefore returns a period index that is safely at or before the one
+// containing from.
+func (r recurrenceRule) periodsBefore(dtstart, from time.Time) int {
+	var n int
+	switch r.Freq {
+	case "DAILY":
+		n = int(from.Sub(dtstart).Hours() / 24)
+	case "WEEKLY":
+		n = int(from.Sub(dtstart).Hours() / (24 * 7))
+	case "MONTHLY":
+		n = (from.Year()-dtstart.Year())*12 + int(from.Month()-dtstart.Month())
+	case "YEARLY":
+		n = from.Year() - dtstart.Year()
+	}
+	n = n/r.Interval - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// period returns the start of the n-th period of the rule and the sorted
+// candidate occurrences that fall into it.
+func (r recurrenceRule) period(dtstart time.Time, n int) (time.Time, []time.Time) {
+	loc := dtstart.Location()
+	hour, minute, sec := dtstart.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, minute, sec, dtstart.Nanosecond(), loc)
+	}
+	step := n * r.Interval
+
+	switch r.Freq {
+	case "DAILY":
+		day := at(dtstart.Year(), dtstart.Month(), dtstart.Day()+step)
+		if len(r.ByDay) > 0 && !r.matchesWeekday(day.Weekday()) {
+			return day, nil
+		}
+		return day, []time.Time{day}
+
+	case "WEEKLY":
+		offset := (int(dtstart.Weekday()) + 6) % 7
+		monday := at(dtstart.Year(), dtstart.Month(), dtstart.Day()-offset+7*step)
+		if len(r.ByDay) == 0 {
+			return monday, []time.Time{monday.AddDate(0, 0, offset)}
+		}
+		var days []time.Time
+		for _, wd := range r.ByDay {
+			days = append(days, monday.AddDate(0, 0, (int(wd.Weekday)+6)%7))
+		}
+		return monday, sortUnique(days)
+
+	case "MONTHLY":
+		first := at(dtstart.Year(), dtstart.Month()+time.Month(step), 1)
+		if len(r.ByMonthDay) > 0 {
+			return first, r.monthDays(first)
+		}
+		if len(r.ByDay) == 0 {
+			day := at(first.Year(), first.Month(), dtstart.Day())
+			if day.Month() != first.Month() {
+				return first, nil
+			}
+			return first, []time.Time{day}
+		}
+		var days []time.Time
+		for _, wd := range r.ByDay {
+			days = append(days, monthWeekdays(first, wd)...)
+		}
+		return first, sortUnique(days)
+
+	default: // YEARLY
+		day := at(dtstart.Year()+step, dtstart.Month(), dtstart.Day())
+		if day.Month() != dtstart.Month() {
+			return day, nil
+		}
+		return day, []time.Time{day}
+	}
+}
+
+func (r recurrenceRule) matchesWeekday(weekday time.Weekday) bool {
+	for _, wd := range r.ByDay {
+		if wd.Weekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays returns the days of the month starting at first named by
+// BYMONTHDAY, counted from the end when negative, that are also on a BYDAY
+// weekday if the rule has any. Days the month does not have are skipped.
+func (r recurrenceRule) monthDays(first time.Time) []time.Time {
+	last := first.AddDate(0, 1, -1).Day()
+	var weekdays []time.Time
+	for _, wd := range r.ByDay {
+		weekdays = append(weekdays, monthWeekdays(first, wd)...)
+	}
+	var days []time.Time
+	for _, n := range r.ByMonthDay {
+		if n < 0 {
+			n += last + 1
+		}
+		if n < 1 || n > last {
+			continue
+		}
+		day := first.AddDate(0, 0, n-1)
+		if len(r.ByDay) > 0 && !containsTime(weekdays, day) {
+			continue
+		}
+		days = append(days, day)
+	}
+	return sortUnique(days)
+}
+
+// monthWeekdays returns the days of the month starting at first that match
+// a BYDAY entry: all of them for a plain weekday, or only the n-th (from
+// the end when negative) for an ordinal one.
+func monthWeekdays(first time.Time, wd weekdayNum) []time.Time {
+	var days []time.Time
+	for day := first.AddDate(0, 0, (int(wd.Weekday)-int(first.Weekday())+7)%7); day.Month() == first.Month(); day = day.AddDate(0, 0, 7) {
+		days = append(days, day)
+	}
+	switch {
+	case wd.Ordinal > 0 && wd.Ordinal <= len(days):
+		return days[wd.Ordinal-1 : wd.Ordinal]
+	case wd.Ordinal < 0 && -wd.Ordinal <= len(days):
+		return days[len(days)+wd.Ordinal : len(days)+wd.Ordinal+1]
+	case wd.Ordinal != 0:
+		return nil
+	}
+	return days
+}
+
+func sortUnique(days []time.Time) []time.Time {
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	unique := days[:0]
+	for i, day := range days {
+		if i == 0 || !day.Equal(days[i-1]) {
+			unique = append(unique, day)
+		}
+	}
+	return unique
+}
+
+func containsTime(times []time.Time, t time.Time) bool {
+	for _, candidate := range times {
+		if candidate.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	tests := []struct {
+		rrule    string
+		expected recurrenceRule
+		err      string
+	}{
+		{"FREQ=DAILY", recurrenceRule{Freq: "DAILY", Interval: 1}, ""},
+		{"RRULE:freq=weekly;INTERVAL=2;COUNT=5", recurrenceRule{Freq: "WEEKLY", Interval: 2, Count: 5}, ""},
+		{"FREQ=MONTHLY;BYDAY=-1FR,2MO", recurrenceRule{Freq: "MONTHLY", Interval: 1,
+			ByDay: []weekdayNum{{-1, time.Friday}, {2, time.Monday}}}, ""},
+		{"FREQ=MONTHLY;BYMONTHDAY=31,-1", recurrenceRule{Freq: "MONTHLY", Interval: 1, ByMonthDay: []int{31, -1}}, ""},
+		{"FREQ=YEARLY;UNTIL=20300101T000000Z", recurrenceRule{Freq: "YEARLY", Interval: 1,
+			Until: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}, ""},
+		{"", recurrenceRule{}, "rrule FREQ is required"},
+		{"FREQ=HOURLY", recurrenceRule{}, `unsupported rrule frequency "HOURLY"`},
+		{"FREQ=DAILY;INTERVAL=0", recurrenceRule{}, `invalid rrule interval "0"`},
+		{"FREQ=DAILY;COUNT=x", recurrenceRule{}, `invalid rrule count "x"`},
+		{"FREQ=DAILY;UNTIL=tomorrow", recurrenceRule{}, `invalid rrule until "tomorrow"`},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20300101", recurrenceRule{}, "rrule COUNT and UNTIL are mutually exclusive"},
+		{"FREQ=WEEKLY;BYDAY=XX", recurrenceRule{}, `invalid rrule byday "XX"`},
+		{"FREQ=MONTHLY;BYDAY=6MO", recurrenceRule{}, `invalid rrule byday "6MO"`},
+		{"FREQ=WEEKLY;BYDAY=1MO", recurrenceRule{}, "BYDAY ordinals are only supported for monthly rules"},
+		{"FREQ=YEARLY;BYDAY=MO", recurrenceRule{}, "BYDAY is not supported for yearly rules"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", recurrenceRule{}, `invalid rrule bymonthday "32"`},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", recurrenceRule{}, "BYMONTHDAY is only supported for monthly rules"},
+		{"FREQ=DAILY;BYSETPOS=1", recurrenceRule{}, `unsupported rrule part "BYSETPOS"`},
+		{"FREQ=DAILY;COUNT", recurrenceRule{}, `invalid rrule part "COUNT"`},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseRRule(tt.rrule)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseRRule(%q) error = %v, expected %q", tt.rrule, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(rule, tt.expected) {
+			t.Errorf("parseRRule(%q) = %+v, %v, expected %+v", tt.rrule, rule, err, tt.expected)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	utc := func(s string) time.Time {
+		t.Helper()
+		at, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	unbounded := utc("2100-01-01 00:00")
+
+	tests := []struct {
+		name     string
+		rrule    string
+		dtstart  time.Time
+		exdates  []time.Time
+		from, to time.Time
+		expected string
+	}{
+		{"daily", "FREQ=DAILY;COUNT=3", utc("2024-05-06 10:00"), nil, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-07 10:00, 2024-05-08 10:00"},
+		{"every third day", "FREQ=DAILY;INTERVAL=3;COUNT=3", utc("2024-05-30 10:00"), nil, utc("2024-05-30 10:00"), unbounded,
+			"2024-05-30 10:00, 2024-06-02 10:00, 2024-06-05 10:00"},
+		{"daily on weekdays", "FREQ=DAILY;BYDAY=MO,FR;COUNT=3", utc("2024-05-06 10:00"), nil, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-10 10:00, 2024-05-13 10:00"},
+		{"every other week", "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH;COUNT=4", utc("2024-05-07 09:00"), nil, utc("2024-05-01 00:00"), unbounded,
+			"2024-05-07 09:00, 2024-05-09 09:00, 2024-05-21 09:00, 2024-05-23 09:00"},
+		{"weekly before dtstart in its week", "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3", utc("2024-05-08 09:00"), nil, utc("2024-05-01 00:00"), unbounded,
+			"2024-05-10 09:00, 2024-05-13 09:00, 2024-05-17 09:00"},
+		{"last friday", "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3", utc("2024-01-01 12:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-26 12:00, 2024-02-23 12:00, 2024-03-29 12:00"},
+		{"second monday", "FREQ=MONTHLY;BYDAY=2MO;COUNT=3", utc("2024-04-01 12:00"), nil, utc("2024-04-01 00:00"), unbounded,
+			"2024-04-08 12:00, 2024-05-13 12:00, 2024-06-10 12:00"},
+		{"fifth monday", "FREQ=MONTHLY;BYDAY=5MO;COUNT=2", utc("2024-01-01 12:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-29 12:00, 2024-04-29 12:00"},
+		{"monthly on the 31st", "FREQ=MONTHLY;COUNT=4", utc("2024-01-31 08:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-31 08:00, 2024-03-31 08:00, 2024-05-31 08:00, 2024-07-31 08:00"},
+		{"bymonthday 31", "FREQ=MONTHLY;BYMONTHDAY=31;COUNT=3", utc("2024-01-15 08:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-31 08:00, 2024-03-31 08:00, 2024-05-31 08:00"},
+		{"last day of the month", "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3", utc("2024-01-15 08:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-31 08:00, 2024-02-29 08:00, 2024-03-31 08:00"},
+		{"february 29th", "FREQ=MONTHLY;BYMONTHDAY=29;COUNT=3", utc("2023-01-29 08:00"), nil, utc("2023-01-01 00:00"), unbounded,
+			"2023-01-29 08:00, 2023-03-29 08:00, 2023-04-29 08:00"},
+		{"first and 15th on mondays", "FREQ=MONTHLY;BYMONTHDAY=1,15;BYDAY=MO;COUNT=2", utc("2024-01-01 08:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-01-01 08:00, 2024-01-15 08:00"},
+		{"leap day yearly", "FREQ=YEARLY;COUNT=2", utc("2024-02-29 08:00"), nil, utc("2024-01-01 00:00"), unbounded,
+			"2024-02-29 08:00, 2028-02-29 08:00"},
+		{"count includes exdates", "FREQ=DAILY;COUNT=4", utc("2024-05-06 10:00"),
+			[]time.Time{utc("2024-05-07 10:00"), utc("2024-05-09 10:00")}, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-08 10:00"},
+		{"exdate off the rule", "FREQ=DAILY;COUNT=2", utc("2024-05-06 10:00"),
+			[]time.Time{utc("2024-05-07 11:00")}, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-07 10:00"},
+		{"until inclusive", "FREQ=DAILY;UNTIL=20240508T100000Z", utc("2024-05-06 10:00"), nil, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-07 10:00, 2024-05-08 10:00"},
+		{"until before the time of day", "FREQ=DAILY;UNTIL=20240508T095959Z", utc("2024-05-06 10:00"), nil, utc("2024-05-06 10:00"), unbounded,
+			"2024-05-06 10:00, 2024-05-07 10:00"},
+		{"window", "FREQ=WEEKLY", utc("2024-01-01 10:00"), nil, utc("2024-05-06 10:00"), utc("2024-05-20 10:00"),
+			"2024-05-06 10:00, 2024-05-13 10:00"},
+		{"count before the window", "FREQ=DAILY;COUNT=5", utc("2024-05-06 10:00"), nil, utc("2024-05-09 00:00"), unbounded,
+			"2024-05-09 10:00, 2024-05-10 10:00"},
+		{"dst start", "FREQ=DAILY;COUNT=3", time.Date(2024, 3, 9, 9, 0, 0, 0, newYork), nil, utc("2024-03-01 00:00"), unbounded,
+			"2024-03-09 14:00, 2024-03-10 13:00, 2024-03-11 13:00"},
+		{"dst end", "FREQ=WEEKLY;BYDAY=SA,MO;COUNT=3", time.Date(2024, 11, 2, 9, 0, 0, 0, newYork), nil, utc("2024-11-01 00:00"), unbounded,
+			"2024-11-02 13:00, 2024-11-04 14:00, 2024-11-09 14:00"},
+		{"dst monthly", "FREQ=MONTHLY;BYDAY=1SU;COUNT=2", time.Date(2024, 10, 6, 9, 0, 0, 0, newYork), nil, utc("2024-10-01 00:00"), unbounded,
+			"2024-10-06 13:00, 2024-11-03 14:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRRule(tt.rrule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			rule.expand(tt.dtstart, tt.exdates, tt.from, tt.to, func(at time.Time) bool {
+				got = append(got, at.UTC().Format("2006-01-02 15:04"))
+				return len(got) < 10
+			})
+			if strings.Join(got, ", ") != tt.expected {
+				t.Errorf("occurrences %q, expected %q", strings.Join(got, ", "), tt.expected)
+			}
+		})
+	}
+}
+
+// A series in a zone with daylight saving time keeps its local time of
+// day, and days in the zone, when queried in UTC.
+func TestOccurrencesAcrossDST(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	series := Event{
+		ID:       1,
+		Title:    "Standup",
+		Date:     time.Date(2024, 3, 29, 9, 30, 0, 0, berlin).UTC(),
+		End:      time.Date(2024, 3, 29, 9, 45, 0, 0, berlin).UTC(),
+		TimeZone: "Europe/Berlin",
+		RRule:    "FREQ=WEEKLY;BYDAY=MO,FR",
+		ExDates:  []time.Time{time.Date(2024, 4, 5, 9, 30, 0, 0, berlin).UTC()},
+	}
+	var got []string
+	series.occurrences(time.Date(2024, 3, 25, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 9, 0, 0, 0, 0, time.UTC), func(e Event) bool {
+		got = append(got, e.Date.Format(time.RFC3339)+"/"+e.End.Sub(e.Date).String())
+		return true
+	})
+	expected := "2024-03-29T08:30:00Z/15m0s, 2024-04-01T07:30:00Z/15m0s, 2024-04-08T07:30:00Z/15m0s"
+	if strings.Join(got, ", ") != expected {
+		t.Errorf("occurrences %s, expected %s", strings.Join(got, ", "), expected)
+	}
+	if !series.hasOccurrence(time.Date(2024, 4, 1, 7, 30, 0, 0, time.UTC)) || series.hasOccurrence(time.Date(2024, 4, 1, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("hasOccurrence ignores the change to summer time")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const maxReminderBefore = 7 * 24 * time.Hour
+
+// Reminder asks for a notification Before the event starts. Channel picks
+// the notifier ("log", "webhook" or "email", the server default when
+// empty) and Target is the address it delivers to, if it needs one.
+type Reminder struct {
+	Before  jsonDuration `json:"before"`
+	Channel string       `json:"channel,omitempty"`
+	Target  string       `json:"target,omitempty"`
+}
+
+// jsonDuration is a time.Duration encoded as a string such as "15m0s".
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *jsonDuration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// parseReminder parses the compact form used in requests:
+// before[/channel[/target]], e.g. 15m or 1h/email/alice@example.com.
+func parseReminder(s string) (Reminder, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 3)
+	before, err := time.ParseDuration(parts[0])
+	if err != nil || before < 0 || before > maxReminderBefore {
+		return Reminder{}, fmt.Errorf("invalid reminder offset %q", parts[0])
+	}
+	reminder := Reminder{Before: jsonDuration(before)}
+	if len(parts) > 1 {
+		reminder.Channel = parts[1]
+	}
+	if len(parts) > 2 {
+		reminder.Target = parts[2]
+	}
+	switch reminder.Channel {
+	case "", "log":
+	case "webhook":
+		if reminder.Target != "" {
+			if u, err := url.Parse(reminder.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return Reminder{}, fmt.Errorf("invalid webhook url %q", reminder.Target)
+			}
+		}
+	case "email":
+		if reminder.Target == "" {
+			return Reminder{}, fmt.Errorf("email reminder needs a target address")
+		}
+		if addr, err := mail.ParseAddress(reminder.Target); err != nil || addr.Address != reminder.Target {
+			return Reminder{}, fmt.Errorf("invalid email address %q", reminder.Target)
+		}
+	default:
+		return Reminder{}, fmt.Errorf("unknown reminder channel %q", reminder.Channel)
+	}
+	return reminder, nil
+}
+
+func (r Reminder) String() string {
+	s := time.Duration(r.Before).String()
+	if r.Channel != "" || r.Target != "" {
+		s += "/" + r.Channel
+	}
+	if r.Target != "" {
+		s += "/" + r.Target
+	}
+	return s
+}
+
+// Notification is a reminder that is due.
+type Notification struct {
+	Event    Event     `json:"event"`
+	Reminder Reminder  `json:"reminder"`
+	FireAt   time.Time `json:"fire_at"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+type logNotifier struct {
+	w io.Writer
+}
+
+func (n logNotifier) Notify(ctx context.Context, notification Notification) error {
+	_, err := fmt.Fprintf(n.w, "Напоминание: %q (id %d, пользователь %d) начинается в %s\n",
+		notification.Event.Title, notification.Event.ID, notification.Event.UserID,
+		notification.Event.Date.In(notification.Event.location()).Format(time.RFC3339))
+	return err
+}
+
+// webhookNotifier POSTs the notification as JSON to the reminder target or,
+// if it has none, to the configured URL. Any user may set the target, so it
+// is only delivered to over targets, which does not reach the server's own
+// network.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	targets *http.Client
+}
+
+func newWebhookNotifier(url string, timeout time.Duration) webhookNotifier {
+	return webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		targets: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{DialContext: (&net.Dialer{Control: dialPublic}).DialContext},
+		},
+	}
+}
+
+// dialPublic refuses connections to loopback, private, link-local and
+// other addresses that are not public. It runs once the name is resolved,
+// so neither a name nor a redirect gets around it.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if addr := addrPort.Addr().Unmap(); !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("webhook address %s is not public", addr)
+	}
+	return nil
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	url, client := notification.Reminder.Target, n.targets
+	if url == "" {
+		url, client = n.url, n.client
+	}
+	if url == "" {
+		return fmt.Errorf("webhook url is not configured")
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Notify sends the reminder by mail. The title is encoded in the subject,
+// so that line breaks in it cannot add headers.
+func (n smtpNotifier) Notify(ctx context.Context, notification Notification) error {
+	to, err := mail.ParseAddress(notification.Reminder.Target)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %w", notification.Reminder.Target, err)
+	}
+	event := notification.Event
+	start := event.Date.In(event.location()).Format("2006-01-02 15:04 MST")
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s starts at %s.\r\n\r\n%s\r\n",
+		n.from, to, mime.QEncoding.Encode("utf-8", "Reminder: "+event.Title), event.Title, start, event.Description)
+	return n.send(n.addr, n.auth, n.from, []string{to.Address}, []byte(msg))
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// reminderScheduler periodically looks for due reminders and hands them to
+// the notifiers. It reads the calendar on every pass, so updated and
+// deleted events are picked up without any bookkeeping. Every fired
+// reminder is recorded in a state file before the notification is sent,
+// so a restart never fires the same reminder twice; a reminder that fell
+// due while the server was down is still sent as long as its event has
+// not started yet. Events that started since the previous pass still have
+// their reminders fired, so reminders shorter than the interval, 0m
+// included, are not missed.
+type reminderScheduler struct {
+	calendar       *Calendar
+	clock          Clock
+	notifiers      map[string]Notifier
+	defaultChannel string
+	statePath      string
+
+	mu    sync.Mutex
+	fired map[string]time.Time
+	// last is the time of the previous pass that completed.
+	last time.Time
+}
+
+func newReminderScheduler(calendar *Calendar, clock Clock, notifiers map[string]Notifier, defaultChannel, statePath string) (*reminderScheduler, error) {
+	s := &reminderScheduler{
+		calendar:       calendar,
+		clock:          clock,
+		notifiers:      notifiers,
+		defaultChannel: defaultChannel,
+		statePath:      statePath,
+		fired:          make(map[string]time.Time),
+	}
+	if statePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.fired); err != nil {
+		return nil, fmt.Errorf("corrupted reminder state: %w", err)
+	}
+	return s, nil
+}
+
+func (s *reminderScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tick fires every reminder that is due at the current time.
+func (s *reminderScheduler) tick(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	from := now
+	if !s.last.IsZero() && s.last.Before(now) {
+		from = s.last.Add(time.Nanosecond)
+	}
+	var due []Notification
+	for _, event := range s.calendar.GetEventsForRange(from, now.Add(maxReminderBefore+time.Nanosecond)) {
+		if event.Date.Before(from) {
+			continue
+		}
+		for _, reminder := range event.Reminders {
+			fireAt := event.Date.Add(-time.Duration(reminder.Before))
+			key := reminderKey(event, reminder)
+			if fireAt.After(now) {
+				continue
+			}
+			if _, done := s.fired[key]; done {
+				continue
+			}
+			s.fired[key] = event.Date
+			due = append(due, Notification{Event: event, Reminder: reminder, FireAt: fireAt})
+		}
+	}
+
+	if len(due) > 0 {
+		if err := s.saveState(); err != nil {
+			slog.Error("Не удалось сохранить состояние напоминаний", "error", err)
+			for _, notification := range due {
+				delete(s.fired, reminderKey(notification.Event, notification.Reminder))
+			}
+			return
+		}
+	}
+	// The next pass only looks at events that start after now, so what was
+	// fired for the others is no longer needed.
+	s.last = now
+	for key, start := range s.fired {
+		if !start.After(now) {
+			delete(s.fired, key)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].FireAt.Before(due[j].FireAt) })
+	for _, notification := range due {
+		channel := notification.Reminder.Channel
+		if channel == "" {
+			channel = s.defaultChannel
+		}
+		notifier, ok := s.notifiers[channel]
+		if !ok {
+			slog.Warn("Канал напоминания не настроен", "event_id", notification.Event.ID, "channel", channel)
+			continue
+		}
+		if err := notifier.Notify(ctx, notification); err != nil {
+			slog.Error("Напоминание не отправлено", "event_id", notification.Event.ID, "channel", channel, "error", err)
+		}
+	}
+}
+
+// reminderKey identifies a reminder of one occurrence. Moving the event
+// changes the key, so the reminder fires again for the new time.
+func reminderKey(event Event, reminder Reminder) string {
+	return fmt.Sprintf("%d/%d/%s", event.ID, event.Date.Unix(), reminder)
+}
+
+func (s *reminderScheduler) saveState() error {
+	if s.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.fired)
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statePath)
+}
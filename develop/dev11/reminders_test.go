@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func (n *recordingNotifier) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.sent)
+}
+
+func TestReminderScheduler(t *testing.T) {
+	start := time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(-time.Hour)}
+	notifier := &recordingNotifier{}
+	notifiers := map[string]Notifier{"log": notifier}
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+
+	c := NewCalendar(newMemoryStore())
+	event, err := c.CreateEvent(0, Event{
+		Title:     "standup",
+		UserID:    1,
+		Date:      start,
+		End:       start.Add(15 * time.Minute),
+		Reminders: []Reminder{{Before: jsonDuration(15 * time.Minute)}},
+	}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler, err := newReminderScheduler(c, clock, notifiers, "log", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	scheduler.tick(ctx)
+	if got := notifier.count(); got != 0 {
+		t.Fatalf("fired %d reminders an hour before the event, expected none", got)
+	}
+
+	clock.Set(start.Add(-10 * time.Minute))
+	scheduler.tick(ctx)
+	scheduler.tick(ctx)
+	if got := notifier.count(); got != 1 {
+		t.Fatalf("fired %d reminders, expected 1", got)
+	}
+
+	// A restarted scheduler must not fire the same reminder again.
+	restarted, err := newReminderScheduler(c, clock, notifiers, "log", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.tick(ctx)
+	if got := notifier.count(); got != 1 {
+		t.Fatalf("restarted scheduler fired again: %d reminders", got)
+	}
+
+	// Moving the event schedules the reminder for the new time.
+	event.Date = start.Add(time.Hour)
+	event.End = event.Date.Add(15 * time.Minute)
+	if _, err := c.UpdateEvent(0, event.ID, event, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	restarted.tick(ctx)
+	if got := notifier.count(); got != 1 {
+		t.Fatalf("fired %d reminders before the moved event is due, expected 1", got)
+	}
+	clock.Set(event.Date.Add(-5 * time.Minute))
+	restarted.tick(ctx)
+	if got := notifier.count(); got != 2 {
+		t.Fatalf("fired %d reminders for the moved event, expected 2", got)
+	}
+
+	// A deleted event does not fire.
+	later, err := c.CreateEvent(0, Event{
+		Title:     "retro",
+		UserID:    1,
+		Date:      start.Add(3 * time.Hour),
+		End:       start.Add(4 * time.Hour),
+		Reminders: []Reminder{{Before: jsonDuration(30 * time.Minute)}},
+	}, AllowConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteEvent(0, later.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(later.Date.Add(-time.Minute))
+	restarted.tick(ctx)
+	if got := notifier.count(); got != 2 {
+		t.Fatalf("fired %d reminders after the event was deleted, expected 2", got)
+	}
+}
+
+func TestReminderSchedulerRecurring(t *testing.T) {
+	start := time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{}
+	notifier := &recordingNotifier{}
+
+	c := NewCalendar(newMemoryStore())
+	if _, err := c.CreateEvent(0, Event{
+		Title:     "daily",
+		UserID:    1,
+		Date:      start,
+		End:       start.Add(time.Hour),
+		RRule:     "FREQ=DAILY;COUNT=3",
+		Reminders: []Reminder{{Before: jsonDuration(time.Hour)}},
+	}, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler, err := newReminderScheduler(c, clock, map[string]Notifier{"log": notifier}, "log", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day := 0; day < 5; day++ {
+		clock.Set(start.AddDate(0, 0, day).Add(-30 * time.Minute))
+		scheduler.tick(context.Background())
+	}
+	if got := notifier.count(); got != 3 {
+		t.Errorf("fired %d reminders for a series of 3 occurrences, expected 3", got)
+	}
+}
+
+// Reminders that fall due between two passes fire on the second one, even
+// if the event has started by then.
+func TestReminderSchedulerShortOffsets(t *testing.T) {
+	start := time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(-20 * time.Second)}
+	notifier := &recordingNotifier{}
+
+	c := NewCalendar(newMemoryStore())
+	if _, err := c.CreateEvent(0, Event{
+		Title:     "call",
+		UserID:    1,
+		Date:      start,
+		End:       start.Add(time.Hour),
+		Reminders: []Reminder{{}, {Before: jsonDuration(10 * time.Second)}},
+	}, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, err := newReminderScheduler(c, clock, map[string]Notifier{"log": notifier}, "log", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Passes every 30s, the default interval: neither reminder is due on
+	// the first, both are on the second, after the event started.
+	ctx := context.Background()
+	for _, at := range []time.Duration{-20 * time.Second, 10 * time.Second, 40 * time.Second} {
+		clock.Set(start.Add(at))
+		scheduler.tick(ctx)
+	}
+	if got := notifier.count(); got != 2 {
+		t.Fatalf("fired %d reminders, expected 2", got)
+	}
+	if notifier.sent[0].Reminder.Before != jsonDuration(10*time.Second) || notifier.sent[1].Reminder.Before != 0 {
+		t.Errorf("fired %v then %v, expected 10s then 0s", notifier.sent[0].Reminder, notifier.sent[1].Reminder)
+	}
+
+	// A scheduler started after the event does not fire its reminders.
+	restarted, err := newReminderScheduler(c, clock, map[string]Notifier{"log": notifier}, "log", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.tick(ctx)
+	if got := notifier.count(); got != 2 {
+		t.Errorf("restarted scheduler fired %d reminders, expected 2", got)
+	}
+}
+
+func TestParseReminder(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"15m", true},
+		{"0m/log", true},
+		{"1h/email/alice@example.com", true},
+		{"1h/webhook", true},
+		{"1h/webhook/https://example.com/hook", true},
+		{"-5m", false},
+		{"8d", false},
+		{"1h/sms", false},
+		{"1h/email", false},
+		{"1h/email/Alice <alice@example.com>", false},
+		{"1h/email/alice@example.com\r\nBcc: eve@example.com", false},
+		{"1h/webhook/file:///etc/passwd", false},
+		{"1h/webhook/example.com", false},
+	}
+	for _, tt := range tests {
+		if _, err := parseReminder(tt.spec); (err == nil) != tt.valid {
+			t.Errorf("parseReminder(%q) = %v, expected valid %v", tt.spec, err, tt.valid)
+		}
+	}
+}
+
+// A title cannot add headers to a reminder mail.
+func TestSMTPNotifier(t *testing.T) {
+	var sent []byte
+	notifier := smtpNotifier{addr: "mail:25", from: "calendar@example.com",
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			if len(to) != 1 || to[0] != "alice@example.com" {
+				t.Errorf("sent to %q", to)
+			}
+			sent = msg
+			return nil
+		}}
+	title := "standup\r\nBcc: eve@example.com"
+	event := Event{Title: title, Date: time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC)}
+	if err := notifier.Notify(context.Background(), Notification{Event: event, Reminder: Reminder{Channel: "email", Target: "alice@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(sent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Header) != 4 || msg.Header.Get("Bcc") != "" {
+		t.Errorf("headers %v", msg.Header)
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != "Reminder: "+title {
+		t.Errorf("subject %q, %v", subject, err)
+	}
+
+	bad := Notification{Event: event, Reminder: Reminder{Channel: "email", Target: "alice@example.com\r\nBcc: eve@example.com"}}
+	if err := notifier.Notify(context.Background(), bad); err == nil {
+		t.Errorf("sent to %q", bad.Reminder.Target)
+	}
+}
+
+// The targets of reminders, unlike the configured URL, may not be on the
+// server's own network.
+func TestWebhookNotifier(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	notifier := newWebhookNotifier(server.URL, time.Second)
+	ctx := context.Background()
+	if err := notifier.Notify(ctx, Notification{Reminder: Reminder{Channel: "webhook"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{server.URL, "http://10.0.0.1/hook", "http://169.254.169.254/latest", "http://[::1]:9/hook", "http://0.0.0.0:9/hook"} {
+		if err := notifier.Notify(ctx, Notification{Reminder: Reminder{Channel: "webhook", Target: target}}); err == nil || !strings.Contains(err.Error(), "is not public") {
+			t.Errorf("delivered to %s: %v", target, err)
+		}
+	}
+	if got := received.Load(); got != 1 {
+		t.Errorf("server received %d notifications, expected 1", got)
+	}
+}
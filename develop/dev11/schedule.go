@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy tells CreateEvent and UpdateEvent what to do with an
+// event that overlaps another event of the same user.
+type ConflictPolicy int
+
+const (
+	// AllowConflicts stores the event anyway; callers may still report
+	// the overlap with Conflicts.
+	AllowConflicts ConflictPolicy = iota
+	// RejectConflicts refuses the change with a *conflictError.
+	RejectConflicts
+)
+
+// parseConflictPolicy reads the conflicts parameter of a change request:
+// with "warn", the default, overlapping events are stored and the overlap
+// is reported; with "reject" they are refused with 409.
+func parseConflictPolicy(form url.Values) (ConflictPolicy, error) {
+	switch form.Get("conflicts") {
+	case "", "warn":
+		return AllowConflicts, nil
+	case "reject":
+		return RejectConflicts, nil
+	default:
+		return 0, invalidField("conflicts", "conflicts must be warn or reject")
+	}
+}
+
+// warnConflicts lists the IDs of the events overlapping the stored event in
+// the X-Conflicts header and returns the events.
+func warnConflicts(w http.ResponseWriter, event Event) []Event {
+	conflicts := calendar.Conflicts(event)
+	if len(conflicts) > 0 {
+		ids := make([]string, len(conflicts))
+		for i, conflict := range conflicts {
+			ids[i] = strconv.Itoa(conflict.ID)
+		}
+		w.Header().Set("X-Conflicts", strings.Join(ids, ","))
+	}
+	return conflicts
+}
+
+// conflictHorizon and maxConflictOccurrences bound the part of a recurring
+// series that is checked for conflicts.
+const (
+	conflictHorizon        = 366 * 24 * time.Hour
+	maxConflictOccurrences = 500
+)
+
+var errEventConflict = errors.New("event overlaps another event")
+
+type conflictError struct {
+	Conflicts []Event
+}
+
+func (e *conflictError) Error() string {
+	ids := make([]string, len(e.Conflicts))
+	for i, event := range e.Conflicts {
+		ids[i] = strconv.Itoa(event.ID)
+	}
+	return fmt.Sprintf("%v: %s", errEventConflict, strings.Join(ids, ", "))
+}
+
+func (e *conflictError) Is(target error) bool {
+	return target == errEventConflict
+}
+
+// sameSeries reports whether two events are the same event or belong to
+// the same recurring series, which never conflict with each other.
+func sameSeries(a, b Event) bool {
+	seriesOf := func(e Event) int {
+		if e.SeriesID != 0 {
+			return e.SeriesID
+		}
+		return e.ID
+	}
+	return (a.ID != 0 && a.ID == b.ID) || (seriesOf(a) != 0 && seriesOf(a) == seriesOf(b))
+}
+
+// Conflicts returns the events and occurrences of the same user that
+// overlap the event, or any occurrence of it in the year after its start.
+// All-day events count as busy for their whole day in the zone of event.
+func (c *Calendar) Conflicts(event Event) []Event {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conflicts(event)
+}
+
+// conflicts must be called with c.mu held. Events without an owner never
+// conflict.
+func (c *Calendar) conflicts(event Event) []Event {
+	if event.UserID == 0 {
+		return nil
+	}
+	loc := event.location()
+	type key struct {
+		id    int
+		start int64
+	}
+	seen := make(map[key]bool)
+	var result []Event
+
+	check := func(occurrence Event) bool {
+		start, end := occurrence.bounds(loc)
+		if !end.After(start) {
+			end = start.Add(time.Nanosecond)
+		}
+		page := &resultPage{}
+		c.index.query(EventQuery{Start: start, End: end, UserID: event.UserID}, page)
+		for _, other := range page.events {
+			k := key{other.ID, other.Date.UnixNano()}
+			if sameSeries(event, other) || seen[k] {
+				continue
+			}
+			seen[k] = true
+			result = append(result, other)
+		}
+		return true
+	}
+
+	if event.RRule == "" {
+		check(event)
+	} else {
+		checked := 0
+		event.occurrences(event.Date, event.Date.Add(conflictHorizon), func(occurrence Event) bool {
+			checked++
+			return check(occurrence) && checked < maxConflictOccurrences
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return cursorOf(result[i], loc).before(cursorOf(result[j], loc))
+	})
+	return result
+}
+
+// checkConflicts applies the policy to the event about to be stored. Must
+// be called with c.mu held.
+func (c *Calendar) checkConflicts(event Event, policy ConflictPolicy) error {
+	if policy != RejectConflicts {
+		return nil
+	}
+	if conflicts := c.conflicts(event); len(conflicts) > 0 {
+		return &conflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// workingHours are the hours of the day, on the given weekdays, in which
+// meetings may be scheduled.
+type workingHours struct {
+	Start, End time.Duration
+	Weekdays   [7]bool
+}
+
+// Slot is a free interval.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// FreeSlots returns the intervals within [start, end) and the working
+// hours, taken in the location of start, in which none of the users has
+// an event and that last at least duration.
+func (c *Calendar) FreeSlots(userIDs []int, start, end time.Time, hours workingHours, duration time.Duration) []Slot {
+	loc := start.Location()
+	var busy []Slot
+	for _, userID := range userIDs {
+		events, _ := c.QueryEvents(EventQuery{Start: start, End: end, UserID: userID})
+		for _, event := range events {
+			from, to := event.bounds(loc)
+			if to.After(from) {
+				busy = append(busy, Slot{Start: from, End: to})
+			}
+		}
+	}
+	sort.Slice(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+
+	slots := []Slot{}
+	add := func(from, to time.Time) {
+		if to.Sub(from) >= duration {
+			slots = append(slots, Slot{Start: from, End: to})
+		}
+	}
+	next := 0
+	for day := startOfDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		if !hours.Weekdays[day.Weekday()] {
+			continue
+		}
+		from, to := atClock(day, hours.Start), atClock(day, hours.End)
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+
+		for next < len(busy) && !busy[next].End.After(from) {
+			next++
+		}
+		for i := next; i < len(busy) && busy[i].Start.Before(to); i++ {
+			if busy[i].Start.After(from) {
+				add(from, busy[i].Start)
+			}
+			if busy[i].End.After(from) {
+				from = busy[i].End
+			}
+		}
+		if to.After(from) {
+			add(from, to)
+		}
+	}
+	return slots
+}
+
+// atClock returns the wall clock time of day on the date of day, so that
+// working hours keep their local time across DST changes.
+func atClock(day time.Time, clock time.Duration) time.Time {
+	year, month, date := day.Date()
+	return time.Date(year, month, date, int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// maxFreeSlotsRange caps the range searched by /free_slots.
+const maxFreeSlotsRange = 92 * 24 * time.Hour
+
+// handleFreeSlots finds the common free time of several users:
+//
+//	GET /free_slots?user_ids=1,2&from=2024-05-06&to=2024-05-11&duration=30m
+//		[&tz=Europe/Berlin][&work_start=09:00][&work_end=18:00][&work_days=mon,tue,wed,thu,fri]
+//
+// Only free intervals are returned, so any authenticated user may look up
+// the free time of others.
+func handleFreeSlots(w http.ResponseWriter, r *http.Request) {
+	var userIDs []int
+	for _, s := range strings.Split(r.FormValue("user_ids"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil || id <= 0 {
+			writeError(w, invalidField("user_ids", "invalid user id "+strconv.Quote(s)))
+			return
+		}
+		userIDs = append(userIDs, id)
+	}
+	if len(userIDs) == 0 {
+		writeError(w, invalidField("user_ids", "at least one user id is required"))
+		return
+	}
+
+	loc, err := parseLocation(r.FormValue("tz"))
+	if err != nil {
+		writeError(w, badRequest("invalid tz"))
+		return
+	}
+	from, _, err := parseDateIn(r.FormValue("from"), loc)
+	if err != nil {
+		writeError(w, invalidField("from", "invalid from"))
+		return
+	}
+	to, _, err := parseDateIn(r.FormValue("to"), loc)
+	if err != nil || !to.After(from) {
+		writeError(w, invalidField("to", "invalid to"))
+		return
+	}
+	if to.Sub(from) > maxFreeSlotsRange {
+		writeError(w, invalidField("to", "range is longer than 92 days"))
+		return
+	}
+	duration, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || duration <= 0 {
+		writeError(w, invalidField("duration", "invalid duration"))
+		return
+	}
+
+	hours := workingHours{Start: 9 * time.Hour, End: 18 * time.Hour}
+	if s := r.FormValue("work_start"); s != "" {
+		if hours.Start, err = parseClock(s); err != nil {
+			writeError(w, invalidField("work_start", "invalid work_start"))
+			return
+		}
+	}
+	if s := r.FormValue("work_end"); s != "" {
+		if hours.End, err = parseClock(s); err != nil {
+			writeError(w, invalidField("work_end", "invalid work_end"))
+			return
+		}
+	}
+	if hours.End <= hours.Start {
+		writeError(w, invalidField("work_end", "work_end must be after work_start"))
+		return
+	}
+	days := r.FormValue("work_days")
+	if days == "" {
+		days = "mon,tue,wed,thu,fri"
+	}
+	for _, s := range strings.Split(days, ",") {
+		day, err := parseWeekday(strings.TrimSpace(s))
+		if err != nil {
+			writeError(w, invalidField("work_days", "invalid weekday "+strconv.Quote(s)))
+			return
+		}
+		hours.Weekdays[day] = true
+	}
+
+	writeJSON(w, http.StatusOK, calendar.FreeSlots(userIDs, from, to, hours, duration))
+}
+
+// parseClock parses a time of day such as 09:30 into the offset from
+// midnight. 24:00 stands for the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreateEventConflicts(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 5, day, hour, minute, 0, 0, time.UTC)
+	}
+	meeting, err := c.CreateEvent(0, Event{Title: "meeting", UserID: 1, Date: at(6, 10, 0), End: at(6, 11, 0)}, RejectConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standup, err := c.CreateEvent(0, Event{Title: "standup", UserID: 1, Date: at(6, 9, 0), End: at(6, 9, 15), RRule: "FREQ=DAILY"}, RejectConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		event    Event
+		expected []int
+	}{
+		{"overlaps the meeting", Event{UserID: 1, Date: at(6, 10, 30), End: at(6, 11, 30)}, []int{meeting.ID}},
+		{"ends when the meeting starts", Event{UserID: 1, Date: at(6, 9, 30), End: at(6, 10, 0)}, nil},
+		{"starts when the meeting ends", Event{UserID: 1, Date: at(6, 11, 0), End: at(6, 12, 0)}, nil},
+		{"other user", Event{UserID: 2, Date: at(6, 10, 0), End: at(6, 11, 0)}, nil},
+		{"hits an occurrence", Event{UserID: 1, Date: at(20, 9, 10), End: at(20, 9, 40)}, []int{standup.ID}},
+		{"recurring against a single event", Event{UserID: 1, Date: time.Date(2024, 4, 29, 10, 45, 0, 0, time.UTC),
+			End: time.Date(2024, 4, 29, 11, 15, 0, 0, time.UTC), RRule: "FREQ=WEEKLY"}, []int{meeting.ID}},
+		{"the meeting itself", meeting, nil},
+	}
+
+	for _, tt := range tests {
+		if tt.expected == nil {
+			if conflicts := c.Conflicts(tt.event); len(conflicts) != 0 {
+				t.Errorf("%s: got conflicts %v, expected none", tt.name, conflicts)
+			}
+			continue
+		}
+		_, err := c.CreateEvent(0, tt.event, RejectConflicts)
+		var conflictErr *conflictError
+		if !errors.As(err, &conflictErr) || !errors.Is(err, errEventConflict) {
+			t.Errorf("%s: error = %v, expected a conflict", tt.name, err)
+			continue
+		}
+		if len(conflictErr.Conflicts) != len(tt.expected) || conflictErr.Conflicts[0].ID != tt.expected[0] {
+			t.Errorf("%s: got conflicts %v, expected ids %v", tt.name, conflictErr.Conflicts, tt.expected)
+		}
+	}
+
+	if _, err := c.CreateEvent(0, Event{UserID: 1, Date: at(6, 10, 0), End: at(6, 11, 0)}, AllowConflicts); err != nil {
+		t.Errorf("AllowConflicts: unexpected error %v", err)
+	}
+}
+
+func TestFreeSlots(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	c := NewCalendar(newMemoryStore())
+	add := func(userID int, start, end time.Time) {
+		if _, err := c.CreateEvent(0, Event{Title: "busy", UserID: userID, Date: start.UTC(), End: end.UTC()}, AllowConflicts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, berlin)
+	}
+	// Friday 29 March, Monday 1 April and the DST change on Sunday 31 March.
+	add(1, at(29, 9, 0), at(29, 10, 0))
+	add(2, at(29, 9, 30), at(29, 11, 0))
+	add(1, at(29, 12, 0), at(29, 12, 20))
+	add(2, at(29, 16, 0), at(30, 10, 0))
+	add(3, at(29, 13, 0), at(29, 14, 0))
+
+	hours := workingHours{Start: 9 * time.Hour, End: 18 * time.Hour}
+	for day := time.Monday; day <= time.Friday; day++ {
+		hours.Weekdays[day] = true
+	}
+	slots := c.FreeSlots([]int{1, 2}, at(29, 0, 0), time.Date(2024, 4, 2, 0, 0, 0, 0, berlin), hours, 30*time.Minute)
+
+	expected := []Slot{
+		{at(29, 11, 0), at(29, 12, 0)},
+		{at(29, 12, 20), at(29, 16, 0)},
+		{time.Date(2024, 4, 1, 9, 0, 0, 0, berlin), time.Date(2024, 4, 1, 18, 0, 0, 0, berlin)},
+	}
+	if len(slots) != len(expected) {
+		t.Fatalf("got slots %v, expected %v", slots, expected)
+	}
+	for i := range slots {
+		if !slots[i].Start.Equal(expected[i].Start) || !slots[i].End.Equal(expected[i].End) {
+			t.Errorf("slot %d is %v, expected %v", i, slots[i], expected[i])
+		}
+	}
+}
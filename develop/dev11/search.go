@@ -0,0 +1,280 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// normalizeTags lower-cases the tags and drops empty ones and duplicates.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// hasTags reports whether the event carries all the tags.
+func (e Event) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, own := range e.Tags {
+			found = found || own == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits text into lower-case words of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// A word of the title counts as much as titleWeight words of the
+// description.
+const titleWeight = 3
+
+// The parameters of the BM25 ranking: bm25K1 is how quickly repeating a
+// word stops raising the score and bm25B how much long texts are
+// penalised.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// termWeights counts the words of the title and the description of an
+// event, weighted by where they occur, and returns the weighted length.
+func termWeights(event Event) (map[string]int, int) {
+	weights := make(map[string]int)
+	length := 0
+	for _, term := range tokenize(event.Title) {
+		weights[term] += titleWeight
+		length += titleWeight
+	}
+	for _, term := range tokenize(event.Description) {
+		weights[term]++
+		length++
+	}
+	return weights, length
+}
+
+// textIndex is an inverted index from the words of the titles and
+// descriptions to the events containing them. Like eventIndex it is
+// guarded by the lock of the calendar.
+type textIndex struct {
+	postings map[string]map[int]int
+	lengths  map[int]int
+	total    int
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{postings: make(map[string]map[int]int), lengths: make(map[int]int)}
+}
+
+func (t *textIndex) add(event Event) {
+	weights, length := termWeights(event)
+	for term, weight := range weights {
+		if t.postings[term] == nil {
+			t.postings[term] = make(map[int]int)
+		}
+		t.postings[term][event.ID] = weight
+	}
+	t.lengths[event.ID] = length
+	t.total += length
+}
+
+// remove takes out the event as it was added.
+func (t *textIndex) remove(event Event) {
+	weights, _ := termWeights(event)
+	for term := range weights {
+		delete(t.postings[term], event.ID)
+		if len(t.postings[term]) == 0 {
+			delete(t.postings, term)
+		}
+	}
+	t.total -= t.lengths[event.ID]
+	delete(t.lengths, event.ID)
+}
+
+// match returns the BM25 scores of the events containing every term.
+func (t *textIndex) match(terms []string) map[int]float64 {
+	if len(terms) == 0 {
+		return nil
+	}
+	// Intersecting from the rarest term keeps the candidates few.
+	sort.Slice(terms, func(i, j int) bool { return len(t.postings[terms[i]]) < len(t.postings[terms[j]]) })
+
+	n := float64(len(t.lengths))
+	average := float64(t.total) / math.Max(n, 1)
+	scores := make(map[int]float64)
+	for i, term := range terms {
+		postings := t.postings[term]
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		next := make(map[int]float64)
+		for id, weight := range postings {
+			score, ok := scores[id]
+			if !ok && i > 0 {
+				continue
+			}
+			tf := float64(weight)
+			norm := 1 - bm25B + bm25B*float64(t.lengths[id])/average
+			next[id] = score + idf*tf*(bm25K1+1)/(tf+bm25K1*norm)
+		}
+		scores = next
+	}
+	return scores
+}
+
+// SearchQuery selects the events Search returns. Every word of Text must
+// occur in the title or the description; an event must also carry all
+// Tags, show up in the calendar of UserID when it is set and occur in
+// [Start, End) when those are set.
+type SearchQuery struct {
+	Text       string
+	UserID     int
+	Tags       []string
+	Start, End time.Time
+}
+
+// SearchResult is an event found by Search with its relevance.
+type SearchResult struct {
+	Score float64 `json:"score"`
+	Event Event   `json:"event"`
+}
+
+// Search returns the matching events, the most relevant first. Without
+// words every event carrying the tags matches, in the order of their
+// start.
+func (c *Calendar) Search(q SearchQuery) []SearchResult {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	terms := normalizeTags(tokenize(q.Text))
+	var scores map[int]float64
+	if len(terms) > 0 {
+		scores = c.index.text.match(terms)
+	} else {
+		scores = make(map[int]float64, len(c.index.indexed))
+		for id := range c.index.indexed {
+			scores[id] = 0
+		}
+	}
+
+	start, end := q.Start, q.End
+	if start.IsZero() {
+		start = minEventDate
+	}
+	if end.IsZero() {
+		end = maxEventDate
+	}
+	tags := normalizeTags(q.Tags)
+	results := []SearchResult{}
+	for id, score := range scores {
+		event := c.index.indexed[id]
+		if q.UserID != 0 && !event.inCalendarOf(q.UserID) {
+			continue
+		}
+		if !event.hasTags(tags) {
+			continue
+		}
+		if (!q.Start.IsZero() || !q.End.IsZero()) && !event.occursBetween(start, end) {
+			continue
+		}
+		results = append(results, SearchResult{Score: math.Round(score*1000) / 1000, Event: event})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.Event.Date.Equal(b.Event.Date) {
+			return a.Event.Date.Before(b.Event.Date)
+		}
+		return a.Event.ID < b.Event.ID
+	})
+	return results
+}
+
+// defaultSearchLimit is the number of results of a search without limit.
+const defaultSearchLimit = 50
+
+// handleSearch finds events by the words of their title and description:
+//
+//	GET /search?q=design+review[&tag=work,urgent][&user_id=1]
+//		[&from=2024-05-01][&to=2024-06-01][&tz=Europe/Berlin][&limit=20]
+//
+// Either q or tag is required. Tags may also be given as repeated tag
+// parameters; an event must carry all of them.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := SearchQuery{Text: query.Get("q")}
+	for _, tags := range query["tag"] {
+		q.Tags = append(q.Tags, strings.Split(tags, ",")...)
+	}
+	q.Tags = normalizeTags(q.Tags)
+	if len(tokenize(q.Text)) == 0 && len(q.Tags) == 0 {
+		writeError(w, invalidField("q", "q or tag is required"))
+		return
+	}
+	if userIDStr := query.Get("user_id"); userIDStr != "" {
+		id, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			writeError(w, badRequest("invalid user_id"))
+			return
+		}
+		q.UserID = id
+	}
+
+	loc, err := parseLocation(query.Get("tz"))
+	if err != nil {
+		writeError(w, badRequest("invalid tz"))
+		return
+	}
+	if fromStr := query.Get("from"); fromStr != "" {
+		if q.Start, _, err = parseDateIn(fromStr, loc); err != nil {
+			writeError(w, badRequest("invalid from"))
+			return
+		}
+	}
+	if toStr := query.Get("to"); toStr != "" {
+		if q.End, _, err = parseDateIn(toStr, loc); err != nil || (!q.Start.IsZero() && !q.End.After(q.Start)) {
+			writeError(w, badRequest("invalid to"))
+			return
+		}
+	}
+	limit := defaultSearchLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			writeError(w, badRequest("invalid limit"))
+			return
+		}
+	}
+
+	results := []SearchResult{}
+	for _, result := range calendar.Search(q) {
+		if len(results) == limit {
+			break
+		}
+		if canView(r, result.Event) {
+			results = append(results, result)
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
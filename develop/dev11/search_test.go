@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"Design review", []string{"design", "review"}},
+		{"Q3 planning: budget & roadmap!", []string{"q3", "planning", "budget", "roadmap"}},
+		{"Встреча с командой", []string{"встреча", "с", "командой"}},
+		{"  ", []string{}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("tokenize(%q) = %q, expected %q", tt.text, got, tt.expected)
+		}
+	}
+}
+
+// ids returns the IDs of the results in order.
+func ids(results []SearchResult) []int {
+	ids := []int{}
+	for _, result := range results {
+		ids = append(ids, result.Event.ID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	c := NewCalendar(newMemoryStore())
+	day := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	for _, event := range []Event{
+		{Title: "Design review", Description: "Review the new design of the calendar", UserID: 1, Date: day.Add(10 * time.Hour), Tags: []string{"work"}},
+		{Title: "Lunch", Description: "Talk about the design of the garden", UserID: 2, Date: day.Add(12 * time.Hour)},
+		{Title: "Design sync", UserID: 1, Date: day.AddDate(0, 0, 7), Tags: []string{"Work", "urgent", "work"},
+			Attendees: []Attendee{{UserID: 3}}},
+		{Title: "Standup", Description: "Daily design notes", UserID: 1, Date: day.Add(9 * time.Hour), RRule: "FREQ=DAILY;COUNT=30"},
+	} {
+		if _, err := c.CreateEvent(0, event, AllowConflicts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    SearchQuery
+		expected []int
+	}{
+		{"title words rank first", SearchQuery{Text: "design"}, []int{3, 1, 4, 2}},
+		{"every word must match", SearchQuery{Text: "REVIEW design"}, []int{1}},
+		{"unknown word", SearchQuery{Text: "design budget"}, []int{}},
+		{"tag", SearchQuery{Text: "design", Tags: []string{"WORK"}}, []int{3, 1}},
+		{"tags without words", SearchQuery{Tags: []string{"work", "urgent"}}, []int{3}},
+		{"attendee", SearchQuery{Text: "design", UserID: 3}, []int{3}},
+		{"organizer", SearchQuery{Text: "design", UserID: 2}, []int{2}},
+		{"range", SearchQuery{Text: "design", Start: day.AddDate(0, 0, 1), End: day.AddDate(0, 0, 2)}, []int{4}},
+	}
+	for _, tt := range tests {
+		if got := ids(c.Search(tt.query)); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: found %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+
+	sync, _ := c.GetEvent(3)
+	if !reflect.DeepEqual(sync.Tags, []string{"work", "urgent"}) {
+		t.Errorf("tags %q, expected them normalised", sync.Tags)
+	}
+	update := sync
+	update.Title, update.Tags, update.Version = "Planning", nil, 0
+	if updated, err := c.UpdateEvent(0, 3, update, AllowConflicts); err != nil || !reflect.DeepEqual(updated.Tags, sync.Tags) {
+		t.Fatalf("update without tags: %q, %v", updated.Tags, err)
+	}
+	if got := ids(c.Search(SearchQuery{Text: "design sync"})); len(got) != 0 {
+		t.Errorf("old title still found: %v", got)
+	}
+	if got := ids(c.Search(SearchQuery{Text: "planning"})); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("new title found %v", got)
+	}
+	if err := c.DeleteEvent(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(c.Search(SearchQuery{Text: "review"})); len(got) != 0 {
+		t.Errorf("deleted event still found: %v", got)
+	}
+	if _, err := c.RestoreEvent(0, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(c.Search(SearchQuery{Text: "review"})); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("restored event found %v", got)
+	}
+}
+
+func TestTags(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/v1/events", `{"title":"review","user_id":1,"date":"2024-05-06T10:00:00Z","tags":["Work"," team ",""]}`)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"tags":["work","team"]`) {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+		tags   string
+	}{
+		{http.MethodPatch, "/api/v1/events/1", `{"title":"final review"}`, http.StatusOK, `"tags":["work","team"]`},
+		{http.MethodPatch, "/api/v1/events/1", `{"tags":"work, urgent"}`, http.StatusOK, `"tags":["work","urgent"]`},
+		{http.MethodPatch, "/api/v1/events/1", `{"tags":["` + strings.Repeat("a", 51) + `"]}`, http.StatusUnprocessableEntity, `"field":"tags"`},
+		{http.MethodPatch, "/api/v1/events/1", `{"tags":[]}`, http.StatusOK, `"version":4`},
+		{http.MethodGet, "/search?tag=work", "", http.StatusOK, `[]`},
+		{http.MethodGet, "/search?q=review&limit=0", "", http.StatusBadRequest, `"invalid limit"`},
+		{http.MethodGet, "/search?q=review&from=2024-05-07&to=2024-05-06", "", http.StatusBadRequest, `"invalid to"`},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target, tt.body)
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.tags) {
+			t.Errorf("%s %s: status %d: %s", tt.method, tt.target, rec.Code, rec.Body)
+		}
+	}
+	if strings.Contains(do(http.MethodGet, "/api/v1/events/1", "").Body.String(), `"tags"`) {
+		t.Error("tags not cleared by an empty list")
+	}
+
+	event := Event{ID: 7, Title: "a", UserID: 1, Date: time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), Tags: []string{"work", "a,b"}}
+	event.End = event.Date
+	var buf bytes.Buffer
+	if err := writeICS(&buf, []Event{event}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `CATEGORIES:work,a\,b`) {
+		t.Errorf("export without CATEGORIES:\n%s", buf.String())
+	}
+	items, err := parseICS(&buf, 1)
+	if err != nil || len(items) != 1 || !reflect.DeepEqual(items[0].Event.Tags, event.Tags) {
+		t.Errorf("imported tags %+v, %v", items, err)
+	}
+
+	var results []SearchResult
+	rec = do(http.MethodGet, "/search?"+url.Values{"q": {"Final"}, "tag": {""}}.Encode(), "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 1 || results[0].Score <= 0 {
+		t.Errorf("search: %s", rec.Body)
+	}
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStore is the storage backend behind Calendar.
+type EventStore interface {
+	Get(id int) (Event, bool)
+	Put(event Event) error
+	Delete(id int) error
+	All() []Event
+	// MaxID returns the largest ID of the events ever put in the store,
+	// deleted and purged ones included.
+	MaxID() int
+
+	// AddRevision appends to the history of an event, which outlives the
+	// event itself until DropHistory forgets it. History returns the
+	// revisions of an event oldest first, Revisions those of all events.
+	AddRevision(revision Revision) error
+	History(eventID int) []Revision
+	Revisions() []Revision
+	DropHistory(eventID int) error
+
+	// Begin starts a transaction over the store.
+	Begin() StoreTx
+
+	// Ping reports whether the store is able to serve requests.
+	Ping() error
+	Close() error
+}
+
+// StoreTx is a transaction of an EventStore. It reads its own writes,
+// which reach the store together on Commit: after a failed Commit, or a
+// crash in the middle of one, the store holds either all of them or none.
+// A transaction that is dropped without Commit leaves the store untouched.
+type StoreTx interface {
+	EventStore
+	Commit() error
+}
+
+// newStore builds the store selected by the -store flag.
+func newStore(kind, dir string, snapshotInterval time.Duration) (EventStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(dir, snapshotInterval)
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	events  map[int]Event
+	history map[int][]Revision
+	maxID   int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{events: make(map[int]Event), history: make(map[int][]Revision)}
+}
+
+func (s *memoryStore) Get(id int) (Event, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	event, ok := s.events[id]
+	return event, ok
+}
+
+func (s *memoryStore) Put(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(event)
+	return nil
+}
+
+// put must be called with s.mu held.
+func (s *memoryStore) put(event Event) {
+	s.events[event.ID] = event
+	if event.ID > s.maxID {
+		s.maxID = event.ID
+	}
+}
+
+func (s *memoryStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+	return nil
+}
+
+func (s *memoryStore) All() []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	events := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		events = append(events, event)
+	}
+	return events
+}
+
+func (s *memoryStore) MaxID() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxID
+}
+
+func (s *memoryStore) AddRevision(revision Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addRevision(revision)
+	return nil
+}
+
+// addRevision appends the revision to the history of its event, or
+// replaces the revision of the same version when there is one already.
+// Must be called with s.mu held.
+func (s *memoryStore) addRevision(revision Revision) {
+	history := s.history[revision.EventID]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Version == revision.Version {
+			history[i] = revision
+			return
+		}
+	}
+	s.history[revision.EventID] = append(history, revision)
+}
+
+func (s *memoryStore) History(eventID int) []Revision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Revision(nil), s.history[eventID]...)
+}
+
+func (s *memoryStore) Revisions() []Revision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var revisions []Revision
+	for _, history := range s.history {
+		revisions = append(revisions, history...)
+	}
+	sortRevisions(revisions)
+	return revisions
+}
+
+func sortRevisions(revisions []Revision) {
+	sort.Slice(revisions, func(i, j int) bool {
+		if revisions[i].EventID != revisions[j].EventID {
+			return revisions[i].EventID < revisions[j].EventID
+		}
+		return revisions[i].Version < revisions[j].Version
+	})
+}
+
+func (s *memoryStore) DropHistory(eventID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.history, eventID)
+	return nil
+}
+
+func (s *memoryStore) Begin() StoreTx {
+	return newStoreTx(s, s.commit)
+}
+
+func (s *memoryStore) commit(records []journalRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		s.apply(record)
+	}
+	return nil
+}
+
+// apply performs a write described by a journal record. Applying a record
+// again changes nothing, so that a journal can be replayed over a snapshot
+// that already holds some of its writes. Must be called with s.mu held.
+func (s *memoryStore) apply(record journalRecord) {
+	switch record.Op {
+	case "put":
+		if record.Event != nil {
+			s.put(*record.Event)
+		}
+	case "delete":
+		delete(s.events, record.ID)
+	case "revision":
+		if record.Revision != nil {
+			s.addRevision(*record.Revision)
+		}
+	case "drop_history":
+		delete(s.history, record.ID)
+	case "batch":
+		for _, nested := range record.Records {
+			s.apply(nested)
+		}
+	}
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// storeTx buffers the writes of a transaction as journal records, which
+// its reads see on top of the store, and hands them to commit at once.
+type storeTx struct {
+	store   EventStore
+	commit  func([]journalRecord) error
+	records []journalRecord
+	// events holds the events written by the transaction, nil for deleted
+	// ones; history the revisions it added and dropped the events whose
+	// earlier history it dropped.
+	events  map[int]*Event
+	history map[int][]Revision
+	dropped map[int]bool
+	maxID   int
+}
+
+func newStoreTx(store EventStore, commit func([]journalRecord) error) *storeTx {
+	return &storeTx{
+		store:   store,
+		commit:  commit,
+		events:  make(map[int]*Event),
+		history: make(map[int][]Revision),
+		dropped: make(map[int]bool),
+	}
+}
+
+// write buffers the records; a nested transaction commits into its parent
+// with it.
+func (t *storeTx) write(records []journalRecord) error {
+	for _, record := range records {
+		t.records = append(t.records, record)
+		switch record.Op {
+		case "put":
+			event := *record.Event
+			t.events[event.ID] = &event
+			if event.ID > t.maxID {
+				t.maxID = event.ID
+			}
+		case "delete":
+			t.events[record.ID] = nil
+		case "revision":
+			t.history[record.Revision.EventID] = append(t.history[record.Revision.EventID], *record.Revision)
+		case "drop_history":
+			t.dropped[record.ID] = true
+			delete(t.history, record.ID)
+		}
+	}
+	return nil
+}
+
+func (t *storeTx) Get(id int) (Event, bool) {
+	if event, written := t.events[id]; written {
+		if event == nil {
+			return Event{}, false
+		}
+		return *event, true
+	}
+	return t.store.Get(id)
+}
+
+func (t *storeTx) Put(event Event) error {
+	return t.write([]journalRecord{{Op: "put", Event: &event}})
+}
+
+func (t *storeTx) Delete(id int) error {
+	return t.write([]journalRecord{{Op: "delete", ID: id}})
+}
+
+func (t *storeTx) All() []Event {
+	var events []Event
+	for _, event := range t.store.All() {
+		if _, written := t.events[event.ID]; !written {
+			events = append(events, event)
+		}
+	}
+	for _, event := range t.events {
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+	return events
+}
+
+func (t *storeTx) MaxID() int {
+	if maxID := t.store.MaxID(); maxID > t.maxID {
+		return maxID
+	}
+	return t.maxID
+}
+
+func (t *storeTx) AddRevision(revision Revision) error {
+	return t.write([]journalRecord{{Op: "revision", Revision: &revision}})
+}
+
+func (t *storeTx) History(eventID int) []Revision {
+	var history []Revision
+	if !t.dropped[eventID] {
+		history = t.store.History(eventID)
+	}
+	return append(history, t.history[eventID]...)
+}
+
+func (t *storeTx) Revisions() []Revision {
+	var revisions []Revision
+	for _, revision := range t.store.Revisions() {
+		if !t.dropped[revision.EventID] {
+			revisions = append(revisions, revision)
+		}
+	}
+	for _, history := range t.history {
+		revisions = append(revisions, history...)
+	}
+	sortRevisions(revisions)
+	return revisions
+}
+
+func (t *storeTx) DropHistory(eventID int) error {
+	return t.write([]journalRecord{{Op: "drop_history", ID: eventID}})
+}
+
+func (t *storeTx) Begin() StoreTx {
+	return newStoreTx(t, t.write)
+}
+
+// Commit hands the buffered writes to the store. A transaction without
+// writes commits nothing.
+func (t *storeTx) Commit() error {
+	if len(t.records) == 0 {
+		return nil
+	}
+	records := t.records
+	t.records = nil
+	return t.commit(records)
+}
+
+func (t *storeTx) Ping() error {
+	return t.store.Ping()
+}
+
+// Close discards the transaction; the store stays open.
+func (t *storeTx) Close() error {
+	return nil
+}
+
+const (
+	journalFile   = "events.journal"
+	snapshotFile  = "events.snapshot"
+	snapshotEvery = 1000
+)
+
+// journalRecord is a single line of the journal. Every line is prefixed
+// with the CRC32 of its JSON payload so a torn write can be detected. A
+// batch record carries the records of a transaction.
+type journalRecord struct {
+	Op       string          `json:"op"`
+	Event    *Event          `json:"event,omitempty"`
+	Revision *Revision       `json:"revision,omitempty"`
+	ID       int             `json:"id"`
+	Records  []journalRecord `json:"records,omitempty"`
+}
+
+// snapshotData is the content of a snapshot. Snapshots written before
+// events had a history are a bare array of events; those written before
+// MaxID was kept leave it to be found from the events and their history.
+type snapshotData struct {
+	Events  []Event    `json:"events"`
+	History []Revision `json:"history"`
+	MaxID   int        `json:"max_id,omitempty"`
+}
+
+// fileStore keeps events in memory and persists them as an append-only
+// journal that is periodically compacted into a snapshot.
+type fileStore struct {
+	*memoryStore
+
+	dir      string
+	mu       sync.Mutex
+	journal  *os.File
+	appended int
+	// failed is the error of the last journal write, if it failed. torn is
+	// set when the partial line a failed write may have left could not be
+	// cut off; the journal then takes no more writes until a snapshot has
+	// replaced it, as replaying stops at the partial line.
+	failed error
+	torn   bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func openFileStore(dir string, snapshotInterval time.Duration) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		dir:         dir,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	if snapshotInterval > 0 {
+		go s.snapshotLoop(snapshotInterval)
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+func (s *fileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot snapshotData
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &snapshot.Events)
+	} else {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		return fmt.Errorf("corrupted snapshot: %w", err)
+	}
+	s.maxID = snapshot.MaxID
+	for _, event := range snapshot.Events {
+		s.put(event)
+	}
+	for _, revision := range snapshot.History {
+		s.addRevision(revision)
+		if revision.EventID > s.maxID {
+			s.maxID = revision.EventID
+		}
+	}
+	return nil
+}
+
+// replayJournal applies every intact record of the journal and cuts off
+// the tail starting at the first damaged one, which can only be the
+// result of a crash in the middle of a write.
+func (s *fileStore) replayJournal() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, journalFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		record, ok := decodeJournalLine(line)
+		if !ok {
+			break
+		}
+		s.apply(record)
+		offset += int64(len(line))
+		s.appended++
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.journal = f
+	return nil
+}
+
+func decodeJournalLine(line []byte) (journalRecord, bool) {
+	var record journalRecord
+	text := strings.TrimSuffix(string(line), "\n")
+	sum, payload, found := strings.Cut(text, " ")
+	if !found {
+		return record, false
+	}
+	want, err := strconv.ParseUint(sum, 16, 32)
+	if err != nil || crc32.ChecksumIEEE([]byte(payload)) != uint32(want) {
+		return record, false
+	}
+	if err := json.Unmarshal([]byte(payload), &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func (s *fileStore) Put(event Event) error {
+	return s.write(journalRecord{Op: "put", Event: &event})
+}
+
+func (s *fileStore) Delete(id int) error {
+	return s.write(journalRecord{Op: "delete", ID: id})
+}
+
+func (s *fileStore) AddRevision(revision Revision) error {
+	return s.write(journalRecord{Op: "revision", Revision: &revision})
+}
+
+func (s *fileStore) DropHistory(eventID int) error {
+	return s.write(journalRecord{Op: "drop_history", ID: eventID})
+}
+
+func (s *fileStore) Begin() StoreTx {
+	return newStoreTx(s, s.commit)
+}
+
+// commit writes the records of a transaction as a single journal record,
+// so that a torn write loses all of them.
+func (s *fileStore) commit(records []journalRecord) error {
+	return s.write(journalRecord{Op: "batch", Records: records})
+}
+
+// write appends the record to the journal and then applies it in memory.
+// Only then may a snapshot replace the journal, as it is taken from what
+// is in memory.
+func (s *fileStore) write(record journalRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(record); err != nil {
+		return err
+	}
+	s.memoryStore.mu.Lock()
+	s.memoryStore.apply(record)
+	s.memoryStore.mu.Unlock()
+
+	s.appended++
+	if s.appended >= snapshotEvery {
+		if err := s.snapshot(); err != nil {
+			slog.Error("Не удалось сохранить снимок", "error", err)
+		}
+	}
+	return nil
+}
+
+// append writes the record to the journal. Must be called with s.mu held.
+func (s *fileStore) append(record journalRecord) error {
+	if s.torn {
+		if err := s.snapshot(); err != nil {
+			s.failed = fmt.Errorf("journal damaged by a failed write: %w", err)
+			return s.failed
+		}
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	offset, err := s.journal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		s.failed = fmt.Errorf("journal seek: %w", err)
+		return s.failed
+	}
+	if _, err := s.journal.WriteString(line); err != nil {
+		return s.rewind(offset, fmt.Errorf("journal write: %w", err))
+	}
+	if err := s.journal.Sync(); err != nil {
+		return s.rewind(offset, fmt.Errorf("journal sync: %w", err))
+	}
+	s.failed = nil
+	return nil
+}
+
+// rewind cuts off what a failed write left in the journal after offset,
+// where it started, so that the writes that follow are not lost behind a
+// partial line. It returns the error of the write.
+func (s *fileStore) rewind(offset int64, err error) error {
+	s.failed = err
+	if terr := s.journal.Truncate(offset); terr != nil {
+		s.torn = true
+		return err
+	}
+	if _, serr := s.journal.Seek(offset, io.SeekStart); serr != nil {
+		s.torn = true
+	}
+	return err
+}
+
+// snapshot writes the current state to a temporary file, atomically
+// renames it over the previous snapshot and only then empties the journal.
+// After a crash between the two the whole journal is replayed over the
+// snapshot that already holds it; as every record applies idempotently,
+// revisions included, this leaves the same state behind. Must be called
+// with s.mu held.
+func (s *fileStore) snapshot() error {
+	data, err := json.Marshal(snapshotData{
+		Events:  s.memoryStore.All(),
+		History: s.memoryStore.Revisions(),
+		MaxID:   s.memoryStore.MaxID(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.appended = 0
+	s.torn = false
+	return s.journal.Sync()
+}
+
+func (s *fileStore) snapshotLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.appended > 0 || s.torn {
+				if err := s.snapshot(); err != nil {
+					slog.Error("Не удалось сохранить снимок", "error", err)
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Ping fails once the store is closed, while the last journal write is
+// failing, or when the journal file has gone missing.
+func (s *fileStore) Ping() error {
+	select {
+	case <-s.stop:
+		return fmt.Errorf("store is closed")
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, journalFile)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	select {
+	case <-s.stop:
+		return nil
+	default:
+		close(s.stop)
+	}
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.snapshot()
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
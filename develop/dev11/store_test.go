@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// crashAfterSnapshot snapshots the store and then puts back the journal as
+// it was before, like a crash between the rename of the snapshot and the
+// truncation of the journal leaves them.
+func crashAfterSnapshot(t *testing.T, store *fileStore) {
+	t.Helper()
+	journal := filepath.Join(store.dir, journalFile)
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	err = store.snapshot()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.journal.Close()
+	if err := os.WriteFile(journal, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotCrashReplay(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCalendar(store)
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	event, _ := c.CreateEvent(1, Event{Title: "v1", UserID: 1, Date: date}, AllowConflicts)
+	event.Title = "v2"
+	if _, err := c.UpdateEvent(1, event.ID, event, AllowConflicts); err != nil {
+		t.Fatal(err)
+	}
+	// The revisions of a batch are nested in a single journal record.
+	if _, err := c.Batch(1, []BatchOp{
+		{Op: "update", ID: event.ID, Event: Event{Title: "v3", UserID: 1, Date: date}},
+	}, true, func(int) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	crashAfterSnapshot(t, store)
+
+	reopened, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	c = NewCalendar(reopened)
+	history, err := c.History(event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ops(history); got != "1 create, 2 update, 3 update" {
+		t.Fatalf("history after the replay = %s", got)
+	}
+
+	restored, err := c.RestoreEvent(1, event.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "v2" || restored.Version != 4 {
+		t.Errorf("restored event = %+v", restored)
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	store, err := newStore("memory", "", 0)
+	if _, ok := store.(*memoryStore); !ok || err != nil {
+		t.Errorf("memory store: %T, %v", store, err)
+	}
+	store, err = newStore("file", t.TempDir(), 0)
+	if _, ok := store.(*fileStore); !ok || err != nil {
+		t.Errorf("file store: %T, %v", store, err)
+	}
+	if store != nil {
+		store.Close()
+	}
+	if _, err := newStore("sql", "", 0); err == nil {
+		t.Errorf("unknown store accepted")
+	}
+}
+
+// journalLines returns the number of records in the journal of the store.
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	store.Put(Event{ID: 1, Title: "first", Date: date})
+	store.Put(Event{ID: 2, Title: "second", Date: date})
+	store.AddRevision(Revision{EventID: 3, Version: 1, Op: "create"})
+
+	// The writes so far go into the snapshot, the following ones stay in
+	// the journal.
+	store.mu.Lock()
+	err = store.snapshot()
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := journalLines(t, dir); n != 0 {
+		t.Fatalf("%d records left in the journal after the snapshot", n)
+	}
+	store.Put(Event{ID: 1, Title: "renamed", Date: date})
+	store.Delete(2)
+	store.AddRevision(Revision{EventID: 1, Version: 1, Op: "create"})
+	store.DropHistory(3)
+	if n := journalLines(t, dir); n != 4 {
+		t.Fatalf("%d records in the journal, expected 4", n)
+	}
+	store.journal.Close()
+
+	reopened, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if event, ok := reopened.Get(1); !ok || event.Title != "renamed" {
+		t.Errorf("event 1 = %+v, %v", event, ok)
+	}
+	if _, ok := reopened.Get(2); ok {
+		t.Errorf("deleted event 2 replayed")
+	}
+	if history := reopened.History(1); len(history) != 1 {
+		t.Errorf("history of event 1 = %+v", history)
+	}
+	if history := reopened.History(3); len(history) != 0 {
+		t.Errorf("dropped history of event 3 = %+v", history)
+	}
+}
+
+func TestFileStoreSnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	for id := 1; id <= snapshotEvery; id++ {
+		if err := store.Put(Event{ID: id, Title: fmt.Sprint("event ", id), Date: date}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last write triggered the snapshot, which emptied the journal.
+	if n := journalLines(t, dir); n != 0 {
+		t.Fatalf("%d records in the journal, expected a snapshot", n)
+	}
+	store.journal.Close()
+
+	reopened, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if event, ok := reopened.Get(snapshotEvery); !ok || event.Title != fmt.Sprint("event ", snapshotEvery) {
+		t.Errorf("last event before the snapshot = %+v, %v", event, ok)
+	}
+	if n := len(reopened.All()); n != snapshotEvery {
+		t.Errorf("%d events after reopening, expected %d", n, snapshotEvery)
+	}
+}
+
+func TestFileStoreDamagedJournal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		store.Put(Event{ID: id, Title: "event", Date: time.Date(2024, 5, id, 10, 0, 0, 0, time.UTC)})
+	}
+	store.journal.Close()
+	data, err := os.ReadFile(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// Everything from the first damaged record on is cut off.
+	tests := []struct {
+		name    string
+		journal string
+		events  int
+	}{
+		{"intact", string(data), 3},
+		{"torn last record", string(data[:len(data)-10]), 2},
+		{"bad checksum", lines[0] + lines[1] + "0" + lines[2][1:], 2},
+		{"damaged middle record", lines[0] + strings.Replace(lines[1], "event", "evil!", 1) + lines[2], 1},
+		{"garbage", "not a journal\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, journalFile), []byte(tt.journal), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			store, err := openFileStore(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if events := store.All(); len(events) != tt.events {
+				t.Fatalf("%d events replayed, expected %d", len(events), tt.events)
+			}
+			// Writes after the cut are not lost behind the damage.
+			if err := store.Put(Event{ID: 9, Title: "after", Date: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			store.journal.Close()
+
+			reopened, err := openFileStore(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if _, ok := reopened.Get(9); !ok || len(reopened.All()) != tt.events+1 {
+				t.Errorf("%d events after the write following the cut", len(reopened.All()))
+			}
+		})
+	}
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	if err := store.Put(Event{ID: 1, Title: "kept", Date: date}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the file size limited the write stops in the middle of the
+	// record; SIGXFSZ is ignored by the Go runtime.
+	info, err := store.journal.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	short := limit
+	short.Cur = uint64(info.Size()) + 20
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &short); err != nil {
+		t.Skip("cannot limit the file size:", err)
+	}
+	err = store.Put(Event{ID: 2, Title: "failed", Date: date})
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err == nil {
+		t.Fatal("write beyond the file size limit succeeded")
+	}
+	if store.Ping() == nil {
+		t.Errorf("Ping succeeded after a failed write")
+	}
+	if _, ok := store.Get(2); ok {
+		t.Errorf("failed write is visible")
+	}
+	if err := store.Put(Event{ID: 3, Title: "after", Date: date}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping after a successful write: %v", err)
+	}
+
+	// A failed write that cannot be cut off stops the journal until a
+	// snapshot replaces it.
+	journal := store.journal
+	store.journal, err = os.Open(filepath.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(Event{ID: 4, Title: "failed", Date: date}); err == nil || !store.torn {
+		t.Fatalf("write to a read-only journal: error %v, torn %v", err, store.torn)
+	}
+	store.journal.Close()
+	store.journal = journal
+	if err := store.Put(Event{ID: 5, Title: "after snapshot", Date: date}); err != nil {
+		t.Fatal(err)
+	}
+	if n := journalLines(t, dir); n != 1 {
+		t.Errorf("%d records in the journal after the snapshot, expected 1", n)
+	}
+	store.journal.Close()
+
+	reopened, err := openFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	var ids []int
+	for _, event := range reopened.All() {
+		ids = append(ids, event.ID)
+	}
+	sort.Ints(ids)
+	if fmt.Sprint(ids) != "[1 3 5]" {
+		t.Errorf("events after reopening: %v, expected [1 3 5]", ids)
+	}
+}
@@ -1,210 +1,891 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type Event struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      int       `json:"user_id"`
-	Date        time.Time `json:"date"`
-}
-
-type Calendar struct {
-	events map[int]Event
-}
-
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.RequestURI, time.Since(start))
-	})
-}
-
 func handleCreateEvent(w http.ResponseWriter, r *http.Request) {
 	var event Event
-	err := parseEvent(r, &event)
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	defaultOwner(r, r.Form)
+	if err := parseEvent(r.Form, &event); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !canAccess(r, event.UserID) {
+		writeError(w, errForbidden)
+		return
+	}
+	policy, err := parseConflictPolicy(r.Form)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	created, err := calendar.CreateEvent(actorOf(r), event, policy)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	calendar.CreateEvent(event)
-	writeJSON(w, http.StatusOK, map[string]string{"result": "event created"})
+	setETag(w, created)
+	response := map[string]interface{}{"result": "event created", "event": created}
+	if conflicts := warnConflicts(w, created); len(conflicts) > 0 {
+		response["conflicts"] = conflicts
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
 func handleUpdateEvent(w http.ResponseWriter, r *http.Request) {
 	var event Event
-	err := parseEvent(r, &event)
-	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusBadRequest)
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	defaultOwner(r, r.Form)
+	if err := parseEvent(r.Form, &event); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	id, err := strconv.Atoi(r.FormValue("id"))
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		writeError(w, invalidField("id", "invalid event id"))
+		return
+	}
+	if err := authorizeChange(r, id, event.UserID); err != nil {
+		writeError(w, err)
+		return
+	}
+	policy, err := parseConflictPolicy(r.Form)
 	if err != nil {
-		http.Error(w, `{"error": "invalid event id"}`, http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+	if event.Version, err = ifMatch(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if occurrenceStr := r.Form.Get("occurrence"); occurrenceStr != "" {
+		occurrence, err := parseDate(occurrenceStr)
+		if err != nil {
+			writeError(w, invalidField("occurrence", "invalid occurrence"))
+			return
+		}
+		detached, err := calendar.UpdateOccurrence(actorOf(r), id, occurrence, event, policy)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		setETag(w, detached)
+		response := map[string]interface{}{"result": "occurrence updated", "event": detached}
+		if conflicts := warnConflicts(w, detached); len(conflicts) > 0 {
+			response["conflicts"] = conflicts
+		}
+		writeJSON(w, http.StatusOK, response)
 		return
 	}
 
-	err = calendar.UpdateEvent(id, event)
+	updated, err := calendar.UpdateEvent(actorOf(r), id, event, policy)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusServiceUnavailable)
+		writeError(w, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"result": "event updated"})
+	setETag(w, updated)
+	response := map[string]interface{}{"result": "event updated", "event": updated}
+	if conflicts := warnConflicts(w, updated); len(conflicts) > 0 {
+		response["conflicts"] = conflicts
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
 func handleDeleteEvent(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(r.FormValue("id"))
+	if err := parseRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	id, err := strconv.Atoi(r.Form.Get("id"))
 	if err != nil {
-		http.Error(w, `{"error": "invalid event id"}`, http.StatusBadRequest)
+		writeError(w, invalidField("id", "invalid event id"))
 		return
 	}
-
-	err = calendar.DeleteEvent(id)
+	if err := authorizeChange(r, id, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := ifMatch(r, id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusServiceUnavailable)
+		writeError(w, err)
+		return
+	}
+
+	if occurrenceStr := r.Form.Get("occurrence"); occurrenceStr != "" {
+		occurrence, err := parseDate(occurrenceStr)
+		if err != nil {
+			writeError(w, invalidField("occurrence", "invalid occurrence"))
+			return
+		}
+		if err := calendar.DeleteOccurrence(actorOf(r), id, occurrence, version); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "occurrence deleted"})
+		return
+	}
+
+	if err := calendar.DeleteEvent(actorOf(r), id, version); err != nil {
+		writeError(w, err)
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"result": "event deleted"})
 }
 
 func handleGetEventsForDay(w http.ResponseWriter, r *http.Request) {
-	date, err := parseDate(r.FormValue("date"))
+	loc, err := parseLocation(r.FormValue("tz"))
+	if err != nil {
+		writeError(w, badRequest("invalid tz"))
+		return
+	}
+	date, _, err := parseDateIn(r.FormValue("date"), loc)
 	if err != nil {
-		http.Error(w, `{"error": "invalid date"}`, http.StatusBadRequest)
+		writeError(w, badRequest("invalid date"))
 		return
 	}
-	events := calendar.GetEventsForDay(date)
-	writeJSON(w, http.StatusOK, events)
+	start := startOfDay(date)
+	serveQuery(w, r, EventQuery{Start: start, End: start.AddDate(0, 0, 1)})
 }
 
 func handleGetEventsForWeek(w http.ResponseWriter, r *http.Request) {
-	date, err := parseDate(r.FormValue("date"))
+	loc, err := parseLocation(r.FormValue("tz"))
 	if err != nil {
-		http.Error(w, `{"error": "invalid date"}`, http.StatusBadRequest)
+		writeError(w, badRequest("invalid tz"))
 		return
 	}
-	events := calendar.GetEventsForWeek(date)
-	writeJSON(w, http.StatusOK, events)
+
+	var date time.Time
+	if week := r.FormValue("week"); week != "" {
+		date, err = parseISOWeek(week, loc)
+		if err != nil {
+			writeError(w, badRequest("invalid week"))
+			return
+		}
+	} else {
+		date, _, err = parseDateIn(r.FormValue("date"), loc)
+		if err != nil {
+			writeError(w, badRequest("invalid date"))
+			return
+		}
+	}
+
+	firstDay := calendar.WeekStart
+	if weekStart := r.FormValue("week_start"); weekStart != "" {
+		firstDay, err = parseWeekday(weekStart)
+		if err != nil {
+			writeError(w, badRequest("invalid week_start"))
+			return
+		}
+	}
+	start, end := weekWindow(date, firstDay)
+	serveQuery(w, r, EventQuery{Start: start, End: end})
 }
 
 func handleGetEventsForMonth(w http.ResponseWriter, r *http.Request) {
-	date, err := parseDate(r.FormValue("date"))
+	loc, err := parseLocation(r.FormValue("tz"))
 	if err != nil {
-		http.Error(w, `{"error": "invalid date"}`, http.StatusBadRequest)
+		writeError(w, badRequest("invalid tz"))
 		return
 	}
-	events := calendar.GetEventsForMonth(date)
-	writeJSON(w, http.StatusOK, events)
+	date, _, err := parseDateIn(r.FormValue("date"), loc)
+	if err != nil {
+		writeError(w, badRequest("invalid date"))
+		return
+	}
+	start, end := monthWindow(date)
+	serveQuery(w, r, EventQuery{Start: start, End: end})
 }
 
-func parseEvent(r *http.Request, event *Event) error {
-	event.Title = r.FormValue("title")
-	event.Description = r.FormValue("description")
-	userID, err := strconv.Atoi(r.FormValue("user_id"))
+func handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	loc, err := parseLocation(r.FormValue("tz"))
 	if err != nil {
-		return fmt.Errorf("invalid user_id")
+		writeError(w, badRequest("invalid tz"))
+		return
+	}
+	from, _, err := parseDateIn(r.FormValue("from"), loc)
+	if err != nil {
+		writeError(w, badRequest("invalid from"))
+		return
+	}
+	to, _, err := parseDateIn(r.FormValue("to"), loc)
+	if err != nil || !to.After(from) {
+		writeError(w, badRequest("invalid to"))
+		return
+	}
+	serveQuery(w, r, EventQuery{Start: from, End: to})
+}
+
+func handleExportICS(w http.ResponseWriter, r *http.Request) {
+	var userID int
+	if userIDStr := r.FormValue("user_id"); userIDStr != "" {
+		id, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			writeError(w, badRequest("invalid user_id"))
+			return
+		}
+		userID = id
+	}
+
+	from, to := time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if fromStr := r.FormValue("from"); fromStr != "" {
+		date, err := parseDate(fromStr)
+		if err != nil {
+			writeError(w, badRequest("invalid from"))
+			return
+		}
+		from = date
+	}
+	if toStr := r.FormValue("to"); toStr != "" {
+		date, err := parseDate(toStr)
+		if err != nil {
+			writeError(w, badRequest("invalid to"))
+			return
+		}
+		to = date
+	}
+	filterByDate := r.FormValue("from") != "" || r.FormValue("to") != ""
+
+	var events []Event
+	for _, event := range visibleEvents(r, calendar.Events()) {
+		if userID != 0 && !event.inCalendarOf(userID) {
+			continue
+		}
+		if filterByDate && !event.occursBetween(from, to) {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	if err := writeICS(w, events); err != nil {
+		slog.Error("Ошибка экспорта календаря", "error", err)
+	}
+}
+
+func handleImportICS(w http.ResponseWriter, r *http.Request) {
+	var userID int
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		id, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			writeError(w, badRequest("invalid user_id"))
+			return
+		}
+		userID = id
+	} else if caller, ok := callerFrom(r); ok {
+		userID = caller.ID
+	}
+
+	body := r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, bodyError(err, "file is required"))
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	items, err := parseICS(body, userID)
+	if err != nil {
+		writeError(w, bodyError(err, err.Error()))
+		return
+	}
+	for i := range items {
+		if items[i].Err == nil && !canAccess(r, items[i].Event.UserID) {
+			items[i].Err = fmt.Errorf("user %d: %w", items[i].Event.UserID, errForbidden)
+		}
+	}
+	results := importICS(calendar, actorOf(r), items)
+
+	imported := 0
+	for _, result := range results {
+		if result.Error == "" {
+			imported++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"imported": imported, "results": results})
+}
+
+// parseEvent reads the event fields from form values, which come either from
+// a form-encoded body or from a JSON object flattened by parseRequest, and
+// validates the result. Every invalid field is reported at once in a
+// validationErrors.
+func parseEvent(form url.Values, event *Event) error {
+	var errs validationErrors
+	failed := make(map[string]bool)
+	fail := func(field, message string) {
+		failed[field] = true
+		errs = append(errs, &validationError{Field: field, Message: message})
 	}
-	event.UserID = userID
 
-	date, err := parseDate(r.FormValue("date"))
+	event.Title = form.Get("title")
+	event.Description = form.Get("description")
+	userID, err := strconv.Atoi(form.Get("user_id"))
 	if err != nil {
-		return fmt.Errorf("invalid date")
+		fail("user_id", "invalid user_id")
+	}
+	event.UserID = userID
+
+	loc := time.UTC
+	if tz := form.Get("timezone"); tz != "" {
+		loc, err = parseLocation(tz)
+		if err != nil {
+			fail("timezone", "invalid timezone")
+			loc = time.UTC
+		} else {
+			event.TimeZone = tz
+		}
 	}
-	event.Date = date
 
-	id, err := strconv.Atoi(r.FormValue("id"))
+	date, allDay, err := parseDateIn(form.Get("date"), loc)
 	if err != nil {
-		return fmt.Errorf("invalid event id")
+		fail("date", "invalid date")
+		// The end cannot be judged without the start.
+		failed["end"] = true
 	}
-	event.ID = id
+	event.AllDay = allDay
+	event.Date = normalizeDate(date, allDay)
 
-	return nil
+	switch {
+	case form.Get("end") != "":
+		end, _, err := parseDateIn(form.Get("end"), loc)
+		if err != nil {
+			fail("end", "invalid end")
+			break
+		}
+		event.End = normalizeDate(end, allDay)
+		if !failed["end"] && !event.End.After(event.Date) {
+			fail("end", "end must be after date")
+		}
+	case form.Get("duration") != "":
+		duration, err := time.ParseDuration(form.Get("duration"))
+		if err != nil || duration < 0 {
+			fail("duration", "invalid duration")
+			failed["end"] = true
+			break
+		}
+		event.End = event.Date.Add(duration)
+	case allDay:
+		event.End = event.Date.AddDate(0, 0, 1)
+	default:
+		event.End = event.Date
+	}
+
+	if rrule := form.Get("rrule"); rrule != "" {
+		event.RRule = rrule
+		if _, err := parseRRule(rrule); err != nil {
+			fail("rrule", fmt.Sprintf("invalid rrule: %v", err))
+		}
+	}
+	exdates := form.Get("exdate")
+	if exdates == "" {
+		exdates = form.Get("exdates")
+	}
+	if exdates != "" {
+		for _, exdateStr := range strings.Split(exdates, ",") {
+			exdate, _, err := parseDateIn(strings.TrimSpace(exdateStr), loc)
+			if err != nil {
+				fail("exdate", "invalid exdate")
+				break
+			}
+			event.ExDates = append(event.ExDates, normalizeDate(exdate, allDay))
+		}
+	}
+
+	if reminders := form.Get("reminders"); reminders != "" {
+		for _, spec := range strings.Split(reminders, ",") {
+			reminder, err := parseReminder(spec)
+			if err != nil {
+				fail("reminders", err.Error())
+				break
+			}
+			event.Reminders = append(event.Reminders, reminder)
+		}
+	}
+
+	// A request without attendees keeps those of the stored event; an
+	// empty list uninvites them all.
+	if attendees, ok := form["attendees"]; ok && len(attendees) > 0 {
+		parsed, err := parseAttendees(attendees[0])
+		if err != nil {
+			fail("attendees", err.Error())
+		}
+		event.Attendees = append([]Attendee{}, parsed...)
+	}
+
+	// Tags are kept and cleared the same way.
+	if tags, ok := form["tags"]; ok && len(tags) > 0 {
+		event.Tags = append([]string{}, normalizeTags(strings.Split(tags[0], ","))...)
+	}
+
+	if idStr := form.Get("id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			fail("id", "invalid event id")
+		}
+		event.ID = id
+	}
+
+	errs = append(errs, validateEvent(*event, failed)...)
+	sortFieldErrors(errs)
+	return errs.err()
 }
 
+var dateLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
 func parseDate(dateStr string) (time.Time, error) {
-	return time.Parse("2006-01-02", dateStr)
+	date, _, err := parseDateIn(dateStr, time.UTC)
+	return date, err
 }
 
-func writeJSON(w http.ResponseWriter, status int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(v)
+// parseDateIn accepts a plain date, an RFC 3339 timestamp or a local
+// date-time without an offset. Everything is returned in loc; dateOnly
+// reports whether no time of day was given.
+func parseDateIn(dateStr string, loc *time.Location) (date time.Time, dateOnly bool, err error) {
+	if date, err := time.ParseInLocation("2006-01-02", dateStr, loc); err == nil {
+		return date, true, nil
+	}
+	if date, err := time.Parse(time.RFC3339Nano, dateStr); err == nil {
+		return date.In(loc), false, nil
+	}
+	for _, layout := range dateLayouts {
+		if date, err := time.ParseInLocation(layout, dateStr, loc); err == nil {
+			return date, false, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q", dateStr)
+}
+
+// normalizeDate converts a parsed date to the form events are stored in:
+// timed events as UTC instants, all-day events as UTC midnight of their date.
+func normalizeDate(date time.Time, allDay bool) time.Time {
+	if allDay {
+		return floatDate(date, time.UTC)
+	}
+	return date.UTC()
 }
 
-func NewCalendar() *Calendar {
-	return &Calendar{events: make(map[int]Event)}
+// parseLocation loads an IANA time zone, UTC when none is given. "Local"
+// is refused: it is the zone of the server, not one a client can name.
+func parseLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	return time.LoadLocation(name)
 }
 
-func (c *Calendar) CreateEvent(event Event) {
-	c.events[event.ID] = event
+// parseRequest fills r.Form from the query string and the body. The body
+// may be form-encoded or a JSON object; JSON values are flattened to the
+// same strings a form would carry, with arrays joined by commas, so both
+// encodings go through the same parsing.
+func parseRequest(r *http.Request) error {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return bodyError(err, fmt.Sprintf("malformed form: %v", err))
+		}
+		return nil
+	}
+
+	var body map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return bodyError(err, fmt.Sprintf("malformed JSON body: %v", err))
+	}
+
+	r.Form = r.URL.Query()
+	return setJSONValues(r.Form, body)
 }
 
-func (c *Calendar) UpdateEvent(id int, event Event) error {
-	if _, exists := c.events[id]; !exists {
-		return fmt.Errorf("event with id %d does not exist", id)
+// setJSONValues sets the fields of a JSON object in form, flattened like
+// parseRequest does.
+func setJSONValues(form url.Values, object map[string]interface{}) error {
+	for key, value := range object {
+		flat, err := flattenJSONValue(value)
+		if err != nil {
+			return badRequest(fmt.Sprintf("unsupported value for %s", key))
+		}
+		if value != nil {
+			form.Set(key, flat)
+		}
 	}
-	c.events[id] = event
 	return nil
 }
 
-func (c *Calendar) DeleteEvent(id int) error {
-	if _, exists := c.events[id]; !exists {
-		return fmt.Errorf("event with id %d does not exist", id)
+func flattenJSONValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]interface{}:
+		// An object stands for a user, such as an attendee of an event.
+		if userID, ok := v["user_id"].(json.Number); ok {
+			return userID.String(), nil
+		}
+		return "", fmt.Errorf("unsupported JSON object")
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			part, err := flattenJSONValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported JSON value %T", value)
 	}
-	delete(c.events, id)
-	return nil
 }
 
-func (c *Calendar) GetEventsForDay(date time.Time) []Event {
-	return c.getEventsByDateRange(date, date.AddDate(0, 0, 1))
+// httpError is an error that knows the status code it is reported with.
+type httpError struct {
+	status  int
+	message string
 }
 
-func (c *Calendar) GetEventsForWeek(date time.Time) []Event {
-	startOfWeek := date.Truncate(time.Hour * 24 * 7)
-	endOfWeek := startOfWeek.AddDate(0, 0, 7)
-	return c.getEventsByDateRange(startOfWeek, endOfWeek)
+func (e *httpError) Error() string {
+	return e.message
 }
 
-func (c *Calendar) GetEventsForMonth(date time.Time) []Event {
-	startOfMonth := date.Truncate(time.Hour * 24 * 30)
-	endOfMonth := startOfMonth.AddDate(0, 1, 0)
-	return c.getEventsByDateRange(startOfMonth, endOfMonth)
+func badRequest(message string) error {
+	return &httpError{status: http.StatusBadRequest, message: message}
 }
 
-func (c *Calendar) getEventsByDateRange(start, end time.Time) []Event {
-	var events []Event
-	for _, event := range c.events {
-		if event.Date.After(start) && event.Date.Before(end) {
-			events = append(events, event)
+// validationError reports a request field whose value is unacceptable.
+type validationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *validationError) Error() string {
+	return e.Message
+}
+
+func invalidField(field, message string) error {
+	return &validationError{Field: field, Message: message}
+}
+
+// errorResponse is the JSON error envelope. Field names the first invalid
+// field and Errors lists all of them.
+type errorResponse struct {
+	Error     string             `json:"error"`
+	Field     string             `json:"field,omitempty"`
+	Errors    []*validationError `json:"errors,omitempty"`
+	Conflicts []Event            `json:"conflicts,omitempty"`
+}
+
+func errorStatus(err error) int {
+	var httpErr *httpError
+	var validationErr *validationError
+	var validationErrs validationErrors
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.status
+	case errors.As(err, &validationErr), errors.As(err, &validationErrs):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errEventNotFound), errors.Is(err, errNoOccurrence), errors.Is(err, errNoVersion):
+		return http.StatusNotFound
+	case errors.Is(err, errEventExists), errors.Is(err, errEventConflict), errors.Is(err, errDeletedVersion):
+		return http.StatusConflict
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errStaleVersion):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errBatchAborted):
+		return http.StatusFailedDependency
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError reports err in the JSON error envelope shared by all handlers.
+func writeError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	response := errorResponse{Error: err.Error()}
+	var validationErr *validationError
+	var validationErrs validationErrors
+	if errors.As(err, &validationErr) {
+		response.Field = validationErr.Field
+		response.Errors = validationErrors{validationErr}
+	}
+	if errors.As(err, &validationErrs) {
+		response.Field = validationErrs[0].Field
+		response.Errors = validationErrs
+	}
+	var conflictErr *conflictError
+	if errors.As(err, &conflictErr) {
+		response.Conflicts = conflictErr.Conflicts
+	}
+	if status == http.StatusInternalServerError {
+		slog.Error("Внутренняя ошибка", "error", err)
+	}
+	writeJSON(w, status, response)
+}
+
+// allowMethods answers requests with any other method with 405.
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allowed := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		methodNotAllowed(w, allowed)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, &httpError{status: http.StatusMethodNotAllowed, message: "method not allowed"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiRoutes are the routes behind authentication and the request limits.
+// Routes without methods check the method themselves.
+var apiRoutes = []struct {
+	pattern string
+	handler http.HandlerFunc
+	methods []string
+}{
+	{"/create_event", handleCreateEvent, []string{http.MethodPost}},
+	{"/update_event", handleUpdateEvent, []string{http.MethodPost}},
+	{"/delete_event", handleDeleteEvent, []string{http.MethodPost}},
+	{"/events_for_day", handleGetEventsForDay, []string{http.MethodGet}},
+	{"/events_for_week", handleGetEventsForWeek, []string{http.MethodGet}},
+	{"/events_for_month", handleGetEventsForMonth, []string{http.MethodGet}},
+	{"/events", handleGetEvents, []string{http.MethodGet}},
+	{"/events/stream", handleEventStream, []string{http.MethodGet}},
+	{"/free_slots", handleFreeSlots, []string{http.MethodGet}},
+	{"/export.ics", handleExportICS, []string{http.MethodGet}},
+	{"/import", handleImportICS, []string{http.MethodPost}},
+	{"/batch", handleBatch, []string{http.MethodPost}},
+	{"/search", handleSearch, []string{http.MethodGet}},
+	{"/api/v1/events", handleAPIEvents, nil},
+	{"/api/v1/events/{id}", handleAPIEvent, nil},
+	{"/api/v1/events/{id}/history", handleEventHistory, []string{http.MethodGet}},
+	{"/api/v1/events/{id}/restore", handleRestoreEvent, []string{http.MethodPost}},
+	{"/api/v1/events/{id}/invite", handleInvite, []string{http.MethodPost}},
+	{"/api/v1/events/{id}/rsvp", handleRSVP, []string{http.MethodPost}},
+	{"/api/v1/deleted_events", handleDeletedEvents, []string{http.MethodGet}},
+	{"/.well-known/caldav", handleWellKnownCalDAV, []string{http.MethodGet, "PROPFIND"}},
+	{"/dav/", handleDAVRoot, nil},
+	{"/dav/principals/{user}/", handleDAVPrincipal, nil},
+	{"/dav/calendars/{user}/", handleDAVHome, nil},
+	{"/dav/calendars/{user}/events/", handleDAVCalendar, nil},
+	{"/dav/calendars/{user}/events/{resource}", handleDAVObject, nil},
+}
+
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, route := range apiRoutes {
+		if route.methods == nil {
+			mux.HandleFunc(route.pattern, route.handler)
+		} else {
+			mux.HandleFunc(route.pattern, allowMethods(route.handler, route.methods...))
+		}
+	}
+	return mux
+}
+
+// newHandler puts the API behind authentication and the request limits,
+// with failed authentication limited by client address in front of it,
+// and wraps everything, including the unauthenticated probes and metrics,
+// in the request ID, logging and metrics middlewares.
+func newHandler(users *userStore, m *metrics, limits requestLimits) http.Handler {
+	api := routes()
+	apiRouteOf := func(r *http.Request) string {
+		_, pattern := api.Handler(r)
+		return pattern
+	}
+	limiter := newRateLimiter(time.Now)
+	limited := chain(api,
+		limits.rateLimitMiddleware(limiter, apiRouteOf),
+		limits.bodyLimitMiddleware(apiRouteOf))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", allowMethods(handleHealthz, http.MethodGet))
+	mux.HandleFunc("/readyz", allowMethods(handleReadyz, http.MethodGet))
+	mux.Handle("/metrics", allowMethods(m.ServeHTTP, http.MethodGet))
+	mux.HandleFunc("/openapi.json", allowMethods(handleOpenAPI, http.MethodGet))
+	mux.Handle("/", chain(authMiddleware(users, limited), limits.authFailureMiddleware(limiter)))
+
+	routeOf := func(r *http.Request) string {
+		if _, pattern := mux.Handler(r); pattern != "/" {
+			return pattern
 		}
+		return apiRouteOf(r)
 	}
-	return events
+	return chain(mux, requestIDMiddleware, loggingMiddleware, m.middleware(routeOf))
 }
 
-var calendar = NewCalendar()
+var calendar *Calendar
 
 func main() {
-	http.HandleFunc("/create_event", handleCreateEvent)
-	http.HandleFunc("/update_event", handleUpdateEvent)
-	http.HandleFunc("/delete_event", handleDeleteEvent)
-	http.HandleFunc("/events_for_day", handleGetEventsForDay)
-	http.HandleFunc("/events_for_week", handleGetEventsForWeek)
-	http.HandleFunc("/events_for_month", handleGetEventsForMonth)
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUserCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+
+	if err := run(cfg); err != nil {
+		slog.Error("Невозможно запустить сервер", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the calendar until SIGINT or SIGTERM, then stops accepting
+// connections, waits for in-flight requests and closes the store.
+func run(cfg *Config) error {
+	store, err := newStore(cfg.Store, cfg.DataDir, cfg.SnapshotInterval)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			slog.Error("Невозможно закрыть хранилище", "error", err)
+		}
+	}()
+	calendar = NewCalendar(store)
+	calendar.WeekStart = cfg.WeekStart
+
+	var users *userStore
+	if cfg.UsersPath != "" {
+		users, err = loadUsers(cfg.UsersPath)
+		if err != nil {
+			return fmt.Errorf("load users: %w", err)
+		}
+	} else {
+		slog.Warn("Аутентификация отключена: файл пользователей не задан")
+	}
+
+	notifiers := map[string]Notifier{
+		"log":     logNotifier{w: os.Stdout},
+		"webhook": newWebhookNotifier(cfg.WebhookURL, 10*time.Second),
+	}
+	if cfg.SMTPAddr != "" {
+		var auth smtp.Auth
+		if cfg.SMTPUser != "" {
+			host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+			auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+		}
+		notifiers["email"] = smtpNotifier{addr: cfg.SMTPAddr, from: cfg.SMTPFrom, auth: auth, send: smtp.SendMail}
+	}
+	statePath := ""
+	if cfg.Store == "file" {
+		statePath = filepath.Join(cfg.DataDir, "reminders.json")
+	}
+	scheduler, err := newReminderScheduler(calendar, realClock{}, notifiers, cfg.ReminderChannel, statePath)
+	if err != nil {
+		return fmt.Errorf("start reminders: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	handler := loggingMiddleware(http.DefaultServeMux)
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		scheduler.Run(ctx, cfg.ReminderInterval)
+	}()
+	if cfg.HistoryRetention > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			purgeDeletedLoop(ctx, calendar, cfg.HistoryRetention, time.Hour)
+		}()
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           newHandler(users, newMetrics(), cfg.Limits),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	server.RegisterOnShutdown(calendar.feed.close)
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Запуск сервера", "addr", cfg.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
 
-	log.Println("Запуск сервера на:8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatalf("Невозможно запустить сервер: %v", err)
+	select {
+	case err := <-serveErr:
+		stop()
+		background.Wait()
+		return err
+	case <-ctx.Done():
 	}
+
+	slog.Info("Остановка сервера")
+	shuttingDown.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Не все запросы завершились до остановки", "error", err)
+		server.Close()
+	}
+	background.Wait()
+	return nil
 }
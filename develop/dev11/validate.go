@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxRRuleLength       = 500
+	maxReminders         = 10
+	maxExDates           = 1000
+	maxTags              = 20
+	maxTagLength         = 50
+)
+
+// Events must start and end within [minEventDate, maxEventDate).
+var (
+	minEventDate = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxEventDate = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// validationErrors reports every invalid field of a request at once.
+type validationErrors []*validationError
+
+func (errs validationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// err returns nil when nothing was collected, so that a nil slice never
+// ends up in a non-nil error interface.
+func (errs validationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// fieldRule is a constraint on a single field of an event; check returns
+// an empty string when the event satisfies it.
+type fieldRule struct {
+	field string
+	check func(Event) string
+}
+
+func required(get func(Event) string) func(Event) string {
+	return func(e Event) string {
+		if strings.TrimSpace(get(e)) == "" {
+			return "is required"
+		}
+		return ""
+	}
+}
+
+func maxLength(n int, get func(Event) string) func(Event) string {
+	return func(e Event) string {
+		if utf8.RuneCountInString(get(e)) > n {
+			return fmt.Sprintf("must be at most %d characters long", n)
+		}
+		return ""
+	}
+}
+
+func maxItems(n int, count func(Event) int) func(Event) string {
+	return func(e Event) string {
+		if count(e) > n {
+			return fmt.Sprintf("must have at most %d items", n)
+		}
+		return ""
+	}
+}
+
+func positive(get func(Event) int) func(Event) string {
+	return func(e Event) string {
+		if get(e) <= 0 {
+			return "must be greater than 0"
+		}
+		return ""
+	}
+}
+
+func inDateRange(get func(Event) time.Time) func(Event) string {
+	return func(e Event) string {
+		if t := get(e); t.Before(minEventDate) || !t.Before(maxEventDate) {
+			return fmt.Sprintf("must be between %s and %s", minEventDate.Format("2006-01-02"), maxEventDate.Format("2006-01-02"))
+		}
+		return ""
+	}
+}
+
+// eventRules are the constraints every event sent by a client has to
+// satisfy, whichever way it arrives.
+var eventRules = []fieldRule{
+	{"title", required(func(e Event) string { return e.Title })},
+	{"title", maxLength(maxTitleLength, func(e Event) string { return e.Title })},
+	{"description", maxLength(maxDescriptionLength, func(e Event) string { return e.Description })},
+	{"user_id", positive(func(e Event) int { return e.UserID })},
+	{"date", inDateRange(func(e Event) time.Time { return e.Date })},
+	{"end", inDateRange(func(e Event) time.Time { return e.End })},
+	{"end", func(e Event) string {
+		if e.End.Before(e.Date) {
+			return "must not be before date"
+		}
+		return ""
+	}},
+	{"rrule", maxLength(maxRRuleLength, func(e Event) string { return e.RRule })},
+	{"exdate", maxItems(maxExDates, func(e Event) int { return len(e.ExDates) })},
+	{"reminders", maxItems(maxReminders, func(e Event) int { return len(e.Reminders) })},
+	{"attendees", maxItems(maxAttendees, func(e Event) int { return len(e.Attendees) })},
+	{"tags", maxItems(maxTags, func(e Event) int { return len(e.Tags) })},
+	{"tags", func(e Event) string {
+		for _, tag := range e.Tags {
+			if utf8.RuneCountInString(tag) > maxTagLength {
+				return fmt.Sprintf("must be at most %d characters long each", maxTagLength)
+			}
+		}
+		return ""
+	}},
+}
+
+// eventFields is the order in which the errors of the fields are reported.
+var eventFields = []string{"id", "title", "description", "user_id", "timezone", "date", "end", "duration", "rrule", "exdate", "reminders", "attendees", "tags"}
+
+func sortFieldErrors(errs validationErrors) {
+	position := func(field string) int {
+		for i, name := range eventFields {
+			if name == field {
+				return i
+			}
+		}
+		return len(eventFields)
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return position(errs[i].Field) < position(errs[j].Field) })
+}
+
+// validateEvent checks the event against eventRules. Fields in skip have
+// already been reported and are not checked again; only the first broken
+// rule of a field is reported.
+func validateEvent(event Event, skip map[string]bool) validationErrors {
+	var errs validationErrors
+	failed := make(map[string]bool)
+	for _, rule := range eventRules {
+		if skip[rule.field] || failed[rule.field] {
+			continue
+		}
+		// An end derived from a broken start would only repeat the error.
+		if rule.field == "end" && failed["date"] {
+			continue
+		}
+		if message := rule.check(event); message != "" {
+			failed[rule.field] = true
+			errs = append(errs, &validationError{Field: rule.field, Message: rule.field + " " + message})
+		}
+	}
+	return errs
+}
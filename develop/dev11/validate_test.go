@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseEventValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		fields []string
+	}{
+		{"valid", url.Values{"title": {"standup"}, "user_id": {"1"}, "date": {"2024-05-06T09:00"}, "end": {"2024-05-06T09:15"}}, nil},
+		{"point in time", url.Values{"title": {"standup"}, "user_id": {"1"}, "date": {"2024-05-06T09:00"}}, nil},
+		{"everything wrong",
+			url.Values{"title": {"  "}, "description": {strings.Repeat("x", maxDescriptionLength+1)}, "user_id": {"-3"}, "date": {"2024-05-06T09:00"}, "end": {"2024-05-06T08:00"}},
+			[]string{"title", "description", "user_id", "end"}},
+		{"unparsable values", url.Values{"title": {"a"}, "user_id": {"x"}, "date": {"soon"}, "end": {"later"}, "rrule": {"FREQ=HOURLY"}},
+			[]string{"user_id", "date", "end", "rrule"}},
+		{"end equal to date", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"2024-05-06T09:00"}, "end": {"2024-05-06T09:00"}}, []string{"end"}},
+		{"out of range", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"1969-12-31"}}, []string{"date"}},
+		{"too long title", url.Values{"title": {strings.Repeat("ж", maxTitleLength+1)}, "user_id": {"1"}, "date": {"2024-05-06"}}, []string{"title"}},
+		{"zoned", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"2024-05-06T09:00"}, "timezone": {"Europe/Berlin"}}, nil},
+		{"unknown timezone", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"2024-05-06"}, "timezone": {"Mars/Olympus_Mons"}}, []string{"timezone"}},
+		{"server timezone", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"2024-05-06"}, "timezone": {"Local"}}, []string{"timezone"}},
+		{"path as timezone", url.Values{"title": {"a"}, "user_id": {"1"}, "date": {"2024-05-06"}, "timezone": {"../../etc/passwd"}}, []string{"timezone"}},
+	}
+
+	for _, tt := range tests {
+		var event Event
+		err := parseEvent(tt.form, &event)
+		var errs validationErrors
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: error = %v, expected validation errors", tt.name, err)
+			continue
+		}
+		var fields []string
+		for _, fieldErr := range errs {
+			fields = append(fields, fieldErr.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s: invalid fields %v, expected %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestValidationResponse(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+
+	requests := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/x-www-form-urlencoded", "title=&user_id=0&date=2024-05-06"},
+		{"application/json", `{"title": "", "user_id": 0, "date": "2024-05-06"}`},
+	}
+	for _, tt := range requests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, expected 422", tt.contentType, rec.Code)
+		}
+		var response errorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Errors) != 2 || response.Errors[0].Field != "title" || response.Errors[1].Field != "user_id" {
+			t.Errorf("%s: got errors %+v, expected title and user_id", tt.contentType, response.Errors)
+		}
+	}
+}
+
+func TestInvalidTimeZone(t *testing.T) {
+	calendar = NewCalendar(newMemoryStore())
+	handler := newHandler(nil, newMetrics(), requestLimits{})
+	for _, target := range []string{
+		"/events_for_day?date=2024-05-06&tz=Mars/Olympus_Mons",
+		"/events_for_week?date=2024-05-06&tz=Local",
+		"/events_for_month?date=2024-05-06&tz=EST5EDT%2F..",
+		"/api/v1/events?from=2024-05-06&to=2024-05-07&tz=Europe/Nowhere",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid tz") {
+			t.Errorf("%s: status %d: %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:lunch\r\nDTSTART;TZID=Local:20240520T120000\r\nSUMMARY:Lunch\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	items, err := parseICS(strings.NewReader(ics), 1)
+	if err != nil || len(items) != 1 || items[0].Err == nil {
+		t.Errorf("TZID=Local accepted: %+v, %v", items, err)
+	}
+}
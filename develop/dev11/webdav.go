@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The parts of WebDAV (RFC 4918) the CalDAV server needs: PROPFIND,
+// multistatus responses and DAV:error bodies. Property values are kept as
+// inner XML written with the prefixes of davPrefixes, which every response
+// declares.
+
+// davPrefixes are the prefixes the namespaces are declared with in the
+// responses.
+var davPrefixes = map[string]string{davNS: "D", calDAVNS: "C", calendarServerNS: "CS"}
+
+// davProp is a property of a resource with its value as inner XML.
+type davProp struct {
+	name  xml.Name
+	value string
+}
+
+// davResource is a resource with the properties PROPFIND and REPORT can
+// return.
+type davResource struct {
+	href  string
+	props []davProp
+}
+
+func (r davResource) prop(name xml.Name) (davProp, bool) {
+	for _, prop := range r.props {
+		if prop.name == name {
+			return prop, true
+		}
+	}
+	return davProp{}, false
+}
+
+func davName(space, local string) xml.Name {
+	return xml.Name{Space: space, Local: local}
+}
+
+func davHref(href string) string {
+	return "<D:href>" + xmlText(href) + "</D:href>"
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// davPropRequest is what a PROPFIND or REPORT asks for: every property,
+// the names of the properties or the listed ones.
+type davPropRequest struct {
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// davResponse is a response element of a multistatus: the properties
+// found and missing, or a status when the resource itself is missing.
+type davResponse struct {
+	href    string
+	status  int
+	found   []davProp
+	missing []xml.Name
+}
+
+func (q davPropRequest) response(resource davResource) davResponse {
+	response := davResponse{href: resource.href}
+	switch {
+	case q.AllProp != nil:
+		for _, prop := range resource.props {
+			if prop.name != calendarData {
+				response.found = append(response.found, prop)
+			}
+		}
+	case q.PropName != nil:
+		for _, prop := range resource.props {
+			response.found = append(response.found, davProp{name: prop.name})
+		}
+	default:
+		for _, name := range q.Prop.Names {
+			if prop, ok := resource.prop(name.XMLName); ok {
+				response.found = append(response.found, prop)
+			} else {
+				response.missing = append(response.missing, name.XMLName)
+			}
+		}
+	}
+	return response
+}
+
+// writeDAVElement writes an element with the prefix of its namespace, or
+// declaring a namespace that has none.
+func writeDAVElement(b *strings.Builder, name xml.Name, inner string) {
+	tag, attrs := name.Local, ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		attrs = ` xmlns="` + xmlText(name.Space) + `"`
+	}
+	if inner == "" {
+		fmt.Fprintf(b, "<%s%s/>", tag, attrs)
+		return
+	}
+	fmt.Fprintf(b, "<%s%s>%s</%s>", tag, attrs, inner, tag)
+}
+
+const davNamespaces = ` xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/"`
+
+func davStatus(status int) string {
+	return fmt.Sprintf("<D:status>HTTP/1.1 %d %s</D:status>", status, http.StatusText(status))
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<D:multistatus" + davNamespaces + ">")
+	for _, response := range responses {
+		b.WriteString("<D:response>" + davHref(response.href))
+		if response.status != 0 {
+			b.WriteString(davStatus(response.status))
+		}
+		for _, propstat := range []struct {
+			props  []davProp
+			status int
+		}{{response.found, http.StatusOK}, {missingProps(response.missing), http.StatusNotFound}} {
+			if len(propstat.props) == 0 {
+				continue
+			}
+			b.WriteString("<D:propstat><D:prop>")
+			for _, prop := range propstat.props {
+				writeDAVElement(&b, prop.name, prop.value)
+			}
+			b.WriteString("</D:prop>" + davStatus(propstat.status) + "</D:propstat>")
+		}
+		b.WriteString("</D:response>")
+	}
+	b.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+func missingProps(names []xml.Name) []davProp {
+	props := make([]davProp, len(names))
+	for i, name := range names {
+		props[i] = davProp{name: name}
+	}
+	return props
+}
+
+// davPrecondition answers with the DAV:error body naming the precondition
+// or postcondition the request failed (RFC 4918, section 16).
+func davPrecondition(w http.ResponseWriter, status int, name xml.Name, inner string) {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<D:error" + davNamespaces + ">")
+	writeDAVElement(&b, name, inner)
+	b.WriteString("</D:error>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, b.String())
+}
+
+// readXMLBody decodes the XML body of a request into v and reports whether
+// there was one.
+func readXMLBody(r *http.Request, v interface{}) (bool, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return false, bodyError(err, "invalid body")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false, nil
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		return false, badRequest("invalid XML body")
+	}
+	return true, nil
+}
+
+// davMethods serves the WebDAV methods of a resource. OPTIONS is answered
+// with the compliance classes and the allowed methods, other methods with
+// 405.
+func davMethods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	methods := []string{http.MethodOptions}
+	for method := range handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allowed := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("DAV", "1, 3, calendar-access")
+			w.Header().Set("Allow", allowed)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		handler, ok := handlers[r.Method]
+		if !ok {
+			methodNotAllowed(w, allowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// propfind answers a PROPFIND for the resource and, at depth 1, for its
+// members. Resources with members refuse infinite depth, which is also
+// what a missing Depth header asks for.
+func propfind(w http.ResponseWriter, r *http.Request, resource davResource, members func() []davResource) {
+	depth := r.Header.Get("Depth")
+	if members != nil && depth != "0" && depth != "1" {
+		davPrecondition(w, http.StatusForbidden, davName(davNS, "propfind-finite-depth"), "")
+		return
+	}
+	var q struct {
+		XMLName xml.Name
+		davPropRequest
+	}
+	found, err := readXMLBody(r, &q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found {
+		q.AllProp = &struct{}{}
+	} else if q.XMLName != davName(davNS, "propfind") {
+		writeError(w, badRequest("expected a DAV:propfind body"))
+		return
+	}
+
+	responses := []davResponse{q.response(resource)}
+	if members != nil && depth == "1" {
+		for _, member := range members() {
+			responses = append(responses, q.response(member))
+		}
+	}
+	writeMultistatus(w, responses)
+}